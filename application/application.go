@@ -1,6 +1,9 @@
 package application
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -11,18 +14,46 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pmylund/go-cache"
 	"github.com/rs/cors"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/handler"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/job"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/live"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/mailin"
 	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/outbox"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/storage"
 )
 
 // Config defines application config
 type Config struct {
-	ListenAddress    string `yaml:"listen"`
-	DbFile           string `yaml:"db_file"`
-	JwtSecret        string `yaml:"jwt_secret"`
-	OAuthAppID       string `yaml:"oauth_appid"`
-	OAuthSecret      string `yaml:"oauth_secret"`
-	OAuthRedirectURL string `yaml:"oauth_redirect"`
-	SessionSecret    string `yaml:"session_secret"`
+	ListenAddress      string               `yaml:"listen"`
+	DbFile             string               `yaml:"db_file"`
+	JwtSecret          string               `yaml:"jwt_secret"`
+	OAuthAppID         string               `yaml:"oauth_appid"`
+	OAuthSecret        string               `yaml:"oauth_secret"`
+	OAuthRedirectURL   string               `yaml:"oauth_redirect"`
+	SessionSecret      string               `yaml:"session_secret"`
+	CursorSecret       string               `yaml:"cursor_secret"`
+	BulkMaxOperations  int                  `yaml:"bulk_max_operations"`
+	IdempotencyTTL     time.Duration        `yaml:"idempotency_ttl"`
+	IdempotencyMaxBody int64                `yaml:"idempotency_max_body"`
+	UndoWindow         time.Duration        `yaml:"undo_window"`
+	Reminders          ReminderConfig       `yaml:"reminders"`
+	Webhooks           WebhookConfig        `yaml:"webhooks"`
+	Outbox             OutboxConfig         `yaml:"outbox"`
+	SyncPolicy         string               `yaml:"sync_conflict_policy"`
+	TrashRetention     time.Duration        `yaml:"trash_retention"`
+	Attachments        AttachmentConfig     `yaml:"attachments"`
+	Jobs               map[string]JobConfig `yaml:"jobs"`
+	Mail               MailConfig           `yaml:"mail"`
+}
+
+// AttachmentConfig defines limits of attachments and storage of their
+// content. Storage is either "local" (default) or "s3"
+type AttachmentConfig struct {
+	MaxSize  int64            `yaml:"max_size"`
+	Storage  string           `yaml:"storage"`
+	LocalDir string           `yaml:"local_dir"`
+	S3       storage.S3Config `yaml:"s3"`
 }
 
 // Runnable defines an interface that can run
@@ -36,12 +67,21 @@ type Migratable interface {
 }
 
 type app struct {
-	config       *Config
-	logger       *logrus.Logger
-	server       *echo.Echo
-	db           *gorm.DB
-	csrfStorage  *cache.Cache
-	tokenStorage *cache.Cache
+	config             *Config
+	logger             *logrus.Logger
+	server             *echo.Echo
+	db                 *gorm.DB
+	csrfStorage        *cache.Cache
+	tokenStorage       *cache.Cache
+	idempotencyStorage *cache.Cache
+	reminders          *reminderScheduler
+	webhooks           *webhookDispatcher
+	outbox             *outbox.Dispatcher
+	liveHub            *live.Hub
+	jobs               *job.Runner
+	blobStore          storage.BlobStore
+	mail               *mailin.Server
+	mailListener       net.Listener
 }
 
 // NewApp instantiates and initializes new application
@@ -53,14 +93,40 @@ func NewApp(config *Config, logger *logrus.Logger) (Runnable, error) {
 	a.server = echo.New()
 	a.server.Use(echologrus.NewWithNameAndLogger("web", a.logger))
 	a.server.Use(mw.Recover())
-	a.server.Use(cors.Default().Handler)
 
 	a.csrfStorage = cache.New(5*time.Minute, 30*time.Second)
 	a.tokenStorage = cache.New(5*time.Minute, 30*time.Second)
+	a.idempotencyStorage = cache.New(handler.DefaultIdempotencyTTL, time.Minute)
 
+	// cursors signed with empty secret could be forged by anyone
+	if a.config.CursorSecret == "" {
+		return nil, errors.New("cursor_secret must be set")
+	}
+	if !handler.IsSyncPolicy(a.config.SyncPolicy) {
+		return nil, fmt.Errorf("unknown sync conflict policy '%s'", a.config.SyncPolicy)
+	}
 	if err := a.initDb(); err != nil {
 		return nil, err
 	}
+	if err := a.initBlobStore(); err != nil {
+		return nil, err
+	}
+	a.reminders = newReminderScheduler(a.db, a.logger, a.config.Reminders)
+	a.webhooks = newWebhookDispatcher(a.db, a.logger, a.config.Webhooks)
+	a.liveHub = live.NewHub()
+	a.initOutbox()
+	if err := a.initJobs(); err != nil {
+		return nil, err
+	}
+	if err := a.initMail(); err != nil {
+		return nil, err
+	}
+	// CalDAV clients are not browsers and use OPTIONS for discovery, so
+	// CalDAV is served before CORS handling
+	a.server.Use(handler.GetCalDAVMiddleware(a.db, a.outboxRetention()))
+	a.server.Use(cors.New(cors.Options{
+		ExposedHeaders: []string{handler.NextCursorHeader},
+	}).Handler)
 	a.initRoutes()
 
 	return a, nil
@@ -78,12 +144,76 @@ func NewMigratable(config *Config, logger *logrus.Logger) (Migratable, error) {
 
 // Run tries to start the application. Panics in case of error
 func (a *app) Run() {
+	if err := a.outbox.Start(); err != nil {
+		panic(err)
+	}
+	if err := a.jobs.Start(); err != nil {
+		panic(err)
+	}
+	a.startMail()
 	a.server.Run(a.config.ListenAddress)
 }
 
 // Migrate runs basic migrations for this simple application
 func (a *app) Migrate() error {
-	return a.db.AutoMigrate(&model.Task{}).Error
+	err := a.db.AutoMigrate(
+		&model.Task{},
+		&model.User{},
+		&model.SavedFilter{},
+		&model.Tag{},
+		&model.Project{},
+		&model.TaskDependency{},
+		&model.Reminder{},
+		&model.ReminderDelivery{},
+		&model.Job{},
+		&model.Comment{},
+		&model.CommentRevision{},
+		&model.Attachment{},
+		&model.TaskEvent{},
+		&model.Webhook{},
+		&model.WebhookDelivery{},
+		&model.OutboxEvent{},
+		&model.OutboxOffset{},
+	).Error
+	if err != nil {
+		return err
+	}
+
+	return a.seedSystemFilters()
+}
+
+// seedSystemFilters creates built-in filters which are available to all users.
+// Filters are matched by name, so running migrations again does not duplicate them
+func (a *app) seedSystemFilters() error {
+	highPriority := 3
+	filters := []model.SavedFilter{
+		{Name: "Open", Filter: model.TaskFilter{Status: model.TaskStatusOpen, OrderBy: "priority"}},
+		{Name: "High priority open", Filter: model.TaskFilter{Status: model.TaskStatusOpen, MinPriority: &highPriority, OrderBy: "priority"}},
+		{Name: "Completed", Filter: model.TaskFilter{Status: model.TaskStatusCompleted, OrderBy: "-updated_at"}},
+		{Name: "Overdue", Filter: model.TaskFilter{Due: model.DueOverdue, OrderBy: "due_at"}},
+		{Name: "Today", Filter: model.TaskFilter{Status: model.TaskStatusOpen, Due: model.DueToday, OrderBy: "due_at"}},
+		{Name: "This week", Filter: model.TaskFilter{Status: model.TaskStatusOpen, Due: model.DueThisWeek, OrderBy: "due_at"}},
+	}
+
+	for _, filter := range filters {
+		count := 0
+		err := a.db.Model(&model.SavedFilter{}).
+			Where("is_system = ? and name = ?", true, filter.Name).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		filter.IsSystem = true
+		if err := a.db.Create(&filter).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (a *app) initDb() error {
@@ -101,3 +231,25 @@ func (a *app) initDb() error {
 
 	return nil
 }
+
+func (a *app) initBlobStore() error {
+	config := a.config.Attachments
+	if config.MaxSize <= 0 {
+		a.config.Attachments.MaxSize = handler.DefaultAttachmentMaxSize
+	}
+
+	var err error
+	switch config.Storage {
+	case "", "local":
+		dir := config.LocalDir
+		if dir == "" {
+			dir = "attachments"
+		}
+		a.blobStore, err = storage.NewLocalStore(dir)
+	case "s3":
+		a.blobStore, err = storage.NewS3Store(config.S3)
+	default:
+		err = fmt.Errorf("unknown attachment storage '%s'", config.Storage)
+	}
+	return err
+}
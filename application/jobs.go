@@ -0,0 +1,162 @@
+package application
+
+import (
+	"time"
+
+	"github.com/seesawlabs/ivan-kirichenko-exercise/job"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"golang.org/x/net/context"
+)
+
+// names of background jobs
+const (
+	jobReminders     = "reminders"
+	jobWebhooks      = "webhooks"
+	jobPurgeTrash    = "purge_trash"
+	jobPurgeOutbox   = "purge_outbox"
+	jobCleanupTokens = "cleanup_tokens"
+)
+
+const defaultTrashRetention = 30 * 24 * time.Hour
+const purgeBatchSize = 500
+
+// JobConfig overrides schedule and timeout of a background job
+type JobConfig struct {
+	Schedule string        `yaml:"schedule"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// initJobs registers background jobs. Schedules and timeouts of jobs can be
+// overridden in config
+func (a *app) initJobs() error {
+	a.jobs = job.NewRunner(a.db, a.logger)
+
+	definitions := []job.Definition{
+		{
+			Name:     jobReminders,
+			Schedule: "@every " + a.reminders.config.Interval.String(),
+			Timeout:  time.Minute,
+			Run: func(ctx context.Context) error {
+				return a.reminders.dispatch(ctx, time.Now())
+			},
+		},
+		{
+			Name:     jobWebhooks,
+			Schedule: "@every " + a.webhooks.config.Interval.String(),
+			Timeout:  5 * time.Minute,
+			Run: func(ctx context.Context) error {
+				return a.webhooks.dispatch(ctx, time.Now())
+			},
+		},
+		{
+			Name:     jobPurgeTrash,
+			Schedule: "0 3 * * *",
+			Timeout:  10 * time.Minute,
+			Run:      a.purgeTrash,
+		},
+		{
+			Name:     jobPurgeOutbox,
+			Schedule: "30 3 * * *",
+			Timeout:  10 * time.Minute,
+			Run:      a.purgeOutbox,
+		},
+		{
+			Name:     jobCleanupTokens,
+			Schedule: "@every 10m",
+			Timeout:  time.Minute,
+			Run:      a.cleanupTokens,
+		},
+	}
+
+	for _, definition := range definitions {
+		if config, ok := a.config.Jobs[definition.Name]; ok {
+			if config.Schedule != "" {
+				definition.Schedule = config.Schedule
+			}
+			if config.Timeout > 0 {
+				definition.Timeout = config.Timeout
+			}
+		}
+		if err := a.jobs.Add(definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeTrash permanently removes tasks which were deleted longer than trash
+// retention period ago, together with their tags, dependencies, reminders,
+// comments, attachments and history. Subtasks of purged tasks become top-level tasks
+func (a *app) purgeTrash(ctx context.Context) error {
+	retention := a.config.TrashRetention
+	if retention <= 0 {
+		retention = defaultTrashRetention
+	}
+	deletedBefore := time.Now().Add(-retention)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ids := []int64{}
+		err := a.db.Model(&model.Task{}).
+			Where("is_deleted = ? and updated_at < ?", true, deletedBefore).
+			Limit(purgeBatchSize).
+			Pluck("id", &ids).Error
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		keys := []string{}
+		if err := a.db.Model(&model.Attachment{}).Where("task_id in (?)", ids).Pluck("storage_key", &keys).Error; err != nil {
+			return err
+		}
+
+		tx := a.db.Begin()
+		statements := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"delete from task_tags where task_id in (?)", []interface{}{ids}},
+			{"delete from task_dependencies where task_id in (?) or blocked_by_id in (?)", []interface{}{ids, ids}},
+			{"delete from reminder_deliveries where reminder_id in (select id from reminders where task_id in (?))", []interface{}{ids}},
+			{"delete from reminders where task_id in (?)", []interface{}{ids}},
+			{"delete from comment_revisions where comment_id in (select id from comments where task_id in (?))", []interface{}{ids}},
+			{"delete from comments where task_id in (?)", []interface{}{ids}},
+			{"delete from attachments where task_id in (?)", []interface{}{ids}},
+			{"delete from task_events where task_id in (?)", []interface{}{ids}},
+			{"update tasks set parent_id = 0 where parent_id in (?)", []interface{}{ids}},
+			{"delete from tasks where id in (?)", []interface{}{ids}},
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement.query, statement.args...).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+		// content of attachments is removed only after their records, so a
+		// failed purge never leaves attachments without content
+		for _, key := range keys {
+			if err := a.blobStore.Delete(key); err != nil {
+				a.logger.Errorf("could not delete attachment content %s: %s", key, err.Error())
+			}
+		}
+		a.logger.Infof("purged %d deleted tasks", len(ids))
+	}
+}
+
+// cleanupTokens removes expired items from in-memory storages
+func (a *app) cleanupTokens(ctx context.Context) error {
+	a.csrfStorage.DeleteExpired()
+	a.tokenStorage.DeleteExpired()
+	a.idempotencyStorage.DeleteExpired()
+	return nil
+}
@@ -0,0 +1,54 @@
+package application
+
+import (
+	"errors"
+	"net"
+
+	"github.com/seesawlabs/ivan-kirichenko-exercise/handler"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/mailin"
+)
+
+// MailConfig defines SMTP listener which turns received mail into tasks. The
+// listener is disabled while listen address is empty. Mail is accepted for
+// addresses at the domain only. Allowed senders are addresses or domains,
+// e.g. someone@example.com or @example.com, empty list allows any sender
+type MailConfig struct {
+	Listen         string   `yaml:"listen"`
+	Domain         string   `yaml:"domain"`
+	MaxMessageSize int64    `yaml:"max_message_size"`
+	AllowedSenders []string `yaml:"allowed_senders"`
+}
+
+// initMail creates SMTP listener if it is enabled. The address is listened
+// on right away, so startup fails if it is taken. Attachments of mail have
+// the same size limit as uploaded ones
+func (a *app) initMail() error {
+	config := a.config.Mail
+	if config.Listen == "" {
+		return nil
+	}
+	if config.Domain == "" {
+		return errors.New("mail domain must be set when mail listener is enabled")
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	receiver := handler.NewMailTaskReceiver(a.db, a.blobStore, config.Domain, a.config.Attachments.MaxSize)
+	a.mail = mailin.NewServer(config.Domain, config.MaxMessageSize, config.AllowedSenders, receiver, a.logger)
+	a.mailListener = listener
+	return nil
+}
+
+// startMail serves SMTP in background on the listener opened by initMail
+func (a *app) startMail() {
+	if a.mail == nil {
+		return
+	}
+	go func() {
+		if err := a.mail.Serve(a.mailListener); err != nil {
+			a.logger.Errorf("mail listener stopped: %s", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package application
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/outbox"
+	"golang.org/x/net/context"
+)
+
+const defaultOutboxRetention = 7 * 24 * time.Hour
+
+// names of outbox subscribers. They identify positions of subscribers in
+// the database, so they must not be changed
+const (
+	subscriberWebhooks = "webhooks"
+	subscriberAudit    = "audit"
+)
+
+// subscriberLive is a name of the transient subscriber which passes events to
+// clients connected to this instance
+const subscriberLive = "live"
+
+// OutboxConfig defines how often the outbox is polled and how long published
+// events are kept
+type OutboxConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval"`
+	Retention    time.Duration `yaml:"retention"`
+}
+
+// initOutbox subscribes in-process consumers of domain events to the outbox
+func (a *app) initOutbox() {
+	a.outbox = outbox.NewDispatcher(a.db, a.logger, a.config.Outbox.PollInterval)
+	a.outbox.Subscribe(subscriberWebhooks, a.webhooks.enqueue)
+	a.outbox.Subscribe(subscriberAudit, a.audit)
+	a.outbox.SubscribeTransient(subscriberLive, a.liveHub.Publish)
+}
+
+// audit writes the event to the log, so changes of tasks can be collected by
+// log storage
+func (a *app) audit(event *model.OutboxEvent) error {
+	a.logger.WithFields(logrus.Fields{
+		"audit":    true,
+		"event_id": event.Id,
+		"user_id":  event.UserID,
+		"task_id":  event.TaskID,
+	}).Info(event.Type)
+	return nil
+}
+
+// purgeOutbox removes events which were published to all subscribers longer
+// than retention period ago
+func (a *app) purgeOutbox(ctx context.Context) error {
+	result := a.db.Exec("delete from outbox where id <= (select min(position) from outbox_offsets) and created_at < ?",
+		time.Now().Add(-a.outboxRetention()))
+	if result.Error != nil {
+		return result.Error
+	}
+	a.logger.Infof("purged %d outbox events", result.RowsAffected)
+	return nil
+}
+
+// outboxRetention returns period published events are kept for
+func (a *app) outboxRetention() time.Duration {
+	if a.config.Outbox.Retention <= 0 {
+		return defaultOutboxRetention
+	}
+	return a.config.Outbox.Retention
+}
@@ -0,0 +1,208 @@
+package application
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/notifier"
+	"golang.org/x/net/context"
+)
+
+const defaultReminderInterval = 30 * time.Second
+const defaultReminderMaxAttempts = 5
+const defaultReminderBackoff = time.Minute
+const maxBackoff = 6 * time.Hour
+const reminderBatchSize = 100
+
+// ReminderConfig defines how reminders are delivered. Log channel is always
+// available, email and webhook channels are enabled when configured
+type ReminderConfig struct {
+	Interval    time.Duration       `yaml:"interval"`
+	MaxAttempts int                 `yaml:"max_attempts"`
+	Backoff     time.Duration       `yaml:"backoff"`
+	SMTP        notifier.SMTPConfig `yaml:"smtp"`
+	WebhookURL  string              `yaml:"webhook_url"`
+}
+
+// reminderScheduler delivers due reminders. It is run periodically by the
+// job runner. All its state is kept in the database, so pending reminders are
+// delivered after restart
+type reminderScheduler struct {
+	db        *gorm.DB
+	logger    *logrus.Logger
+	config    ReminderConfig
+	notifiers map[string]notifier.Notifier
+}
+
+func newReminderScheduler(db *gorm.DB, logger *logrus.Logger, config ReminderConfig) *reminderScheduler {
+	if config.Interval <= 0 {
+		config.Interval = defaultReminderInterval
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultReminderMaxAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultReminderBackoff
+	}
+
+	notifiers := map[string]notifier.Notifier{
+		model.ReminderChannelLog: notifier.NewLogNotifier(logger),
+	}
+	if config.SMTP.Address != "" {
+		notifiers[model.ReminderChannelEmail] = notifier.NewSMTPNotifier(config.SMTP)
+	}
+	if config.WebhookURL != "" {
+		notifiers[model.ReminderChannelWebhook] = notifier.NewWebhookNotifier(config.WebhookURL)
+	}
+
+	return &reminderScheduler{db: db, logger: logger, config: config, notifiers: notifiers}
+}
+
+// channels returns names of configured delivery channels
+func (s *reminderScheduler) channels() []string {
+	channels := make([]string, 0, len(s.notifiers))
+	for channel := range s.notifiers {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// dispatch delivers reminders which are due at the moment. It stops between
+// reminders when the context is done, and the context cancels the delivery
+// in progress
+func (s *reminderScheduler) dispatch(ctx context.Context, now time.Time) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		reminders := []model.Reminder{}
+		err := s.db.Where("status = ? and notify_at <= ?", model.ReminderPending, now).
+			Order("notify_at").
+			Limit(reminderBatchSize).
+			Find(&reminders).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range reminders {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := s.deliver(ctx, &reminders[i], now); err != nil {
+				return err
+			}
+		}
+		if len(reminders) < reminderBatchSize {
+			return nil
+		}
+	}
+}
+
+// deliver makes a single attempt to deliver the reminder and records its
+// result. Failed reminder is retried with exponential backoff until attempts
+// are exhausted. Reminders of completed or deleted tasks are canceled
+func (s *reminderScheduler) deliver(ctx context.Context, reminder *model.Reminder, now time.Time) error {
+	task := model.Task{}
+	err := s.db.First(&task, reminder.TaskID).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	if err == gorm.RecordNotFound || task.IsDeleted || task.IsCompleted {
+		reminder.Status = model.ReminderCanceled
+		reminder.NotifyAt = nil
+		return s.db.Save(reminder).Error
+	}
+
+	user := model.User{}
+	if err := s.db.First(&user, reminder.UserID).Error; err != nil {
+		return err
+	}
+
+	deliveryErr := s.notify(ctx, reminder, &task, &user)
+	delivery := model.ReminderDelivery{
+		ReminderID:  reminder.Id,
+		Channel:     reminder.Channel,
+		IsSuccess:   deliveryErr == nil,
+		AttemptedAt: &now,
+	}
+	reminder.Attempts++
+	if deliveryErr == nil {
+		reminder.Status = model.ReminderSent
+		reminder.SentAt = &now
+		reminder.NotifyAt = nil
+		reminder.LastError = ""
+	} else {
+		delivery.Error = deliveryErr.Error()
+		reminder.LastError = deliveryErr.Error()
+		if reminder.Attempts >= s.config.MaxAttempts {
+			reminder.Status = model.ReminderFailed
+			reminder.NotifyAt = nil
+		} else {
+			notifyAt := now.Add(backoff(s.config.Backoff, reminder.Attempts))
+			reminder.NotifyAt = &notifyAt
+		}
+		s.logger.Warnf("could not deliver reminder %d (attempt %d): %s", reminder.Id, reminder.Attempts, deliveryErr.Error())
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Create(&delivery).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Save(reminder).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *reminderScheduler) notify(ctx context.Context, reminder *model.Reminder, task *model.Task, user *model.User) error {
+	n, ok := s.notifiers[reminder.Channel]
+	if !ok {
+		return fmt.Errorf("channel '%s' is not configured", reminder.Channel)
+	}
+
+	body := task.Title
+	if task.DueAt != nil {
+		location, err := user.Location()
+		if err != nil {
+			location = time.UTC
+		}
+		format := "Mon, 02 Jan 2006 15:04 MST"
+		if task.IsAllDay {
+			location, format = time.UTC, "Mon, 02 Jan 2006"
+		}
+		body += "\nDue: " + task.DueAt.In(location).Format(format)
+	}
+	if task.Description != "" {
+		body += "\n\n" + task.Description
+	}
+
+	return n.Notify(ctx, notifier.Message{
+		UserID:  user.Id,
+		To:      user.Email,
+		TaskID:  task.Id,
+		Subject: "Reminder: " + task.Title,
+		Body:    body,
+		DueAt:   task.DueAt,
+	})
+}
+
+// backoff returns delay before the next delivery attempt. Delay starts with
+// the base one and doubles with every failed attempt
+func backoff(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
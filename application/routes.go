@@ -10,14 +10,142 @@ func (a *app) initRoutes() {
 	a.logger.Infoln("initializing routing and handlers...")
 	defer a.logger.Infoln("initializing routing and handlers")
 
+	// EventSource of browsers can not set headers, so token of the event
+	// stream can be passed in the query as well
+	events := a.server.Group("/task/events")
+	events.Use(handler.GetJwtQueryAuthHandler(a.config.JwtSecret))
+	events.Get("", handler.GetTaskEventsHandler(a.db, a.liveHub))
+
 	// routes for tasks CRUD operations
 	tasks := a.server.Group("/task")
 	tasks.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	tasks.Use(handler.GetIdempotencyMiddleware(a.idempotencyStorage, a.config.IdempotencyTTL, a.config.IdempotencyMaxBody))
 
+	tasks.Get("", handler.GetListTasksHandler(a.db, a.config.CursorSecret))
+	tasks.Get("/export", handler.GetExportTasksHandler(a.db))
 	tasks.Get("/:id", handler.GetGetTaskHandler(a.db))
+	tasks.Get("/:id/subtree", handler.GetTaskSubtreeHandler(a.db))
+	tasks.Get("/:id/occurrences", handler.GetTaskOccurrencesHandler(a.db))
 	tasks.Post("", handler.GetCreateTaskHandler(a.db))
+	tasks.Post("/bulk", handler.GetBulkTaskHandler(a.db, a.config.BulkMaxOperations))
+	tasks.Post("/import", handler.GetImportTasksHandler(a.db))
+	tasks.Post("/import/ics", handler.GetImportICalHandler(a.db))
 	tasks.Patch("/:id", handler.GetUpdateTaskHandler(a.db))
+	tasks.Post("/:id/complete", handler.GetCompleteTaskHandler(a.db))
 	tasks.Delete("/:id", handler.GetDeleteTaskHandler(a.db))
+	tasks.Post("/:id/restore", handler.GetRestoreTaskHandler(a.db))
+	tasks.Put("/:id/tags/:tag_id", handler.GetAddTaskTagHandler(a.db))
+	tasks.Delete("/:id/tags/:tag_id", handler.GetRemoveTaskTagHandler(a.db))
+	tasks.Put("/:id/blockers/:blocker_id", handler.GetAddDependencyHandler(a.db))
+	tasks.Delete("/:id/blockers/:blocker_id", handler.GetRemoveDependencyHandler(a.db))
+	tasks.Get("/:id/graph", handler.GetDependencyGraphHandler(a.db))
+	tasks.Get("/:id/reminders", handler.GetListRemindersHandler(a.db))
+	tasks.Post("/:id/reminders", handler.GetCreateReminderHandler(a.db, a.reminders.channels()))
+	tasks.Delete("/:id/reminders/:reminder_id", handler.GetDeleteReminderHandler(a.db))
+	tasks.Get("/:id/reminders/:reminder_id/deliveries", handler.GetReminderDeliveriesHandler(a.db))
+	tasks.Get("/:id/comments", handler.GetListCommentsHandler(a.db))
+	tasks.Post("/:id/comments", handler.GetAddCommentHandler(a.db))
+	tasks.Patch("/:id/comments/:comment_id", handler.GetEditCommentHandler(a.db))
+	tasks.Delete("/:id/comments/:comment_id", handler.GetDeleteCommentHandler(a.db))
+	tasks.Get("/:id/comments/:comment_id/history", handler.GetCommentHistoryHandler(a.db))
+	tasks.Get("/:id/history", handler.GetTaskHistoryHandler(a.db))
+	tasks.Post("/:id/revert", handler.GetRevertTaskHandler(a.db))
+	tasks.Get("/:id/attachments", handler.GetListAttachmentsHandler(a.db))
+	tasks.Post("/:id/attachments", handler.GetUploadAttachmentsHandler(a.db, a.blobStore, a.config.Attachments.MaxSize))
+	tasks.Get("/:id/attachments/:attachment_id", handler.GetDownloadAttachmentHandler(a.db, a.blobStore))
+	tasks.Delete("/:id/attachments/:attachment_id", handler.GetDeleteAttachmentHandler(a.db, a.blobStore))
+
+	// route for undo of task operations
+	undo := a.server.Group("/undo")
+	undo.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	undo.Use(handler.GetIdempotencyMiddleware(a.idempotencyStorage, a.config.IdempotencyTTL, a.config.IdempotencyMaxBody))
+
+	undo.Post("/:operation_id", handler.GetUndoHandler(a.db, a.config.UndoWindow))
+
+	// routes for sync of offline clients
+	sync := a.server.Group("/sync")
+	sync.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	sync.Use(handler.GetIdempotencyMiddleware(a.idempotencyStorage, a.config.IdempotencyTTL, a.config.IdempotencyMaxBody))
+
+	sync.Get("", handler.GetSyncPullHandler(a.db, a.outboxRetention()))
+	sync.Post("", handler.GetSyncPushHandler(a.db, a.config.SyncPolicy, a.config.BulkMaxOperations))
+
+	// routes for projects
+	projects := a.server.Group("/project")
+	projects.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	projects.Use(handler.GetIdempotencyMiddleware(a.idempotencyStorage, a.config.IdempotencyTTL, a.config.IdempotencyMaxBody))
+
+	projects.Get("", handler.GetListProjectsHandler(a.db))
+	projects.Post("", handler.GetCreateProjectHandler(a.db))
+	projects.Get("/:id", handler.GetGetProjectHandler(a.db))
+	projects.Patch("/:id", handler.GetUpdateProjectHandler(a.db))
+	projects.Delete("/:id", handler.GetDeleteProjectHandler(a.db))
+	projects.Get("/:id/tasks", handler.GetProjectTasksHandler(a.db, a.config.CursorSecret))
+
+	// routes for tags
+	tags := a.server.Group("/tags")
+	tags.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	tags.Use(handler.GetIdempotencyMiddleware(a.idempotencyStorage, a.config.IdempotencyTTL, a.config.IdempotencyMaxBody))
+
+	tags.Get("", handler.GetListTagsHandler(a.db))
+	tags.Post("", handler.GetCreateTagHandler(a.db))
+	tags.Patch("/:id", handler.GetUpdateTagHandler(a.db))
+	tags.Delete("/:id", handler.GetDeleteTagHandler(a.db))
+	tags.Post("/:id/merge", handler.GetMergeTagsHandler(a.db))
+
+	// routes for saved filters
+	filters := a.server.Group("/filters")
+	filters.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	filters.Use(handler.GetIdempotencyMiddleware(a.idempotencyStorage, a.config.IdempotencyTTL, a.config.IdempotencyMaxBody))
+
+	filters.Get("", handler.GetListFiltersHandler(a.db))
+	filters.Post("", handler.GetCreateFilterHandler(a.db))
+	filters.Get("/:id", handler.GetGetFilterHandler(a.db))
+	filters.Patch("/:id", handler.GetUpdateFilterHandler(a.db))
+	filters.Delete("/:id", handler.GetDeleteFilterHandler(a.db))
+	filters.Get("/:id/tasks", handler.GetFilterTasksHandler(a.db, a.config.CursorSecret))
+
+	// routes for webhooks
+	webhooks := a.server.Group("/webhooks")
+	webhooks.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	webhooks.Use(handler.GetIdempotencyMiddleware(a.idempotencyStorage, a.config.IdempotencyTTL, a.config.IdempotencyMaxBody))
+
+	webhooks.Get("", handler.GetListWebhooksHandler(a.db))
+	webhooks.Post("", handler.GetCreateWebhookHandler(a.db))
+	webhooks.Get("/:id", handler.GetGetWebhookHandler(a.db))
+	webhooks.Patch("/:id", handler.GetUpdateWebhookHandler(a.db))
+	webhooks.Delete("/:id", handler.GetDeleteWebhookHandler(a.db))
+	webhooks.Get("/:id/deliveries", handler.GetWebhookDeliveriesHandler(a.db))
+	webhooks.Post("/:id/test", handler.GetTestWebhookHandler(a.db))
+
+	// route for live updates. WebSocket handler authenticates by itself
+	a.server.WebSocket("/ws", handler.GetWebSocketHandler(a.liveHub, a.config.JwtSecret))
+
+	// routes for user settings
+	user := a.server.Group("/user")
+	user.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+
+	user.Get("", handler.GetGetUserHandler(a.db))
+	user.Patch("", handler.GetUpdateUserHandler(a.db))
+	user.Post("/calendar", handler.GetEnableCalendarFeedHandler(a.db))
+	user.Delete("/calendar", handler.GetDisableCalendarFeedHandler(a.db))
+	user.Post("/caldav", handler.GetEnableCalDAVHandler(a.db))
+	user.Delete("/caldav", handler.GetDisableCalDAVHandler(a.db))
+	if a.mail != nil {
+		user.Post("/mail", handler.GetEnableMailHandler(a.db, a.config.Mail.Domain))
+		user.Delete("/mail", handler.GetDisableMailHandler(a.db))
+	}
+
+	// route for calendar feed. It is authorized by secret token in the path
+	a.server.Get("/calendar/:token", handler.GetCalendarFeedHandler(a.db))
+
+	// routes for administration
+	admin := a.server.Group("/admin")
+	admin.Use(handler.GetJwtAuthHandler(a.config.JwtSecret))
+	admin.Use(handler.GetAdminHandler(a.db))
+
+	admin.Get("/jobs", handler.GetListJobsHandler(a.jobs))
+	admin.Post("/jobs/:name/run", handler.GetRunJobHandler(a.jobs))
 
 	// routes for auth
 
@@ -37,6 +165,7 @@ func (a *app) initRoutes() {
 	)
 	a.server.Get("/auth_verify",
 		handler.GetOAuthVerifyHandler(
+			a.db,
 			conf,
 			a.config.JwtSecret,
 			a.config.SessionSecret,
@@ -0,0 +1,222 @@
+package application
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"golang.org/x/net/context"
+)
+
+const defaultWebhookInterval = 10 * time.Second
+const defaultWebhookMaxAttempts = 8
+const defaultWebhookBackoff = 30 * time.Second
+const defaultWebhookTimeout = 10 * time.Second
+const webhookBatchSize = 100
+
+// maxWebhookResponseBody limits part of a response read to reuse the
+// connection
+const maxWebhookResponseBody = 64 << 10
+
+// headers of webhook requests. Signature is a hex HMAC-SHA256 of the body
+// keyed by the webhook secret
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// WebhookConfig defines how webhook deliveries are attempted
+type WebhookConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// webhookDispatcher delivers webhook payloads. Deliveries are created from
+// outbox events and attempted periodically by the job runner. Failed
+// deliveries are retried with exponential backoff until attempts are exhausted
+type webhookDispatcher struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+	config WebhookConfig
+	client *http.Client
+}
+
+func newWebhookDispatcher(db *gorm.DB, logger *logrus.Logger, config WebhookConfig) *webhookDispatcher {
+	if config.Interval <= 0 {
+		config.Interval = defaultWebhookInterval
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultWebhookBackoff
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+
+	// webhooks must not reach internal services: only public addresses are
+	// dialed, proxies are not used and redirects are not followed
+	dialer := &net.Dialer{Timeout: config.Timeout, Control: lib.PublicDialControl}
+	client := &http.Client{
+		Timeout:   config.Timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &webhookDispatcher{
+		db:     db,
+		logger: logger,
+		config: config,
+		client: client,
+	}
+}
+
+// enqueue creates deliveries of the outbox event for active webhooks of its
+// user subscribed to it. Event can be published more than once, so existing
+// deliveries are not duplicated
+func (d *webhookDispatcher) enqueue(event *model.OutboxEvent) error {
+	webhooks := []model.Webhook{}
+	if err := d.db.Where("user_id = ? and is_active = ?", event.UserID, true).Find(&webhooks).Error; err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.Subscribed(event.Type) {
+			continue
+		}
+
+		count := 0
+		err := d.db.Model(&model.WebhookDelivery{}).
+			Where("webhook_id = ? and event_id = ?", webhook.Id, event.Id).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		delivery := model.NewWebhookDelivery(webhook.Id, event.Id, event.Type, event.Payload)
+		if err := d.db.Create(delivery).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatch attempts deliveries which are due at the moment. It stops between
+// deliveries when the context is done, and the context cancels the request
+// in progress
+func (d *webhookDispatcher) dispatch(ctx context.Context, now time.Time) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		deliveries := []model.WebhookDelivery{}
+		err := d.db.Where("status = ? and next_attempt_at <= ?", model.WebhookDeliveryPending, now).
+			Order("next_attempt_at, id").
+			Limit(webhookBatchSize).
+			Find(&deliveries).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range deliveries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := d.deliver(ctx, &deliveries[i], now); err != nil {
+				return err
+			}
+		}
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// deliver makes a single attempt of the delivery and records its outcome.
+// Deliveries of deleted or inactive webhooks become dead right away, except
+// test events
+func (d *webhookDispatcher) deliver(ctx context.Context, delivery *model.WebhookDelivery, now time.Time) error {
+	webhook := model.Webhook{}
+	err := d.db.First(&webhook, delivery.WebhookID).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+
+	var deliveryErr error
+	switch {
+	case err == gorm.RecordNotFound:
+		deliveryErr = fmt.Errorf("webhook was deleted")
+		delivery.Attempts = d.config.MaxAttempts
+	case !webhook.IsActive && delivery.Event != model.WebhookEventTest:
+		deliveryErr = fmt.Errorf("webhook is not active")
+		delivery.Attempts = d.config.MaxAttempts
+	default:
+		delivery.Attempts++
+		delivery.StatusCode, deliveryErr = d.send(ctx, &webhook, delivery)
+	}
+
+	if deliveryErr == nil {
+		delivery.Status = model.WebhookDeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = deliveryErr.Error()
+		if delivery.Attempts >= d.config.MaxAttempts {
+			delivery.Status = model.WebhookDeliveryDead
+			delivery.NextAttemptAt = nil
+		} else {
+			nextAttemptAt := now.Add(backoff(d.config.Backoff, delivery.Attempts))
+			delivery.NextAttemptAt = &nextAttemptAt
+		}
+		d.logger.Warnf("could not deliver webhook %d event %d (attempt %d): %s",
+			delivery.WebhookID, delivery.Id, delivery.Attempts, deliveryErr.Error())
+	}
+
+	return d.db.Save(delivery).Error
+}
+
+// send posts signed payload of the delivery to the webhook. Any status except
+// 2xx is treated as a failure. Response body is never kept, so webhooks can
+// not be used to read responses of other services
+func (d *webhookDispatcher) send(ctx context.Context, webhook *model.Webhook, delivery *model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set(webhookSignatureHeader, "sha256="+lib.HMACSha256(delivery.Payload, webhook.Secret))
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxWebhookResponseBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/job"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// JobRunner defines runner of background jobs which can be managed by admins
+type JobRunner interface {
+	Jobs() ([]model.Job, error)
+	Trigger(name string) error
+}
+
+// GetAdminHandler creates a handler function which allows only admins to
+// proceed. Must be used after JWT authorization middleware
+func GetAdminHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		admin, err := isAdmin(db, currentUserID(c))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+		}
+		if !admin {
+			return echo.NewHTTPError(http.StatusForbidden, NewApiError("admin access required").String())
+		}
+		return nil
+	}
+}
+
+// GetListJobsHandler creates HTTP handler which lists background jobs with
+// their schedules, statistics and results of the last run
+func GetListJobsHandler(runner JobRunner) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		jobs, err := runner.Jobs()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, jobs)
+	}
+}
+
+// GetRunJobHandler creates HTTP handler which starts the job right now. The
+// job runs in background, so handler does not wait for its result
+func GetRunJobHandler(runner JobRunner) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		switch err := runner.Trigger(c.Param("name")); err {
+		case nil:
+			return c.NoContent(http.StatusAccepted)
+		case job.ErrNotFound:
+			return c.JSON(http.StatusNotFound, NewApiError(err.Error()))
+		case job.ErrLocked:
+			return c.JSON(http.StatusConflict, NewApiError(err.Error()))
+		default:
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+	}
+}
+
+// isAdmin checks whether the user is an administrator
+func isAdmin(db *gorm.DB, userID int64) (bool, error) {
+	user := model.User{}
+	err := db.Select("is_admin").First(&user, userID).Error
+	if err == gorm.RecordNotFound {
+		return false, nil
+	}
+	return user.IsAdmin, err
+}
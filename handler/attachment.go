@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/storage"
+)
+
+// DefaultAttachmentMaxSize is used when maximum size of attachment is not
+// configured
+const DefaultAttachmentMaxSize = 10 << 20
+
+// maxAttachmentFiles limits number of files uploaded by one request
+const maxAttachmentFiles = 10
+
+// attachmentFormMemory is the part of multipart form kept in memory, the rest
+// is stored in temporary files
+const attachmentFormMemory = 16 << 20
+
+var errAttachmentNotFound = errors.New("attachment not found")
+
+// GetListAttachmentsHandler creates HTTP handler which lists attachments of
+// the task
+func GetListAttachmentsHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		attachments := []model.Attachment{}
+		if err := db.Where("task_id = ?", task.Id).Order("id").Find(&attachments).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, attachments)
+	}
+}
+
+// GetUploadAttachmentsHandler creates HTTP handler which attaches files
+// uploaded as multipart form field 'files' to the task. Files larger than
+// maxSize are rejected before anything is stored
+func GetUploadAttachmentsHandler(db *gorm.DB, store storage.BlobStore, maxSize int64) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		req := c.Request()
+		req.Body = http.MaxBytesReader(c.Response(), req.Body, maxSize*maxAttachmentFiles+attachmentFormMemory)
+		if err := req.ParseMultipartForm(attachmentFormMemory); err != nil {
+			return c.JSON(http.StatusRequestEntityTooLarge, NewApiError("could not read files: "+err.Error()))
+		}
+		defer req.MultipartForm.RemoveAll()
+
+		files := req.MultipartForm.File["files"]
+		if len(files) == 0 {
+			return c.JSON(http.StatusBadRequest, NewApiError("files must be provided"))
+		}
+		if len(files) > maxAttachmentFiles {
+			return c.JSON(http.StatusBadRequest, NewApiError(fmt.Sprintf("at most %d files can be uploaded at once", maxAttachmentFiles)))
+		}
+		for _, f := range files {
+			if f.Size > maxSize {
+				return c.JSON(http.StatusRequestEntityTooLarge, NewApiError(fmt.Sprintf("file %s is larger than %d bytes", f.Filename, maxSize)))
+			}
+		}
+
+		attachments := []model.Attachment{}
+		for _, f := range files {
+			attachment, err := storeAttachment(db, store, task, f)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+			attachments = append(attachments, *attachment)
+		}
+
+		return c.JSON(http.StatusCreated, attachments)
+	}
+}
+
+// GetDownloadAttachmentHandler creates HTTP handler which responds with
+// content of the attachment. Range and conditional requests are supported
+func GetDownloadAttachmentHandler(db *gorm.DB, store storage.BlobStore) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		attachment, err := findAttachmentFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		blob, err := store.Open(attachment.StorageKey, attachment.Size)
+		if err == storage.ErrNotFound {
+			return c.JSON(http.StatusNotFound, NewApiError("content of the attachment is missing"))
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		defer blob.Close()
+
+		header := c.Response().Header()
+		header.Set("Content-Type", attachment.ContentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+		header.Set("ETag", `"`+attachment.SHA256+`"`)
+
+		modified := time.Time{}
+		if attachment.CreatedAt != nil {
+			modified = *attachment.CreatedAt
+		}
+		http.ServeContent(c.Response(), c.Request(), attachment.Name, modified, blob)
+		return nil
+	}
+}
+
+// GetDeleteAttachmentHandler creates HTTP handler which removes the
+// attachment together with its content
+func GetDeleteAttachmentHandler(db *gorm.DB, store storage.BlobStore) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		attachment, err := findAttachmentFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		if err := db.Delete(attachment).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		if err := store.Delete(attachment.StorageKey); err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// storeAttachment puts uploaded file into the blob store and saves its
+// attachment
+func storeAttachment(db *gorm.DB, store storage.BlobStore, task *model.Task, f *multipart.FileHeader) (*model.Attachment, error) {
+	src, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	return storeAttachmentContent(db, store, task, f.Filename, f.Header.Get("Content-Type"), src)
+}
+
+// storeAttachmentContent puts the content into the blob store and saves its
+// attachment. Content is read twice: to calculate its hash and to store it.
+// Missing or generic content type is detected from the content
+func storeAttachmentContent(db *gorm.DB, store storage.BlobStore, task *model.Task, name, contentType string, src io.ReadSeeker) (*model.Attachment, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType == "" || contentType == "application/octet-stream" {
+		head := make([]byte, 512)
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		n, _ := io.ReadFull(src, head)
+		contentType = http.DetectContentType(head[:n])
+	}
+
+	random, err := lib.GenerateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	attachment := &model.Attachment{
+		UserID:      task.UserID,
+		TaskID:      task.Id,
+		Name:        filepath.Base(name),
+		Size:        size,
+		ContentType: contentType,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		StorageKey:  fmt.Sprintf("%d/%d/%s", task.UserID, task.Id, hex.EncodeToString(random)),
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := store.Put(attachment.StorageKey, src, size, contentType); err != nil {
+		return nil, err
+	}
+	if err := db.Create(attachment).Error; err != nil {
+		store.Delete(attachment.StorageKey)
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// findAttachmentFromRequest loads attachment of current user's task. Ids of
+// both are provided in the path of the request
+func findAttachmentFromRequest(c *echo.Context, db *gorm.DB) (*model.Attachment, error) {
+	task, err := findTaskFromRequest(c, db)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(c.Param("attachment_id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	attachment := &model.Attachment{}
+	err = db.Where("task_id = ?", task.Id).First(attachment, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, NewApiError(errAttachmentNotFound.Error()).String())
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+	return attachment, nil
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/storage"
+)
+
+func TestUploadAttachmentsSizeLimit(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const maxSize = 100
+	task := createTestTask(t, db, "Task with files")
+	e := newTestServer()
+	e.Post("/task/:id/attachments", GetUploadAttachmentsHandler(db, store, maxSize))
+	upload := func(sizes ...int) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		for i, size := range sizes {
+			w, err := form.CreateFormFile("files", fmt.Sprintf("file%d.txt", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(bytes.Repeat([]byte("x"), size))
+		}
+		form.Close()
+
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/task/%d/attachments", task.Id), body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := upload(maxSize); rec.Code != http.StatusCreated {
+		t.Fatalf("file of maximum size: expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	if rec := upload(1, maxSize+1); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("file over maximum size: expected status %d, got %d: %s", http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+	}
+
+	count := 0
+	if err := db.Model(&model.Attachment{}).Where("task_id = ?", task.Id).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("rejected upload must store nothing, found %d attachments", count)
+	}
+}
@@ -2,21 +2,28 @@ package handler
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
 
 	"github.com/labstack/echo"
 	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
 	"golang.org/x/oauth2"
 )
 
 const defaultTokenExpiration time.Duration = 5 * time.Minute
 const issuer string = "demoapp"
 const bearer = "Bearer"
+const facebookProfileURL = "https://graph.facebook.com/me?fields=id,name"
+
+// userIDKey is a key of the context value with ID of authorized user
+const userIDKey = "user_id"
 
 // TokenStorage defines some key-value storage for tokens by session id
 type TokenStorage interface {
@@ -29,12 +36,6 @@ type TokenStorage interface {
 // based on JWT token in incoming request. Can be used as middleware
 func GetJwtAuthHandler(jwtSecret string) echo.HandlerFunc {
 	return func(c *echo.Context) error {
-
-		// Skip WebSocket
-		if (c.Request().Header.Get(echo.Upgrade)) == echo.WebSocket {
-			return nil
-		}
-
 		auth := c.Request().Header.Get("Authorization")
 		l := len(bearer)
 
@@ -44,41 +45,80 @@ func GetJwtAuthHandler(jwtSecret string) echo.HandlerFunc {
 			)
 		}
 
-		_, err := jwt.Parse(auth[l+1:], func(token *jwt.Token) (interface{}, error) {
-
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-
-			if iss, ok := token.Claims["iss"].(string); !ok {
-				return nil, errors.New("issuer not provided")
-			} else if iss != issuer {
-				return nil, errors.New("incorrect issuer provided")
-			}
-
-			accessToken, found := token.Claims["access_token"].(string)
-			if !found {
-				return nil, errors.New("access token not provided")
-			}
+		userID, err := parseJwtToken(auth[l+1:], jwtSecret)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized,
+				NewApiError(err.Error()).String(),
+			)
+		}
+		c.Set(userIDKey, userID)
 
-			expirationTime, _ := token.Claims["exp"].(float64)
-			if int64(expirationTime) < time.Now().Unix() {
-				return nil, errors.New("access token has expired, try to authenticate again")
-			}
+		return nil
+	}
+}
 
-			return getJwtSignature(jwtSecret, accessToken), nil
-		})
+// GetJwtQueryAuthHandler creates a handler function which works like the one
+// of GetJwtAuthHandler, but also accepts JWT token in 'token' query param.
+// It is meant for clients which can not set headers, e.g. EventSource of
+// browsers
+func GetJwtQueryAuthHandler(jwtSecret string) echo.HandlerFunc {
+	headerAuth := GetJwtAuthHandler(jwtSecret)
+	return func(c *echo.Context) error {
+		token := c.Query("token")
+		if token == "" {
+			return headerAuth(c)
+		}
 
+		userID, err := parseJwtToken(token, jwtSecret)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusUnauthorized,
 				NewApiError(err.Error()).String(),
 			)
 		}
+		c.Set(userIDKey, userID)
 
 		return nil
 	}
 }
 
+// parseJwtToken verifies JWT token and returns ID of the user it was issued to
+func parseJwtToken(raw, jwtSecret string) (int64, error) {
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+
+		if iss, ok := token.Claims["iss"].(string); !ok {
+			return nil, errors.New("issuer not provided")
+		} else if iss != issuer {
+			return nil, errors.New("incorrect issuer provided")
+		}
+
+		accessToken, found := token.Claims["access_token"].(string)
+		if !found {
+			return nil, errors.New("access token not provided")
+		}
+
+		expirationTime, _ := token.Claims["exp"].(float64)
+		if int64(expirationTime) < time.Now().Unix() {
+			return nil, errors.New("access token has expired, try to authenticate again")
+		}
+
+		return getJwtSignature(jwtSecret, accessToken), nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	userID, _ := token.Claims["uid"].(float64)
+	if userID <= 0 {
+		return 0, errors.New("user is not provided, try to authenticate again")
+	}
+	return int64(userID), nil
+}
+
 // GetOAuthHandler creates a handler function that starts authorization process
 // using Facebook as OAuth provider
 func GetOAuthHandler(conf oauth2.Config, sessionSecret string, csrfStorage TokenStorage) echo.HandlerFunc {
@@ -108,7 +148,7 @@ func GetOAuthHandler(conf oauth2.Config, sessionSecret string, csrfStorage Token
 // GetOAuthVerifyHandler creates a handler function that checks response of
 // OAuth provider (Facebook), performs authorization of the user in our system
 // and responds with JWT that should be used as access token to our API
-func GetOAuthVerifyHandler(conf oauth2.Config, jwtSecret, sessionSecret string, csrfStorage TokenStorage) echo.HandlerFunc {
+func GetOAuthVerifyHandler(db *gorm.DB, conf oauth2.Config, jwtSecret, sessionSecret string, csrfStorage TokenStorage) echo.HandlerFunc {
 	// oauthVerifyResponse is a type which is used only within oauth verify handler
 	type oauthVerifyResponse struct {
 		Token   string `json:"jwt_token"`
@@ -146,8 +186,14 @@ func GetOAuthVerifyHandler(conf oauth2.Config, jwtSecret, sessionSecret string,
 			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
 		}
 
+		user, err := getFacebookUser(db, conf, oauthToken)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError("could not get user: "+err.Error()))
+		}
+
 		jwtToken := jwt.New(jwt.SigningMethodHS256)
 		jwtToken.Claims["iss"] = issuer
+		jwtToken.Claims["uid"] = user.Id
 		jwtToken.Claims["iat"] = time.Now().Unix()
 		jwtToken.Claims["exp"] = oauthToken.Expiry.Unix()
 		jwtToken.Claims["access_token"] = oauthToken.AccessToken
@@ -164,6 +210,40 @@ func GetOAuthVerifyHandler(conf oauth2.Config, jwtSecret, sessionSecret string,
 	}
 }
 
+// getFacebookUser fetches profile of the authenticated facebook user and
+// finds or registers the corresponding user in our system
+func getFacebookUser(db *gorm.DB, conf oauth2.Config, oauthToken *oauth2.Token) (*model.User, error) {
+	resp, err := conf.Client(oauth2.NoContext, oauthToken).Get(facebookProfileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	profile := struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, err
+	}
+	if profile.ID == "" {
+		return nil, errors.New("facebook did not provide user id")
+	}
+
+	user := &model.User{}
+	err = db.Where(model.User{FacebookID: profile.ID}).
+		Assign(model.User{Name: profile.Name}).
+		FirstOrCreate(user).Error
+
+	return user, err
+}
+
+// currentUserID returns ID of the user authorized by JWT auth handler
+func currentUserID(c *echo.Context) int64 {
+	userID, _ := c.Get(userIDKey).(int64)
+	return userID
+}
+
 func getJwtSignature(jwtSecret, accessToken string) []byte {
 	var buffer bytes.Buffer
 	buffer.WriteString(accessToken)
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// bulk operation modes
+const (
+	bulkModeAtomic     = "atomic"
+	bulkModeBestEffort = "best_effort"
+)
+
+// DefaultBulkMaxOperations is used when limit of operations in a bulk request
+// is not configured
+const DefaultBulkMaxOperations = 100
+
+// bulkOperation defines a single item of a bulk request
+type bulkOperation struct {
+	Op    string          `json:"op"`
+	ID    int64           `json:"id"`
+	Task  json.RawMessage `json:"task"`
+	Force bool            `json:"force"`
+}
+
+// bulkRequest defines input of bulk tasks operation
+type bulkRequest struct {
+	Mode       string          `json:"mode"`
+	Operations []bulkOperation `json:"operations"`
+}
+
+// bulkResult defines outcome of a single item of a bulk request
+type bulkResult struct {
+	Index  int         `json:"index"`
+	Op     string      `json:"op"`
+	Status int         `json:"status"`
+	Task   *model.Task `json:"task,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// bulkResponse defines output of bulk tasks operation. All changes of the
+// request belong to a single operation, so they are undone together
+type bulkResponse struct {
+	Mode        string       `json:"mode"`
+	Applied     bool         `json:"applied"`
+	OperationID string       `json:"operation_id,omitempty"`
+	Results     []bulkResult `json:"results"`
+}
+
+// GetBulkTaskHandler creates HTTP handler which performs a batch of create,
+// update, complete, delete and restore operations with tasks. In atomic mode
+// either all operations are applied or none of them. In best effort mode
+// every operation is applied independently
+func GetBulkTaskHandler(db *gorm.DB, maxOperations int) echo.HandlerFunc {
+	if maxOperations <= 0 {
+		maxOperations = DefaultBulkMaxOperations
+	}
+
+	return func(c *echo.Context) error {
+		req := bulkRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if req.Mode == "" {
+			req.Mode = bulkModeAtomic
+		}
+		if req.Mode != bulkModeAtomic && req.Mode != bulkModeBestEffort {
+			return c.JSON(http.StatusBadRequest, NewApiError("mode must be either 'atomic' or 'best_effort'"))
+		}
+		if len(req.Operations) == 0 {
+			return c.JSON(http.StatusBadRequest, NewApiError("no operations provided"))
+		}
+		if len(req.Operations) > maxOperations {
+			return c.JSON(http.StatusRequestEntityTooLarge,
+				NewApiError(fmt.Sprintf("too many operations, at most %d are allowed", maxOperations)),
+			)
+		}
+
+		userID := currentUserID(c)
+		resp := bulkResponse{Mode: req.Mode, Results: make([]bulkResult, len(req.Operations))}
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		if req.Mode == bulkModeBestEffort {
+			failed := false
+			for i, op := range req.Operations {
+				resp.Results[i] = applyBulkOperation(opDB, userID, i, op)
+				failed = failed || resp.Results[i].Error != ""
+			}
+			resp.Applied = true
+			resp.OperationID = opID
+			c.Response().Header().Set(OperationIDHeader, opID)
+
+			if failed {
+				return c.JSON(http.StatusMultiStatus, resp)
+			}
+			return c.JSON(http.StatusOK, resp)
+		}
+
+		tx := opDB.Begin()
+		if tx.Error != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(tx.Error.Error()))
+		}
+		for i, op := range req.Operations {
+			resp.Results[i] = applyBulkOperation(tx, userID, i, op)
+			if resp.Results[i].Error == "" {
+				continue
+			}
+
+			tx.Rollback()
+			// nothing was applied, so none of the results is valid anymore
+			for j := range resp.Results {
+				if j != i {
+					resp.Results[j] = bulkResult{
+						Index:  j,
+						Op:     req.Operations[j].Op,
+						Status: http.StatusFailedDependency,
+						Error:  "not applied due to failure of another operation",
+					}
+				}
+			}
+			return c.JSON(http.StatusUnprocessableEntity, resp)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		resp.Applied = true
+		resp.OperationID = opID
+		c.Response().Header().Set(OperationIDHeader, opID)
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// applyBulkOperation performs single operation of a bulk request
+func applyBulkOperation(db *gorm.DB, userID int64, index int, op bulkOperation) bulkResult {
+	result := bulkResult{Index: index, Op: op.Op, Status: http.StatusOK}
+
+	var err error
+	switch op.Op {
+	case "create":
+		if len(op.Task) == 0 {
+			return bulkError(result, http.StatusBadRequest, "task must be provided")
+		}
+		result.Status = http.StatusCreated
+		result.Task = &model.Task{}
+		if err := json.Unmarshal(op.Task, result.Task); err != nil {
+			return bulkError(result, http.StatusBadRequest, errInvalidTask.Error())
+		}
+		err = createTask(db, userID, result.Task)
+	case "update":
+		if len(op.Task) == 0 {
+			return bulkError(result, http.StatusBadRequest, "task must be provided")
+		}
+		result.Task, err = updateTask(db, userID, op.ID, op.Task)
+	case "complete":
+		result.Task, err = completeTask(db, userID, op.ID, op.Force)
+	case "delete":
+		result.Task, err = deleteTask(db, userID, op.ID)
+	case "restore":
+		result.Task, err = restoreTask(db, userID, op.ID)
+	default:
+		return bulkError(result, http.StatusBadRequest, "unknown operation: "+op.Op)
+	}
+
+	if err != nil {
+		return bulkError(result, taskErrorStatus(err), err.Error())
+	}
+	return result
+}
+
+func bulkError(result bulkResult, status int, message string) bulkResult {
+	result.Status = status
+	result.Task = nil
+	result.Error = message
+	return result
+}
@@ -0,0 +1,753 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// calDAVPrefix is a path all CalDAV resources are located under
+const calDAVPrefix = "/caldav/"
+
+// names of calendar collections. Tasks without project are kept in a
+// collection of their own
+const (
+	calDAVTasksCollection  = "tasks"
+	calDAVProjectPrefix    = "project-"
+	calDAVTasksDisplayName = "Tasks"
+)
+
+const calDAVContentType = "text/calendar; charset=utf-8; component=VTODO"
+const calDAVSyncTokenPrefix = "http://" + icalUIDDomain + "/ns/sync/"
+
+// maxCalDAVResourceSize limits size of a single uploaded resource
+const maxCalDAVResourceSize = 1 << 20
+
+var errPreconditionFailed = errors.New("precondition failed")
+var errCalDAVUIDConflict = errors.New("UID is used by another resource")
+
+// preconditions of failed CalDAV requests
+var (
+	davValidSyncToken        = xml.Name{Space: davNS, Local: "valid-sync-token"}
+	calDAVSupportedComponent = xml.Name{Space: calDAVNS, Local: "supported-calendar-component"}
+	calDAVValidData          = xml.Name{Space: calDAVNS, Local: "valid-calendar-data"}
+	calDAVNoUIDConflict      = xml.Name{Space: calDAVNS, Local: "no-uid-conflict"}
+)
+
+// calDAVResponse defines output of enable CalDAV operation. Password is
+// shown only once
+type calDAVResponse struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// calDAVCollection defines calendar collection of user's tasks
+type calDAVCollection struct {
+	Name        string
+	DisplayName string
+	ProjectID   int64
+}
+
+// calDAVServer serves CalDAV requests of authenticated user
+type calDAVServer struct {
+	db        *gorm.DB
+	retention time.Duration
+	userID    int64
+	home      string
+}
+
+// GetEnableCalDAVHandler creates HTTP handler which generates a new password
+// for CalDAV clients of current user. Only hash of the password is stored.
+// Password issued before stops working
+func GetEnableCalDAVHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		password, err := lib.GenerateRandomString(18)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		err = db.Model(&model.User{}).Where("id = ?", currentUserID(c)).
+			UpdateColumns(map[string]interface{}{"caldav_password": lib.Sha256(password), "updated_at": time.Now()}).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, calDAVResponse{
+			URL:      requestBaseURL(c) + calDAVPrefix,
+			Username: strconv.FormatInt(currentUserID(c), 10),
+			Password: password,
+		})
+	}
+}
+
+// GetDisableCalDAVHandler creates HTTP handler which revokes CalDAV password
+// of current user
+func GetDisableCalDAVHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		err := db.Model(&model.User{}).Where("id = ?", currentUserID(c)).
+			UpdateColumns(map[string]interface{}{"caldav_password": "", "updated_at": time.Now()}).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetCalDAVMiddleware creates middleware which serves CalDAV requests. Router
+// does not know WebDAV methods, so requests under /caldav/ are taken over
+// before routing. Clients authenticate with Basic auth: id of the user and
+// the password issued for CalDAV. Every project is a calendar collection of
+// VTODO resources named by their UIDs, unless client stored the resource
+// under a name of its own. Deleted tasks are not shown
+func GetCalDAVMiddleware(db *gorm.DB, retention time.Duration) echo.MiddlewareFunc {
+	return func(h echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			p := c.Request().URL.Path
+			if p == "/.well-known/caldav" {
+				return c.Redirect(http.StatusMovedPermanently, calDAVPrefix)
+			}
+			if !strings.HasPrefix(p+"/", calDAVPrefix) {
+				return h(c)
+			}
+
+			if c.Request().Method == echo.OPTIONS {
+				c.Response().Header().Set("DAV", "1, 3, calendar-access")
+				c.Response().Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+				return c.NoContent(http.StatusOK)
+			}
+
+			userID, ok := authenticateCalDAV(db, c.Request())
+			if !ok {
+				c.Response().Header().Set("WWW-Authenticate", `Basic realm="tasks"`)
+				return c.String(http.StatusUnauthorized, "authorization required")
+			}
+
+			s := &calDAVServer{
+				db:        db,
+				retention: retention,
+				userID:    userID,
+				home:      calDAVPrefix + strconv.FormatInt(userID, 10) + "/",
+			}
+			return s.serve(c)
+		}
+	}
+}
+
+// authenticateCalDAV returns id of the user the Basic credentials belong to
+func authenticateCalDAV(db *gorm.DB, req *http.Request) (int64, bool) {
+	username, password, ok := req.BasicAuth()
+	if !ok || password == "" {
+		return 0, false
+	}
+	userID, err := strconv.ParseInt(username, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	user := model.User{}
+	if err := db.First(&user, userID).Error; err != nil || user.CalDAVPassword == "" {
+		return 0, false
+	}
+	hash := lib.Sha256(password)
+	return user.Id, subtle.ConstantTimeCompare([]byte(hash), []byte(user.CalDAVPassword)) == 1
+}
+
+// serve dispatches the request by depth of its path: root, home of the user,
+// calendar collection or task resource
+func (s *calDAVServer) serve(c *echo.Context) error {
+	method := c.Request().Method
+	rest := strings.Trim(strings.TrimPrefix(c.Request().URL.Path, calDAVPrefix), "/")
+	parts := []string{}
+	if rest != "" {
+		parts = strings.Split(rest, "/")
+	}
+
+	if len(parts) == 0 {
+		if method != "PROPFIND" {
+			return c.String(http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return s.propfindRoot(c)
+	}
+	if parts[0] != strconv.FormatInt(s.userID, 10) {
+		return c.String(http.StatusForbidden, "access denied")
+	}
+	if len(parts) == 1 {
+		if method != "PROPFIND" {
+			return c.String(http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return s.propfindHome(c)
+	}
+
+	collection, err := s.findCollection(parts[1])
+	if err == errProjectNotFound {
+		return c.String(http.StatusNotFound, "collection not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+
+	if len(parts) == 2 {
+		switch method {
+		case "PROPFIND":
+			return s.propfindCollection(c, collection)
+		case "REPORT":
+			return s.report(c, collection)
+		default:
+			return c.String(http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+	if len(parts) > 3 {
+		return c.String(http.StatusNotFound, "resource not found")
+	}
+
+	name := strings.TrimSuffix(parts[2], ".ics")
+	switch method {
+	case echo.GET, echo.HEAD:
+		return s.get(c, collection, name)
+	case echo.PUT:
+		return s.put(c, collection, name)
+	case echo.DELETE:
+		return s.delete(c, collection, name)
+	case "PROPFIND":
+		return s.propfindResource(c, collection, name)
+	default:
+		return c.String(http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *calDAVServer) propfindRoot(c *echo.Context) error {
+	req, err := parseDAVRequest(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "%s", err)
+	}
+
+	props := davProps{
+		davResourceType:         "<d:collection/>",
+		davCurrentUserPrincipal: davHref(s.home),
+	}
+	return writeMultistatus(c.Response(), []davResponse{newDAVResponse(calDAVPrefix, props, req.requested())}, "")
+}
+
+// propfindHome describes home of the user, which is both the principal and
+// the set of calendar collections
+func (s *calDAVServer) propfindHome(c *echo.Context) error {
+	req, err := parseDAVRequest(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "%s", err)
+	}
+
+	user := model.User{}
+	if err := s.db.First(&user, s.userID).Error; err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+	props := davProps{
+		davResourceType:         "<d:collection/><d:principal/>",
+		davDisplayName:          davText(user.Name),
+		davCurrentUserPrincipal: davHref(s.home),
+		davPrincipalURL:         davHref(s.home),
+		calDAVCalendarHomeSet:   davHref(s.home),
+	}
+	responses := []davResponse{newDAVResponse(s.home, props, req.requested())}
+
+	if davDepth(c.Request()) > 0 {
+		collections, err := s.collections()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "%s", err)
+		}
+		token, err := s.currentSyncToken()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "%s", err)
+		}
+		for _, collection := range collections {
+			responses = append(responses,
+				newDAVResponse(s.collectionHref(collection), s.collectionProps(collection, token), req.requested()))
+		}
+	}
+	return writeMultistatus(c.Response(), responses, "")
+}
+
+func (s *calDAVServer) propfindCollection(c *echo.Context, collection *calDAVCollection) error {
+	req, err := parseDAVRequest(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "%s", err)
+	}
+
+	token, err := s.currentSyncToken()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+	responses := []davResponse{
+		newDAVResponse(s.collectionHref(collection), s.collectionProps(collection, token), req.requested()),
+	}
+
+	if davDepth(c.Request()) > 0 {
+		tasks, err := s.collectionTasks(collection)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "%s", err)
+		}
+		for i := range tasks {
+			responses = append(responses, s.taskResponse(collection, &tasks[i], req.requested()))
+		}
+	}
+	return writeMultistatus(c.Response(), responses, "")
+}
+
+func (s *calDAVServer) propfindResource(c *echo.Context, collection *calDAVCollection, name string) error {
+	req, err := parseDAVRequest(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "%s", err)
+	}
+
+	task, err := s.findTask(s.db, collection, name)
+	if err == errTaskNotFound {
+		return c.String(http.StatusNotFound, "%s", err)
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+	return writeMultistatus(c.Response(), []davResponse{s.taskResponse(collection, task, req.requested())}, "")
+}
+
+// report serves calendar-query, calendar-multiget and sync-collection
+// reports. Filters of calendar-query are not applied: every task of the
+// collection is a VTODO, and clients filter the rest by themselves
+func (s *calDAVServer) report(c *echo.Context, collection *calDAVCollection) error {
+	req, err := parseDAVRequest(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "%s", err)
+	}
+
+	switch req.XMLName {
+	case xml.Name{Space: calDAVNS, Local: "calendar-query"}:
+		tasks, err := s.collectionTasks(collection)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "%s", err)
+		}
+		responses := []davResponse{}
+		for i := range tasks {
+			responses = append(responses, s.taskResponse(collection, &tasks[i], req.requested()))
+		}
+		return writeMultistatus(c.Response(), responses, "")
+
+	case xml.Name{Space: calDAVNS, Local: "calendar-multiget"}:
+		responses := []davResponse{}
+		for _, href := range req.Hrefs {
+			name := strings.TrimSuffix(path.Base(href), ".ics")
+			if unescaped, err := url.PathUnescape(name); err == nil {
+				name = unescaped
+			}
+			task, err := s.findTask(s.db, collection, name)
+			if err == errTaskNotFound {
+				responses = append(responses, davResponse{Href: href, Status: http.StatusNotFound})
+				continue
+			} else if err != nil {
+				return c.String(http.StatusInternalServerError, "%s", err)
+			}
+			responses = append(responses, s.taskResponse(collection, task, req.requested()))
+		}
+		return writeMultistatus(c.Response(), responses, "")
+
+	case xml.Name{Space: davNS, Local: "sync-collection"}:
+		return s.syncCollection(c, collection, req)
+
+	default:
+		return writeDAVError(c.Response(), http.StatusForbidden, xml.Name{Space: davNS, Local: "supported-report"})
+	}
+}
+
+// syncCollection reports tasks changed since the sync token. Changes are
+// read from the outbox, so the token expires the same way as tokens of sync
+// API. Task which is deleted or moved to another collection is reported as
+// removed. Tasks changed in other collections are reported as removed as
+// well, which clients ignore, because they do not know them
+func (s *calDAVServer) syncCollection(c *echo.Context, collection *calDAVCollection, req *davRequest) error {
+	next, err := s.currentSyncToken()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+
+	responses := []davResponse{}
+	if req.SyncToken == "" {
+		tasks, err := s.collectionTasks(collection)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "%s", err)
+		}
+		for i := range tasks {
+			responses = append(responses, s.taskResponse(collection, &tasks[i], req.requested()))
+		}
+		return writeMultistatus(c.Response(), responses, calDAVSyncTokenPrefix+next.String())
+	}
+
+	token, err := parseSyncToken(strings.TrimPrefix(req.SyncToken, calDAVSyncTokenPrefix))
+	if err != nil || !strings.HasPrefix(req.SyncToken, calDAVSyncTokenPrefix) ||
+		time.Since(time.Unix(token.IssuedAt, 0)) > s.retention-syncTokenMargin {
+		return writeDAVError(c.Response(), http.StatusForbidden, davValidSyncToken)
+	}
+
+	ids := []int64{}
+	err = s.db.Model(&model.OutboxEvent{}).
+		Where("user_id = ? and id > ? and task_id > 0", s.userID, token.ID).
+		Pluck("distinct task_id", &ids).Error
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+	if len(ids) > 0 {
+		tasks := []model.Task{}
+		if err := s.db.Where("user_id = ? and id in (?)", s.userID, ids).Order("id").Find(&tasks).Error; err != nil {
+			return c.String(http.StatusInternalServerError, "%s", err)
+		}
+		// tasks purged from trash are not reported: they were deleted long
+		// before, so the client either knows it or its token has expired
+		for i := range tasks {
+			task := &tasks[i]
+			if task.IsDeleted || task.ProjectID != collection.ProjectID {
+				responses = append(responses, davResponse{Href: s.taskHref(collection, task), Status: http.StatusNotFound})
+			} else {
+				responses = append(responses, s.taskResponse(collection, task, req.requested()))
+			}
+		}
+	}
+	return writeMultistatus(c.Response(), responses, calDAVSyncTokenPrefix+next.String())
+}
+
+func (s *calDAVServer) get(c *echo.Context, collection *calDAVCollection, name string) error {
+	task, err := s.findTask(s.db, collection, name)
+	if err == errTaskNotFound {
+		return c.String(http.StatusNotFound, "%s", err)
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+
+	content, err := taskCalendarData(task)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+	c.Response().Header().Set(echo.ContentType, calDAVContentType)
+	c.Response().Header().Set("ETag", taskETag(task))
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = c.Response().Write(content)
+	return err
+}
+
+// put creates or replaces the task from VTODO of the resource. Conditions
+// of If-Match and If-None-Match headers are checked against the current
+// ETag of the task, so concurrent changes are not lost. Name of a new
+// resource is kept when it differs from the UID. UID of a resource can not
+// change, and can not be taken by another resource
+func (s *calDAVServer) put(c *echo.Context, collection *calDAVCollection, name string) error {
+	content, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxCalDAVResourceSize+1))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "%s", err)
+	}
+	if len(content) > maxCalDAVResourceSize {
+		return c.String(http.StatusRequestEntityTooLarge, "resource is too large")
+	}
+	calendar, err := lib.ParseICal(bytes.NewReader(content))
+	if err != nil {
+		return writeDAVError(c.Response(), http.StatusForbidden, calDAVValidData)
+	}
+	todos := calendar.Find("VTODO")
+	if len(todos) == 0 {
+		return writeDAVError(c.Response(), http.StatusForbidden, calDAVSupportedComponent)
+	}
+
+	location, err := userLocation(s.db, s.userID)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+	imported, err := taskFromICal(todos[0], location)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "%s", err)
+	}
+	imported.ProjectID = collection.ProjectID
+
+	opDB, opID, err := withOperation(s.db)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+	created := false
+	var task *model.Task
+	err = inTransaction(opDB, func(tx *gorm.DB) error {
+		existing, err := findTaskByResourceName(tx, s.userID, name)
+		if err == errTaskNotFound {
+			existing = nil
+		} else if err != nil {
+			return err
+		}
+		if !checkETagConditions(c.Request(), existing) {
+			return errPreconditionFailed
+		}
+
+		if existing == nil {
+			if _, err := findTaskByUID(tx, s.userID, imported.ExternalID); err == nil {
+				return errCalDAVUIDConflict
+			} else if err != errTaskNotFound {
+				return err
+			}
+			if imported.IsCompleted {
+				imported.RRule = ""
+			}
+			if name != imported.ExternalID {
+				imported.ResourceName = name
+			}
+			created = true
+			if err := createTask(tx, s.userID, imported); err != nil {
+				return err
+			}
+		} else if imported.ExternalID != taskUID(existing) {
+			return errCalDAVUIDConflict
+		} else if _, err := mergeICalTask(tx, s.userID, existing, imported); err != nil {
+			return err
+		}
+		// completed recurring task passes its UID and name to the next
+		// occurrence
+		task, err = findTaskByResourceName(tx, s.userID, name)
+		return err
+	})
+	if err == errPreconditionFailed {
+		return c.String(http.StatusPreconditionFailed, "%s", err)
+	} else if err == errCalDAVUIDConflict {
+		return writeDAVError(c.Response(), http.StatusForbidden, calDAVNoUIDConflict)
+	} else if err != nil {
+		return c.String(taskErrorStatus(err), "%s", err)
+	}
+
+	c.Response().Header().Set(OperationIDHeader, opID)
+	c.Response().Header().Set("ETag", taskETag(task))
+	if created {
+		return c.NoContent(http.StatusCreated)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// delete moves the task to trash
+func (s *calDAVServer) delete(c *echo.Context, collection *calDAVCollection, name string) error {
+	opDB, opID, err := withOperation(s.db)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "%s", err)
+	}
+
+	err = inTransaction(opDB, func(tx *gorm.DB) error {
+		task, err := s.findTask(tx, collection, name)
+		if err != nil {
+			return err
+		}
+		if !checkETagConditions(c.Request(), task) {
+			return errPreconditionFailed
+		}
+		_, err = deleteTask(tx, s.userID, task.Id)
+		return err
+	})
+	if err == errPreconditionFailed {
+		return c.String(http.StatusPreconditionFailed, "%s", err)
+	} else if err != nil {
+		return c.String(taskErrorStatus(err), "%s", err)
+	}
+
+	c.Response().Header().Set(OperationIDHeader, opID)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// collections lists calendar collections of the user: tasks without project
+// and projects which are not archived
+func (s *calDAVServer) collections() ([]*calDAVCollection, error) {
+	projects := []model.Project{}
+	if err := s.db.Where("user_id = ? and is_archived = ?", s.userID, false).Order("position, id").Find(&projects).Error; err != nil {
+		return nil, err
+	}
+
+	collections := []*calDAVCollection{{Name: calDAVTasksCollection, DisplayName: calDAVTasksDisplayName}}
+	for _, project := range projects {
+		collections = append(collections, &calDAVCollection{
+			Name:        calDAVProjectPrefix + strconv.FormatInt(project.Id, 10),
+			DisplayName: project.Name,
+			ProjectID:   project.Id,
+		})
+	}
+	return collections, nil
+}
+
+// findCollection resolves name of the collection from the path
+func (s *calDAVServer) findCollection(name string) (*calDAVCollection, error) {
+	if name == calDAVTasksCollection {
+		return &calDAVCollection{Name: name, DisplayName: calDAVTasksDisplayName}, nil
+	}
+	if !strings.HasPrefix(name, calDAVProjectPrefix) {
+		return nil, errProjectNotFound
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(name, calDAVProjectPrefix), 10, 64)
+	if err != nil {
+		return nil, errProjectNotFound
+	}
+	project, err := findProject(s.db, s.userID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &calDAVCollection{Name: name, DisplayName: project.Name, ProjectID: project.Id}, nil
+}
+
+func (s *calDAVServer) collectionTasks(collection *calDAVCollection) ([]model.Task, error) {
+	tasks := []model.Task{}
+	err := s.db.Where("user_id = ? and project_id = ? and is_deleted = ?", s.userID, collection.ProjectID, false).
+		Order("id").
+		Find(&tasks).Error
+	return tasks, err
+}
+
+// findTask loads the task of the collection by name of its resource
+func (s *calDAVServer) findTask(db *gorm.DB, collection *calDAVCollection, name string) (*model.Task, error) {
+	task, err := findTaskByResourceName(db, s.userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if task.ProjectID != collection.ProjectID {
+		return nil, errTaskNotFound
+	}
+	return task, nil
+}
+
+// currentSyncToken returns token of the current state of user's collections.
+// It points to the latest event of the user in the outbox
+func (s *calDAVServer) currentSyncToken() (syncToken, error) {
+	last := model.OutboxEvent{}
+	err := s.db.Where("user_id = ?", s.userID).Order("id desc").First(&last).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return syncToken{}, err
+	}
+	return syncToken{ID: last.Id, IssuedAt: time.Now().Unix()}, nil
+}
+
+// collectionProps describes the collection. Unlike sync token, ctag does not
+// include time of issue, so it changes only when tasks change
+func (s *calDAVServer) collectionProps(collection *calDAVCollection, token syncToken) davProps {
+	return davProps{
+		davResourceType:           "<d:collection/><c:calendar/>",
+		davDisplayName:            davText(collection.DisplayName),
+		davOwner:                  davHref(s.home),
+		davCurrentUserPrincipal:   davHref(s.home),
+		davSyncToken:              davText(calDAVSyncTokenPrefix + token.String()),
+		calServerGetCTag:          davText(strconv.FormatInt(token.ID, 10)),
+		calDAVSupportedComponents: `<c:comp name="VTODO"/>`,
+		davSupportedReportSet: "<d:supported-report><d:report><c:calendar-query/></d:report></d:supported-report>" +
+			"<d:supported-report><d:report><c:calendar-multiget/></d:report></d:supported-report>" +
+			"<d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>",
+		davCurrentUserPrivileges: "<d:privilege><d:read/></d:privilege><d:privilege><d:write/></d:privilege>",
+	}
+}
+
+// taskResponse describes the task resource. Calendar data is rendered only
+// when requested
+func (s *calDAVServer) taskResponse(collection *calDAVCollection, task *model.Task, requested []xml.Name) davResponse {
+	props := davProps{
+		davResourceType:   "",
+		davGetETag:        davText(taskETag(task)),
+		davGetContentType: davText(calDAVContentType),
+	}
+	for _, name := range requested {
+		if name != calDAVCalendarData {
+			continue
+		}
+		if content, err := taskCalendarData(task); err == nil {
+			props[calDAVCalendarData] = davText(string(content))
+		}
+	}
+	return newDAVResponse(s.taskHref(collection, task), props, requested)
+}
+
+func (s *calDAVServer) collectionHref(collection *calDAVCollection) string {
+	return s.home + collection.Name + "/"
+}
+
+func (s *calDAVServer) taskHref(collection *calDAVCollection, task *model.Task) string {
+	return s.collectionHref(collection) + url.PathEscape(taskResourceName(task)) + ".ics"
+}
+
+// findTaskByResourceName loads user's task which is not deleted by name of
+// its CalDAV resource. Task stored under a name of its own is not found by
+// its UID
+func findTaskByResourceName(db *gorm.DB, userID int64, name string) (*model.Task, error) {
+	task := &model.Task{}
+	err := db.Where("user_id = ? and resource_name = ? and is_deleted = ?", userID, name, false).
+		Order("id desc").
+		First(task).Error
+	if err == nil {
+		return task, nil
+	} else if err != gorm.RecordNotFound {
+		return nil, err
+	}
+
+	task, err = findTaskByUID(db, userID, name)
+	if err == nil && task.ResourceName != "" {
+		return nil, errTaskNotFound
+	}
+	return task, err
+}
+
+// taskResourceName returns name of CalDAV resource of the task
+func taskResourceName(task *model.Task) string {
+	if task.ResourceName != "" {
+		return task.ResourceName
+	}
+	return taskUID(task)
+}
+
+// taskCalendarData renders the task as iCalendar object with a single VTODO
+func taskCalendarData(task *model.Task) ([]byte, error) {
+	calendar := newICalendar("")
+	calendar.Components = append(calendar.Components, taskToVTodo(task))
+	buf := &bytes.Buffer{}
+	err := calendar.Encode(buf)
+	return buf.Bytes(), err
+}
+
+// taskETag changes with every save of the task
+func taskETag(task *model.Task) string {
+	return fmt.Sprintf(`"%d-%d"`, task.Id, task.Version)
+}
+
+// checkETagConditions checks If-Match and If-None-Match headers of the request
+// against the task. Nil task means the resource does not exist
+func checkETagConditions(req *http.Request, task *model.Task) bool {
+	if match := req.Header.Get("If-Match"); match != "" {
+		if task == nil || (match != "*" && !etagListContains(match, taskETag(task))) {
+			return false
+		}
+	}
+	if noneMatch := req.Header.Get("If-None-Match"); noneMatch != "" && task != nil {
+		if noneMatch == "*" || etagListContains(noneMatch, taskETag(task)) {
+			return false
+		}
+	}
+	return true
+}
+
+func etagListContains(list, etag string) bool {
+	for _, value := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(value), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// davDepth returns depth of PROPFIND request. Infinite depth is served as 1
+func davDepth(req *http.Request) int {
+	if req.Header.Get("Depth") == "0" {
+		return 0
+	}
+	return 1
+}
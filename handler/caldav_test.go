@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+const testCalDAVPassword = "secret"
+const testCalDAVRetention = time.Hour
+
+var davSyncTokenPattern = regexp.MustCompile(`<d:sync-token>([^<]*)</d:sync-token>`)
+
+// calDAVTest serves CalDAV requests of the test user
+type calDAVTest struct {
+	t  *testing.T
+	db *gorm.DB
+	e  *echo.Echo
+}
+
+func newCalDAVTest(t *testing.T) (*calDAVTest, func()) {
+	db, cleanup := newTestDB(t)
+	err := db.Model(&model.User{}).Where("id = ?", testUserID).
+		UpdateColumn("caldav_password", lib.Sha256(testCalDAVPassword)).Error
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(GetCalDAVMiddleware(db, testCalDAVRetention))
+	return &calDAVTest{t: t, db: db, e: e}, cleanup
+}
+
+func (ct *calDAVTest) do(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth(fmt.Sprint(testUserID), testCalDAVPassword)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	ct.e.ServeHTTP(rec, req)
+	return rec
+}
+
+// put uploads VTODO with the UID and summary to the resource
+func (ct *calDAVTest) put(name, uid, summary string, headers map[string]string) *httptest.ResponseRecorder {
+	body := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\nBEGIN:VTODO\r\n" +
+		"UID:" + uid + "\r\nSUMMARY:" + summary + "\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+	return ct.do("PUT", ct.href(name), body, headers)
+}
+
+func (ct *calDAVTest) href(name string) string {
+	return fmt.Sprintf("/caldav/%d/tasks/%s.ics", testUserID, name)
+}
+
+func (ct *calDAVTest) expect(rec *httptest.ResponseRecorder, status int) string {
+	ct.t.Helper()
+	if rec.Code != status {
+		ct.t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+func TestCalDAVPropfindDepth(t *testing.T) {
+	ct, cleanup := newCalDAVTest(t)
+	defer cleanup()
+	task := createTestTask(t, ct.db, "Buy milk")
+
+	propfind := `<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getetag/></d:prop></d:propfind>`
+	collection := fmt.Sprintf("/caldav/%d/tasks/", testUserID)
+
+	body := ct.expect(ct.do("PROPFIND", collection, propfind, map[string]string{"Depth": "0"}), http.StatusMultiStatus)
+	if n := strings.Count(body, "<d:response>"); n != 1 {
+		t.Fatalf("depth 0 must describe the collection only, got %d responses: %s", n, body)
+	}
+	if !strings.Contains(body, "<c:calendar/>") {
+		t.Fatalf("collection must be a calendar: %s", body)
+	}
+
+	body = ct.expect(ct.do("PROPFIND", collection, propfind, map[string]string{"Depth": "1"}), http.StatusMultiStatus)
+	if n := strings.Count(body, "<d:response>"); n != 2 {
+		t.Fatalf("depth 1 must describe the collection and its task, got %d responses: %s", n, body)
+	}
+	if !strings.Contains(body, ct.href(taskUID(task))) || !strings.Contains(body, davText(taskETag(task))) {
+		t.Fatalf("task resource is missing: %s", body)
+	}
+}
+
+func TestCalDAVCalendarQuery(t *testing.T) {
+	ct, cleanup := newCalDAVTest(t)
+	defer cleanup()
+	task := createTestTask(t, ct.db, "Buy milk")
+	deleted := createTestTask(t, ct.db, "Deleted")
+	if _, err := deleteTask(ct.db, testUserID, deleted.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	query := `<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">` +
+		`<d:prop><d:getetag/><c:calendar-data/></d:prop>` +
+		`<c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VTODO"/></c:comp-filter></c:filter>` +
+		`</c:calendar-query>`
+	body := ct.expect(ct.do("REPORT", fmt.Sprintf("/caldav/%d/tasks/", testUserID), query, map[string]string{"Depth": "1"}), http.StatusMultiStatus)
+	if n := strings.Count(body, "<d:response>"); n != 1 {
+		t.Fatalf("expected only the task which is not deleted, got %d responses: %s", n, body)
+	}
+	if !strings.Contains(body, ct.href(taskUID(task))) || !strings.Contains(body, "SUMMARY:Buy milk") {
+		t.Fatalf("calendar data of the task is missing: %s", body)
+	}
+}
+
+func TestCalDAVSyncCollection(t *testing.T) {
+	ct, cleanup := newCalDAVTest(t)
+	defer cleanup()
+	createTestTask(t, ct.db, "Before sync")
+
+	collection := fmt.Sprintf("/caldav/%d/tasks/", testUserID)
+	syncReport := func(token string) string {
+		return `<d:sync-collection xmlns:d="DAV:"><d:sync-token>` + token + `</d:sync-token>` +
+			`<d:sync-level>1</d:sync-level><d:prop><d:getetag/></d:prop></d:sync-collection>`
+	}
+
+	body := ct.expect(ct.do("REPORT", collection, syncReport(""), nil), http.StatusMultiStatus)
+	if n := strings.Count(body, "<d:response>"); n != 1 {
+		t.Fatalf("initial sync must report every task, got %d responses: %s", n, body)
+	}
+	match := davSyncTokenPattern.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("sync token is missing: %s", body)
+	}
+
+	ct.expect(ct.put("new-task", "new-task", "After sync", nil), http.StatusCreated)
+	body = ct.expect(ct.do("REPORT", collection, syncReport(match[1]), nil), http.StatusMultiStatus)
+	if n := strings.Count(body, "<d:response>"); n != 1 || !strings.Contains(body, ct.href("new-task")) {
+		t.Fatalf("sync must report only the new task: %s", body)
+	}
+
+	expired := syncToken{ID: 0, IssuedAt: time.Now().Add(-testCalDAVRetention).Unix()}
+	body = ct.expect(ct.do("REPORT", collection, syncReport(calDAVSyncTokenPrefix+expired.String()), nil), http.StatusForbidden)
+	if !strings.Contains(body, "valid-sync-token") {
+		t.Fatalf("expired token must fail valid-sync-token precondition: %s", body)
+	}
+}
+
+func TestCalDAVPutPreconditions(t *testing.T) {
+	ct, cleanup := newCalDAVTest(t)
+	defer cleanup()
+
+	rec := ct.put("task-uid", "task-uid", "First", map[string]string{"If-None-Match": "*"})
+	ct.expect(rec, http.StatusCreated)
+	etag := rec.Header().Get("ETag")
+
+	ct.expect(ct.put("task-uid", "task-uid", "Again", map[string]string{"If-None-Match": "*"}), http.StatusPreconditionFailed)
+	ct.expect(ct.put("task-uid", "task-uid", "Stale", map[string]string{"If-Match": `"0-0"`}), http.StatusPreconditionFailed)
+	ct.expect(ct.put("missing", "missing", "Missing", map[string]string{"If-Match": "*"}), http.StatusPreconditionFailed)
+
+	rec = ct.put("task-uid", "task-uid", "Second", map[string]string{"If-Match": etag})
+	ct.expect(rec, http.StatusNoContent)
+	if rec.Header().Get("ETag") == etag {
+		t.Fatalf("ETag must change with the task")
+	}
+	body := ct.expect(ct.do("GET", ct.href("task-uid"), "", nil), http.StatusOK)
+	if !strings.Contains(body, "SUMMARY:Second") {
+		t.Fatalf("task must be updated: %s", body)
+	}
+}
+
+func TestCalDAVResourceNameDiffersFromUID(t *testing.T) {
+	ct, cleanup := newCalDAVTest(t)
+	defer cleanup()
+
+	rec := ct.put("client-name", "uid@client", "Named by client", nil)
+	ct.expect(rec, http.StatusCreated)
+	etag := rec.Header().Get("ETag")
+
+	body := ct.expect(ct.do("GET", ct.href("client-name"), "", nil), http.StatusOK)
+	if !strings.Contains(body, "UID:uid@client") {
+		t.Fatalf("UID must be kept: %s", body)
+	}
+	ct.expect(ct.do("GET", ct.href("uid@client"), "", nil), http.StatusNotFound)
+
+	propfind := `<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`
+	body = ct.expect(ct.do("PROPFIND", fmt.Sprintf("/caldav/%d/tasks/", testUserID), propfind, map[string]string{"Depth": "1"}), http.StatusMultiStatus)
+	if !strings.Contains(body, ct.href("client-name")) {
+		t.Fatalf("task must be listed under its resource name: %s", body)
+	}
+
+	ct.expect(ct.put("client-name", "uid@client", "Renamed", map[string]string{"If-Match": etag}), http.StatusNoContent)
+	body = ct.expect(ct.put("other-name", "uid@client", "Duplicate", nil), http.StatusForbidden)
+	if !strings.Contains(body, "no-uid-conflict") {
+		t.Fatalf("UID of another resource must fail no-uid-conflict precondition: %s", body)
+	}
+	body = ct.expect(ct.put("client-name", "changed@client", "Changed UID", nil), http.StatusForbidden)
+	if !strings.Contains(body, "no-uid-conflict") {
+		t.Fatalf("UID of the resource must not change: %s", body)
+	}
+
+	ct.expect(ct.do("DELETE", ct.href("client-name"), "", nil), http.StatusNoContent)
+	ct.expect(ct.do("GET", ct.href("client-name"), "", nil), http.StatusNotFound)
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+var errCommentNotFound = errors.New("comment not found")
+
+// commentRequest defines input of add and edit comment operations
+type commentRequest struct {
+	Body string `json:"body"`
+}
+
+// GetListCommentsHandler creates HTTP handler which lists comments of the task
+// from the oldest to the newest. Supports limit and offset parameters
+func GetListCommentsHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		limit, offset, err := parsePagination(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		comments := []model.Comment{}
+		err = db.Where("task_id = ?", task.Id).
+			Order("id").
+			Limit(limit).
+			Offset(offset).
+			Find(&comments).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, comments)
+	}
+}
+
+// GetAddCommentHandler creates HTTP handler which adds a comment to the task
+// on behalf of current user
+func GetAddCommentHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		req := commentRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		comment := model.Comment{TaskID: task.Id, AuthorID: currentUserID(c), Body: req.Body}
+		if err := comment.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		if err := db.Create(&comment).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusCreated, comment)
+	}
+}
+
+// GetEditCommentHandler creates HTTP handler which changes body of the
+// comment. Previous body is kept as a revision
+func GetEditCommentHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		comment, err := findEditableComment(c, db)
+		if err != nil {
+			return err
+		}
+
+		req := commentRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if req.Body == comment.Body {
+			return c.JSON(http.StatusOK, comment)
+		}
+
+		revision := model.CommentRevision{CommentID: comment.Id, EditorID: currentUserID(c), Body: comment.Body}
+		now := time.Now()
+		comment.Body = req.Body
+		comment.EditedAt = &now
+		if err := comment.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		tx := db.Begin()
+		if err := tx.Create(&revision).Error; err != nil {
+			tx.Rollback()
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		if err := tx.Save(comment).Error; err != nil {
+			tx.Rollback()
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		if err := tx.Commit().Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, comment)
+	}
+}
+
+// GetDeleteCommentHandler creates HTTP handler which removes the comment
+// together with its revisions
+func GetDeleteCommentHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		comment, err := findEditableComment(c, db)
+		if err != nil {
+			return err
+		}
+
+		tx := db.Begin()
+		if err := tx.Where("comment_id = ?", comment.Id).Delete(model.CommentRevision{}).Error; err != nil {
+			tx.Rollback()
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		if err := tx.Delete(comment).Error; err != nil {
+			tx.Rollback()
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		if err := tx.Commit().Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetCommentHistoryHandler creates HTTP handler which lists previous versions
+// of the comment from the oldest to the newest
+func GetCommentHistoryHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		comment, _, err := findComment(c, db)
+		if err != nil {
+			return err
+		}
+
+		revisions := []model.CommentRevision{}
+		if err := db.Where("comment_id = ?", comment.Id).Order("id").Find(&revisions).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, revisions)
+	}
+}
+
+// loadTaskCommentCounts fills number of comments of the tasks
+func loadTaskCommentCounts(db *gorm.DB, tasks []model.Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	taskIDs := make([]int64, 0, len(tasks))
+	for _, task := range tasks {
+		taskIDs = append(taskIDs, task.Id)
+	}
+
+	rows, err := db.Model(&model.Comment{}).
+		Select("task_id, count(*)").
+		Where("task_id in (?)", taskIDs).
+		Group("task_id").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	counts := map[int64]int{}
+	for rows.Next() {
+		var taskID int64
+		var count int
+		if err := rows.Scan(&taskID, &count); err != nil {
+			return err
+		}
+		counts[taskID] = count
+	}
+	for i := range tasks {
+		tasks[i].CommentCount = counts[tasks[i].Id]
+	}
+
+	return rows.Err()
+}
+
+// findComment loads comment of the task. Owner of the task can see all its
+// comments, while admins can see comments of any task to moderate them
+func findComment(c *echo.Context, db *gorm.DB) (*model.Comment, bool, error) {
+	admin, err := isAdmin(db, currentUserID(c))
+	if err != nil {
+		return nil, false, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+
+	taskID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, false, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+	id, err := strconv.ParseInt(c.Param("comment_id"), 10, 64)
+	if err != nil {
+		return nil, false, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	if !admin {
+		if _, err := findTask(db, currentUserID(c), taskID); err != nil {
+			return nil, false, echo.NewHTTPError(taskErrorStatus(err), NewApiError(err.Error()).String())
+		}
+	}
+
+	comment := &model.Comment{}
+	err = db.Where("task_id = ?", taskID).First(comment, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, false, echo.NewHTTPError(http.StatusNotFound, NewApiError(errCommentNotFound.Error()).String())
+	} else if err != nil {
+		return nil, false, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+	return comment, admin, nil
+}
+
+// findEditableComment loads comment which current user is allowed to change.
+// Only authors and admins can change comments
+func findEditableComment(c *echo.Context, db *gorm.DB) (*model.Comment, error) {
+	comment, admin, err := findComment(c, db)
+	if err != nil {
+		return nil, err
+	}
+	if !admin && comment.AuthorID != currentUserID(c) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, NewApiError("only author can change the comment").String())
+	}
+	return comment, nil
+}
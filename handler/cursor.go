@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// NextCursorHeader is a response header with cursor to the next page of a list
+const NextCursorHeader = "X-Next-Cursor"
+
+// encodeCursor serializes cursor into opaque string signed with the secret,
+// so clients can not forge cursors to jump into arbitrary positions
+func encodeCursor(cursor model.TaskCursor, secret string) (string, error) {
+	content, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(content)
+	return payload + "." + lib.HMACSha256(payload, secret), nil
+}
+
+// decodeCursor checks signature of the opaque cursor and deserializes it
+func decodeCursor(value, secret string) (model.TaskCursor, error) {
+	cursor := model.TaskCursor{}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return cursor, errors.New("invalid cursor")
+	}
+	// signatures are compared in constant time, so timing does not tell how
+	// much of a forged one is right
+	signature, err := hex.DecodeString(parts[1])
+	expected, _ := hex.DecodeString(lib.HMACSha256(parts[0], secret))
+	if err != nil || !hmac.Equal(signature, expected) {
+		return cursor, errors.New("invalid cursor")
+	}
+
+	content, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	if err := json.Unmarshal(content, &cursor); err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+
+	return cursor, nil
+}
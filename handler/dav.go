@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// XML namespaces of WebDAV and its extensions
+const (
+	davNS          = "DAV:"
+	calDAVNS       = "urn:ietf:params:xml:ns:caldav"
+	calServerNS    = "http://calendarserver.org/ns/"
+	davContentType = "application/xml; charset=utf-8"
+)
+
+// davPrefixes are prefixes of known namespaces in responses. Properties of
+// other namespaces declare their namespace by themselves
+var davPrefixes = map[string]string{
+	davNS:       "d",
+	calDAVNS:    "c",
+	calServerNS: "cs",
+}
+
+// properties of WebDAV resources
+var (
+	davResourceType           = xml.Name{Space: davNS, Local: "resourcetype"}
+	davDisplayName            = xml.Name{Space: davNS, Local: "displayname"}
+	davGetETag                = xml.Name{Space: davNS, Local: "getetag"}
+	davGetContentType         = xml.Name{Space: davNS, Local: "getcontenttype"}
+	davCurrentUserPrincipal   = xml.Name{Space: davNS, Local: "current-user-principal"}
+	davPrincipalURL           = xml.Name{Space: davNS, Local: "principal-URL"}
+	davOwner                  = xml.Name{Space: davNS, Local: "owner"}
+	davSyncToken              = xml.Name{Space: davNS, Local: "sync-token"}
+	davSupportedReportSet     = xml.Name{Space: davNS, Local: "supported-report-set"}
+	davCurrentUserPrivileges  = xml.Name{Space: davNS, Local: "current-user-privilege-set"}
+	calDAVCalendarHomeSet     = xml.Name{Space: calDAVNS, Local: "calendar-home-set"}
+	calDAVCalendarData        = xml.Name{Space: calDAVNS, Local: "calendar-data"}
+	calDAVSupportedComponents = xml.Name{Space: calDAVNS, Local: "supported-calendar-component-set"}
+	calServerGetCTag          = xml.Name{Space: calServerNS, Local: "getctag"}
+)
+
+// davRequest defines body of PROPFIND and REPORT requests. Name of the root
+// element tells the type of the report. Only parts used by supported
+// requests are read
+type davRequest struct {
+	XMLName   xml.Name
+	AllProp   *struct{}     `xml:"DAV: allprop"`
+	Prop      *davPropNames `xml:"DAV: prop"`
+	Hrefs     []string      `xml:"DAV: href"`
+	SyncToken string        `xml:"DAV: sync-token"`
+}
+
+// davPropNames lists names of requested properties
+type davPropNames struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// requested returns names of requested properties. Empty list means all
+// properties
+func (r *davRequest) requested() []xml.Name {
+	names := []xml.Name{}
+	if r.Prop == nil || r.AllProp != nil {
+		return names
+	}
+	for _, name := range r.Prop.Names {
+		names = append(names, name.XMLName)
+	}
+	return names
+}
+
+// davProps maps names of properties of a resource to their XML content
+type davProps map[xml.Name]string
+
+// davResponse defines a response about a single resource in multistatus.
+// Response without properties has only status, e.g. for a deleted resource
+type davResponse struct {
+	Href    string
+	Status  int
+	Found   davProps
+	Missing []xml.Name
+}
+
+// parseDAVRequest reads body of the request. Empty body means all properties
+// are requested
+func parseDAVRequest(body io.Reader) (*davRequest, error) {
+	req := &davRequest{}
+	err := xml.NewDecoder(body).Decode(req)
+	if err == io.EOF {
+		return req, nil
+	}
+	return req, err
+}
+
+// newDAVResponse selects requested properties of the resource. Properties
+// which are expensive to compute are returned only when requested explicitly
+func newDAVResponse(href string, props davProps, requested []xml.Name) davResponse {
+	resp := davResponse{Href: href, Found: davProps{}}
+	if len(requested) == 0 {
+		for name, value := range props {
+			if name != calDAVCalendarData {
+				resp.Found[name] = value
+			}
+		}
+		return resp
+	}
+
+	for _, name := range requested {
+		if value, ok := props[name]; ok {
+			resp.Found[name] = value
+		} else {
+			resp.Missing = append(resp.Missing, name)
+		}
+	}
+	return resp
+}
+
+// writeMultistatus writes the responses as 207 Multi-Status. Sync token is
+// written for sync-collection report only
+func writeMultistatus(w http.ResponseWriter, responses []davResponse, syncToken string) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`)
+	for _, resp := range responses {
+		buf.WriteString("<d:response>")
+		buf.WriteString(davElement(xml.Name{Space: davNS, Local: "href"}, davText(resp.Href)))
+		if resp.Status != 0 {
+			buf.WriteString(davStatus(resp.Status))
+		}
+		if len(resp.Found) > 0 {
+			buf.WriteString(davPropStat(resp.Found, http.StatusOK))
+		}
+		if len(resp.Missing) > 0 {
+			missing := davProps{}
+			for _, name := range resp.Missing {
+				missing[name] = ""
+			}
+			buf.WriteString(davPropStat(missing, http.StatusNotFound))
+		}
+		buf.WriteString("</d:response>")
+	}
+	if syncToken != "" {
+		buf.WriteString(davElement(davSyncToken, davText(syncToken)))
+	}
+	buf.WriteString("</d:multistatus>")
+
+	w.Header().Set("Content-Type", davContentType)
+	w.WriteHeader(http.StatusMultiStatus)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeDAVError responds with the status and the precondition which failed
+func writeDAVError(w http.ResponseWriter, status int, condition xml.Name) error {
+	w.Header().Set("Content-Type", davContentType)
+	w.WriteHeader(status)
+	_, err := fmt.Fprintf(w, `%s<d:error xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">%s</d:error>`,
+		xml.Header, davElement(condition, ""))
+	return err
+}
+
+func davPropStat(props davProps, status int) string {
+	// properties are sorted, so responses do not change from call to call
+	names := make([]string, 0, len(props))
+	elements := map[string]string{}
+	for name, value := range props {
+		key := name.Space + " " + name.Local
+		names = append(names, key)
+		elements[key] = davElement(name, value)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("<d:propstat><d:prop>")
+	for _, name := range names {
+		buf.WriteString(elements[name])
+	}
+	buf.WriteString("</d:prop>")
+	buf.WriteString(davStatus(status))
+	buf.WriteString("</d:propstat>")
+	return buf.String()
+}
+
+func davStatus(status int) string {
+	return fmt.Sprintf("<d:status>HTTP/1.1 %d %s</d:status>", status, http.StatusText(status))
+}
+
+// davElement renders XML element with the content, which must be escaped
+// already
+func davElement(name xml.Name, content string) string {
+	tag := name.Local
+	declaration := ""
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		tag = prefix + ":" + name.Local
+	} else if name.Space != "" {
+		tag = "x:" + name.Local
+		declaration = ` xmlns:x="` + davText(name.Space) + `"`
+	}
+
+	if content == "" {
+		return "<" + tag + declaration + "/>"
+	}
+	return "<" + tag + declaration + ">" + content + "</" + tag + ">"
+}
+
+// davHref renders href element with the path
+func davHref(path string) string {
+	return davElement(xml.Name{Space: davNS, Local: "href"}, davText(path))
+}
+
+func davText(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
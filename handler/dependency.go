@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+var errTaskBlocked = errors.New("task is blocked by open tasks, use force to complete it anyway")
+var errDependencyCycle = errors.New("dependency would create a cycle")
+
+// taskBlockedByField is a name of the task change which lists ids of tasks
+// the task is blocked by
+const taskBlockedByField = "BlockedBy"
+
+// dependencyGraph defines tasks connected by dependencies and edges between them
+type dependencyGraph struct {
+	Nodes []dependencyNode `json:"nodes"`
+	Edges []dependencyEdge `json:"edges"`
+}
+
+type dependencyNode struct {
+	ID          int64  `json:"id"`
+	Title       string `json:"title"`
+	IsCompleted bool   `json:"is_completed"`
+	IsBlocked   bool   `json:"is_blocked"`
+}
+
+type dependencyEdge struct {
+	TaskID      int64 `json:"task_id"`
+	BlockedByID int64 `json:"blocked_by_id"`
+}
+
+// GetAddDependencyHandler creates HTTP handler which makes the task blocked by
+// another task. Dependencies which would create a cycle are rejected
+func GetAddDependencyHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, blocker, err := findTaskAndBlocker(c, db)
+		if err != nil {
+			return err
+		}
+
+		return changeTaskBlockers(c, db, task, func(blockerIDs []int64) []int64 {
+			return append(blockerIDs, blocker.Id)
+		})
+	}
+}
+
+// GetRemoveDependencyHandler creates HTTP handler which removes dependency of
+// the task on another task
+func GetRemoveDependencyHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, blocker, err := findTaskAndBlocker(c, db)
+		if err != nil {
+			return err
+		}
+
+		return changeTaskBlockers(c, db, task, func(blockerIDs []int64) []int64 {
+			blockers := []int64{}
+			for _, id := range blockerIDs {
+				if id != blocker.Id {
+					blockers = append(blockers, id)
+				}
+			}
+			return blockers
+		})
+	}
+}
+
+// changeTaskBlockers changes tasks the task is blocked by as a single
+// operation and responds with the task
+func changeTaskBlockers(c *echo.Context, db *gorm.DB, task *model.Task, change func(blockerIDs []int64) []int64) error {
+	opDB, opID, err := withOperation(db)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+	}
+	err = inTransaction(opDB, func(tx *gorm.DB) error {
+		blockerIDs, err := taskBlockerIDs(tx, task.Id)
+		if err != nil {
+			return err
+		}
+		return setTaskBlockers(tx, currentUserID(c), task, change(blockerIDs), model.TaskEventUpdated)
+	})
+	if err != nil {
+		return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+	}
+	if task, err = findTask(db, currentUserID(c), task.Id); err != nil {
+		return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+	}
+
+	c.Response().Header().Set(OperationIDHeader, opID)
+	return respondWithTask(c, db, task)
+}
+
+// setTaskBlockers replaces tasks the task is blocked by and records the change
+// as an event of given type, so consumers of events learn that the task got
+// blocked or unblocked. Like with tags, the task is saved explicitly and its
+// version grows. Dependencies which would create a cycle are rejected, ids of
+// tasks which no longer exist are skipped. Nothing is saved if dependencies
+// do not change
+func setTaskBlockers(db *gorm.DB, actorID int64, task *model.Task, blockerIDs []int64, eventType string) error {
+	before, err := taskBlockerIDs(db, task.Id)
+	if err != nil {
+		return err
+	}
+	existing := map[int64]bool{}
+	for _, id := range before {
+		existing[id] = true
+	}
+
+	after := []int64{}
+	for _, id := range uniqueIDs(blockerIDs) {
+		if existing[id] {
+			after = append(after, id)
+			continue
+		}
+		if _, err := findTask(db, task.UserID, id); err == errTaskNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if cycle, err := isDependencyCycle(db, task.UserID, task.Id, id); err != nil {
+			return err
+		} else if cycle {
+			return errDependencyCycle
+		}
+		after = append(after, id)
+	}
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+
+	if err := db.Where("task_id = ?", task.Id).Delete(model.TaskDependency{}).Error; err != nil {
+		return err
+	}
+	for _, id := range after {
+		dependency := &model.TaskDependency{UserID: task.UserID, TaskID: task.Id, BlockedByID: id}
+		if err := db.Create(dependency).Error; err != nil {
+			return err
+		}
+	}
+
+	previous := *task
+	task.Tags = nil
+	if err := db.Save(task).Error; err != nil {
+		return err
+	}
+	changes := append(model.DiffTasks(&previous, task), model.TaskChange{Field: taskBlockedByField, Before: before, After: after})
+	return recordTaskChanges(db, actorID, eventType, task, changes)
+}
+
+// taskBlockerIDs returns sorted ids of tasks the task is blocked by
+func taskBlockerIDs(db *gorm.DB, taskID int64) ([]int64, error) {
+	ids := []int64{}
+	if err := db.Model(&model.TaskDependency{}).Where("task_id = ?", taskID).Pluck("blocked_by_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return uniqueIDs(ids), nil
+}
+
+// GetDependencyGraphHandler creates HTTP handler which responds with all tasks
+// connected to the task by dependencies in any direction, so the whole
+// dependency graph can be visualized
+func GetDependencyGraphHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		task, err := findTask(db, currentUserID(c), id)
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
+
+		graph := dependencyGraph{Nodes: []dependencyNode{}, Edges: []dependencyEdge{}}
+		visited := map[int64]bool{task.Id: true}
+		seenEdges := map[int64]bool{}
+		taskIDs := []int64{task.Id}
+		for level := []int64{task.Id}; len(level) > 0; {
+			dependencies := []model.TaskDependency{}
+			err := db.Where("user_id = ? and (task_id in (?) or blocked_by_id in (?))", task.UserID, level, level).
+				Find(&dependencies).Error
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+
+			level = []int64{}
+			for _, dependency := range dependencies {
+				if !seenEdges[dependency.Id] {
+					seenEdges[dependency.Id] = true
+					graph.Edges = append(graph.Edges, dependencyEdge{dependency.TaskID, dependency.BlockedByID})
+				}
+				for _, id := range []int64{dependency.TaskID, dependency.BlockedByID} {
+					if !visited[id] {
+						visited[id] = true
+						level = append(level, id)
+						taskIDs = append(taskIDs, id)
+					}
+				}
+			}
+		}
+
+		tasks := []model.Task{}
+		err = db.Where("user_id = ? and id in (?)", task.UserID, taskIDs).Order("id").Find(&tasks).Error
+		if err == nil {
+			err = loadTaskBlocked(db, tasks)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		for _, t := range tasks {
+			graph.Nodes = append(graph.Nodes, dependencyNode{t.Id, t.Title, t.IsCompleted, t.IsBlocked})
+		}
+
+		return c.JSON(http.StatusOK, graph)
+	}
+}
+
+// isDependencyCycle checks if the blocker already depends on the task directly
+// or through other tasks, so making the task depend on the blocker would
+// create a cycle
+func isDependencyCycle(db *gorm.DB, userID, taskID, blockerID int64) (bool, error) {
+	if taskID == blockerID {
+		return true, nil
+	}
+
+	visited := map[int64]bool{blockerID: true}
+	for level := []int64{blockerID}; len(level) > 0; {
+		dependencies := []model.TaskDependency{}
+		err := db.Where("user_id = ? and task_id in (?)", userID, level).Find(&dependencies).Error
+		if err != nil {
+			return false, err
+		}
+
+		level = []int64{}
+		for _, dependency := range dependencies {
+			if dependency.BlockedByID == taskID {
+				return true, nil
+			}
+			if !visited[dependency.BlockedByID] {
+				visited[dependency.BlockedByID] = true
+				level = append(level, dependency.BlockedByID)
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// openBlockersQuery is a condition which selects ids of tasks blocked by open
+// tasks. Deleted tasks do not block anything
+const openBlockersQuery = "select task_dependencies.task_id from task_dependencies " +
+	"join tasks on tasks.id = task_dependencies.blocked_by_id " +
+	"where tasks.is_completed = ? and tasks.is_deleted = ? and task_dependencies.task_id in (?)"
+
+// loadTaskBlocked fills blocked flag of the tasks
+func loadTaskBlocked(db *gorm.DB, tasks []model.Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	taskIDs := make([]int64, 0, len(tasks))
+	for _, task := range tasks {
+		taskIDs = append(taskIDs, task.Id)
+	}
+
+	rows, err := db.Raw(openBlockersQuery, false, false, taskIDs).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	blocked := map[int64]bool{}
+	for rows.Next() {
+		var taskID int64
+		if err := rows.Scan(&taskID); err != nil {
+			return err
+		}
+		blocked[taskID] = true
+	}
+	for i := range tasks {
+		tasks[i].IsBlocked = blocked[tasks[i].Id]
+	}
+
+	return rows.Err()
+}
+
+// isTaskBlocked checks if any of tasks the task depends on is open
+func isTaskBlocked(db *gorm.DB, task *model.Task) (bool, error) {
+	tasks := []model.Task{*task}
+	if err := loadTaskBlocked(db, tasks); err != nil {
+		return false, err
+	}
+	return tasks[0].IsBlocked, nil
+}
+
+// findTaskAndBlocker loads current user's task and blocking task by ids from
+// request path. Returns echo HTTP error otherwise
+func findTaskAndBlocker(c *echo.Context, db *gorm.DB) (*model.Task, *model.Task, error) {
+	tasks := make([]*model.Task, 2)
+	for i, param := range []string{"id", "blocker_id"} {
+		id, err := strconv.ParseInt(c.Param(param), 10, 64)
+		if err != nil {
+			return nil, nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+		}
+
+		tasks[i], err = findTask(db, currentUserID(c), id)
+		if err != nil {
+			return nil, nil, echo.NewHTTPError(taskErrorStatus(err), NewApiError(err.Error()).String())
+		}
+	}
+
+	return tasks[0], tasks[1], nil
+}
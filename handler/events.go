@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/live"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// LastEventIDHeader is a header of reconnecting event stream client with id
+// of the last event it received
+const LastEventIDHeader = "Last-Event-ID"
+
+// sseHeartbeatInterval is a period of comments sent to keep idle stream open
+// behind proxies
+const sseHeartbeatInterval = 15 * time.Second
+
+// sseReplayBatchSize limits number of events loaded at once during replay
+const sseReplayBatchSize = 100
+
+// GetTaskEventsHandler creates HTTP handler which streams events of current
+// user's tasks as Server-Sent Events. Id of every event is its id in the
+// outbox. Client which reconnects with Last-Event-ID header first gets events
+// it missed, as long as they are still kept in the outbox. Stream of a client
+// which does not keep up with events is closed, so it can reconnect and
+// catch up
+func GetTaskEventsHandler(db *gorm.DB, hub *live.Hub) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		var lastID int64
+		if header := c.Request().Header.Get(LastEventIDHeader); header != "" {
+			id, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || id < 0 {
+				return c.JSON(http.StatusBadRequest, NewApiError("invalid "+LastEventIDHeader))
+			}
+			lastID = id
+		}
+
+		userID := currentUserID(c)
+		// subscribe before replay, so events written meanwhile are not lost.
+		// Events received both ways are sent once
+		subscription := hub.Subscribe(userID)
+		defer hub.Cancel(subscription)
+
+		resp := c.Response()
+		resp.Header().Set(echo.ContentType, "text/event-stream")
+		resp.Header().Set("Cache-Control", "no-cache")
+		resp.Header().Set("X-Accel-Buffering", "no")
+		resp.WriteHeader(http.StatusOK)
+		resp.Flush()
+
+		if lastID > 0 {
+			for {
+				events := []model.OutboxEvent{}
+				err := db.Where("user_id = ? and id > ?", userID, lastID).
+					Order("id").
+					Limit(sseReplayBatchSize).
+					Find(&events).Error
+				if err != nil {
+					return nil
+				}
+
+				for i := range events {
+					if err := writeServerEvent(resp, &events[i]); err != nil {
+						return nil
+					}
+					lastID = events[i].Id
+				}
+				resp.Flush()
+				if len(events) < sseReplayBatchSize {
+					break
+				}
+			}
+		}
+
+		ticker := time.NewTicker(sseHeartbeatInterval)
+		defer ticker.Stop()
+		closed := resp.CloseNotify()
+
+		for {
+			select {
+			case event, ok := <-subscription.Events:
+				if !ok {
+					return nil
+				}
+				if event.Id <= lastID {
+					continue
+				}
+				if err := writeServerEvent(resp, event); err != nil {
+					return nil
+				}
+				lastID = event.Id
+			case <-ticker.C:
+				if _, err := fmt.Fprint(resp, ": ping\n\n"); err != nil {
+					return nil
+				}
+			case <-closed:
+				return nil
+			}
+			resp.Flush()
+		}
+	}
+}
+
+// writeServerEvent writes the event in text/event-stream format. Payload is
+// a single line of JSON, so it fits in one data field
+func writeServerEvent(resp *echo.Response, event *model.OutboxEvent) error {
+	_, err := fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, event.Payload)
+	return err
+}
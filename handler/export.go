@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// formats of tasks export and import
+const (
+	transferFormatNDJSON  = "ndjson"
+	transferFormatJSON    = "json"
+	transferFormatCSV     = "csv"
+	transferFormatTodoTxt = "todotxt"
+)
+
+const csvContentType = "text/csv; charset=utf-8"
+const todoTxtContentType = "text/plain; charset=utf-8"
+
+// csvColumns lists columns of exported CSV. Id and creation time are exported
+// for reference only, they are ignored on import
+var csvColumns = []string{
+	"id", "external_id", "title", "description", "project", "tags", "priority",
+	"start_at", "due_at", "is_all_day", "is_completed", "completed_at", "rrule", "created_at",
+}
+
+var errUnknownFormat = errors.New("format must be one of 'ndjson', 'json', 'csv' or 'todotxt'")
+
+// taskEncoder writes exported tasks in some format
+type taskEncoder interface {
+	Encode(task *model.Task) error
+	Close() error
+}
+
+// newTaskEncoder creates encoder of the format. Project names are used by
+// formats which refer to projects by name
+func newTaskEncoder(format string, w io.Writer, projects map[int64]string) (taskEncoder, string, error) {
+	switch format {
+	case "", transferFormatNDJSON:
+		return &ndjsonTaskEncoder{encoder: json.NewEncoder(w)}, ndjsonContentType, nil
+	case transferFormatJSON:
+		return &jsonTaskEncoder{w: w}, echo.ApplicationJSONCharsetUTF8, nil
+	case transferFormatCSV:
+		return &csvTaskEncoder{w: csv.NewWriter(w), projects: projects}, csvContentType, nil
+	case transferFormatTodoTxt:
+		return &todoTxtTaskEncoder{w: w, projects: projects}, todoTxtContentType, nil
+	default:
+		return nil, "", errUnknownFormat
+	}
+}
+
+// ndjsonTaskEncoder writes every task as JSON object on a line of its own
+type ndjsonTaskEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonTaskEncoder) Encode(task *model.Task) error {
+	return e.encoder.Encode(task)
+}
+
+func (e *ndjsonTaskEncoder) Close() error {
+	return nil
+}
+
+// jsonTaskEncoder writes tasks as JSON array. The array is written item by
+// item, so it is never kept in memory as a whole
+type jsonTaskEncoder struct {
+	w       io.Writer
+	started bool
+}
+
+func (e *jsonTaskEncoder) Encode(task *model.Task) error {
+	content, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	separator := ",\n"
+	if !e.started {
+		separator = "[\n"
+		e.started = true
+	}
+	_, err = io.WriteString(e.w, separator+string(content))
+	return err
+}
+
+func (e *jsonTaskEncoder) Close() error {
+	if !e.started {
+		_, err := io.WriteString(e.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(e.w, "\n]\n")
+	return err
+}
+
+// csvTaskEncoder writes tasks as CSV with a header row. Dates of all-day
+// tasks are written without time, other times are written in RFC 3339
+type csvTaskEncoder struct {
+	w        *csv.Writer
+	projects map[int64]string
+	started  bool
+}
+
+func (e *csvTaskEncoder) Encode(task *model.Task) error {
+	if !e.started {
+		if err := e.w.Write(csvColumns); err != nil {
+			return err
+		}
+		e.started = true
+	}
+
+	tags := make([]string, 0, len(task.Tags))
+	for _, tag := range task.Tags {
+		tags = append(tags, tag.Name)
+	}
+	err := e.w.Write([]string{
+		strconv.FormatInt(task.Id, 10),
+		taskUID(task),
+		task.Title,
+		task.Description,
+		e.projects[task.ProjectID],
+		strings.Join(tags, ","),
+		strconv.Itoa(task.Priority),
+		formatExportTime(task.StartAt, task.IsAllDay),
+		formatExportTime(task.DueAt, task.IsAllDay),
+		strconv.FormatBool(task.IsAllDay),
+		strconv.FormatBool(task.IsCompleted),
+		formatExportTime(task.CompletedAt, false),
+		task.RRule,
+		formatExportTime(task.CreatedAt, false),
+	})
+	if err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvTaskEncoder) Close() error {
+	if !e.started {
+		e.w.Write(csvColumns)
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// todoTxtTaskEncoder writes tasks as todo.txt. Projects and tags become
+// projects and contexts with spaces replaced by underscores. Description
+// can not be represented in todo.txt, so it is not exported
+type todoTxtTaskEncoder struct {
+	w        io.Writer
+	projects map[int64]string
+}
+
+func (e *todoTxtTaskEncoder) Encode(task *model.Task) error {
+	item := lib.TodoTxtItem{
+		Completed:    task.IsCompleted,
+		Priority:     todoTxtPriority(task.Priority),
+		CreationDate: task.CreatedAt,
+		Text:         strings.Join(strings.Fields(task.Title), " "),
+	}
+	if task.IsCompleted {
+		item.CompletionDate = task.CompletedAt
+		if item.CompletionDate == nil {
+			item.CompletionDate = task.UpdatedAt
+		}
+	}
+	if name := e.projects[task.ProjectID]; name != "" {
+		item.Projects = []string{todoTxtName(name)}
+	}
+	for _, tag := range task.Tags {
+		item.Contexts = append(item.Contexts, todoTxtName(tag.Name))
+	}
+	if task.DueAt != nil {
+		item.Extensions = append(item.Extensions, lib.TodoTxtExtension{Key: "due", Value: formatExportTime(task.DueAt, task.IsAllDay)})
+	}
+	if task.StartAt != nil {
+		item.Extensions = append(item.Extensions, lib.TodoTxtExtension{Key: "t", Value: formatExportTime(task.StartAt, task.IsAllDay)})
+	}
+	if task.RRule != "" {
+		item.Extensions = append(item.Extensions, lib.TodoTxtExtension{Key: "rrule", Value: task.RRule})
+	}
+	if task.IsCompleted && item.Priority != 0 {
+		item.Extensions = append(item.Extensions, lib.TodoTxtExtension{Key: "pri", Value: string(item.Priority)})
+	}
+	// todo.txt can not have spaces in values, so such ids are not kept
+	if uid := taskUID(task); !strings.ContainsAny(uid, " \t") {
+		item.Extensions = append(item.Extensions, lib.TodoTxtExtension{Key: "uid", Value: uid})
+	}
+
+	_, err := io.WriteString(e.w, item.String()+"\n")
+	return err
+}
+
+func (e *todoTxtTaskEncoder) Close() error {
+	return nil
+}
+
+// formatExportTime formats the time for CSV and todo.txt. Dates of all-day
+// tasks are stored as midnight UTC, so they are formatted in UTC
+func formatExportTime(t *time.Time, isDate bool) string {
+	if t == nil {
+		return ""
+	}
+	if isDate {
+		return t.UTC().Format(lib.TodoTxtDateFormat)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// todoTxtPriority converts priority of the task, where greater is more
+// important, into todo.txt priority, where A is the highest one
+func todoTxtPriority(priority int) byte {
+	switch {
+	case priority <= 0:
+		return 0
+	case priority >= 9:
+		return 'A'
+	default:
+		return byte('A' + 9 - priority)
+	}
+}
+
+// todoTxtName makes name of project or tag a single word
+func todoTxtName(name string) string {
+	return strings.Join(strings.Fields(name), "_")
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// savedFilterRequest defines input of create and update saved filter operations
+type savedFilterRequest struct {
+	Name   string           `json:"name"`
+	Filter model.TaskFilter `json:"filter"`
+}
+
+func (r savedFilterRequest) validate() error {
+	if r.Name == "" {
+		return errors.New("filter name must be provided")
+	}
+	return r.Filter.Validate()
+}
+
+// GetListFiltersHandler creates HTTP handler which lists system filters and
+// filters saved by current user
+func GetListFiltersHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		filters := []model.SavedFilter{}
+		err := db.Where("is_system = ? or user_id = ?", true, currentUserID(c)).
+			Order("is_system desc, id").
+			Find(&filters).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, filters)
+	}
+}
+
+// GetGetFilterHandler creates HTTP handler for Get Saved Filter operation
+func GetGetFilterHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		filter, err := findVisibleFilter(c, db)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, filter)
+	}
+}
+
+// GetCreateFilterHandler creates HTTP handler for Create Saved Filter operation
+func GetCreateFilterHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		req := savedFilterRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if err := req.validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		filter := model.SavedFilter{
+			UserID: currentUserID(c),
+			Name:   req.Name,
+			Filter: req.Filter,
+		}
+		if err := db.Create(&filter).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusCreated, filter)
+	}
+}
+
+// GetUpdateFilterHandler creates HTTP handler for Update Saved Filter operation
+func GetUpdateFilterHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		filter, err := findOwnFilter(c, db)
+		if err != nil {
+			return err
+		}
+
+		req := savedFilterRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if err := req.validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		filter.Name = req.Name
+		filter.Filter = req.Filter
+		if err := db.Save(filter).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, filter)
+	}
+}
+
+// GetDeleteFilterHandler creates HTTP handler for Delete Saved Filter operation
+func GetDeleteFilterHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		filter, err := findOwnFilter(c, db)
+		if err != nil {
+			return err
+		}
+
+		if err := db.Delete(filter).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetFilterTasksHandler creates HTTP handler which lists tasks matching the
+// saved filter
+func GetFilterTasksHandler(db *gorm.DB, cursorSecret string) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		filter, err := findVisibleFilter(c, db)
+		if err != nil {
+			return err
+		}
+
+		return listTasks(c, db, cursorSecret, filter.Filter)
+	}
+}
+
+// findVisibleFilter loads filter by id from request if it is either a system
+// filter or belongs to current user. Returns echo HTTP error otherwise
+func findVisibleFilter(c *echo.Context, db *gorm.DB) (*model.SavedFilter, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	filter := &model.SavedFilter{}
+	err = db.Where("is_system = ? or user_id = ?", true, currentUserID(c)).First(filter, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, NewApiError("filter not found").String())
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+
+	return filter, nil
+}
+
+// findOwnFilter loads filter by id from request if it can be modified by
+// current user. Returns echo HTTP error otherwise
+func findOwnFilter(c *echo.Context, db *gorm.DB) (*model.SavedFilter, error) {
+	filter, err := findVisibleFilter(c, db)
+	if err != nil {
+		return nil, err
+	}
+	if filter.IsSystem {
+		return nil, echo.NewHTTPError(http.StatusForbidden, NewApiError("system filters can not be modified").String())
+	}
+
+	return filter, nil
+}
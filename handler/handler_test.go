@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// testUserID is the user requests of test servers are authorized as
+const testUserID int64 = 1
+
+// newTestDB creates database in a temporary directory with schema of the
+// application and the test user. The returned function removes it
+func newTestDB(t *testing.T) (*gorm.DB, func()) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "test.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	err = db.AutoMigrate(
+		&model.Task{},
+		&model.User{},
+		&model.Tag{},
+		&model.Project{},
+		&model.TaskDependency{},
+		&model.Reminder{},
+		&model.Comment{},
+		&model.Attachment{},
+		&model.TaskEvent{},
+		&model.OutboxEvent{},
+	).Error
+	if err == nil {
+		err = db.Create(&model.User{Id: testUserID, FacebookID: "test", Name: "Test"}).Error
+	}
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return &db, cleanup
+}
+
+// newTestServer creates server whose requests are authorized as the test user
+func newTestServer() *echo.Echo {
+	e := echo.New()
+	e.Use(func(c *echo.Context) error {
+		c.Set(userIDKey, testUserID)
+		return nil
+	})
+	return e
+}
+
+// createTestTask saves a task of the test user
+func createTestTask(t *testing.T, db *gorm.DB, title string) *model.Task {
+	task := &model.Task{Title: title}
+	if err := createTask(db, testUserID, task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
@@ -0,0 +1,329 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// OperationIDHeader is set in responses of requests which changed tasks. Its
+// value identifies the operation for undo
+const OperationIDHeader = "X-Operation-Id"
+
+// operationIDKey is a key of the operation id in gorm values
+const operationIDKey = "todo:operation_id"
+
+// DefaultUndoWindow is used when period, during which an operation can be
+// undone, is not configured
+const DefaultUndoWindow = 5 * time.Minute
+
+var errVersionNotFound = errors.New("version not found")
+
+// GetTaskHistoryHandler creates HTTP handler which lists changes of the task
+// from the oldest one
+func GetTaskHistoryHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		limit, offset, err := parsePagination(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		events := []model.TaskEvent{}
+		err = db.Where("task_id = ?", task.Id).
+			Order("id").
+			Limit(limit).
+			Offset(offset).
+			Find(&events).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, events)
+	}
+}
+
+// GetRevertTaskHandler creates HTTP handler which restores fields of the task
+// from its version given by 'version' parameter. Revert is recorded as a new
+// version, so it can be reverted as well. Deletion of the task is not
+// reverted: there are separate operations for it
+func GetRevertTaskHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+		version, err := strconv.ParseInt(c.Query("version"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError("version must be a number"))
+		}
+
+		event := model.TaskEvent{}
+		err = db.Where("task_id = ? and version = ? and snapshot <> ?", task.Id, version, "").First(&event).Error
+		if err == gorm.RecordNotFound {
+			return c.JSON(http.StatusNotFound, NewApiError(errVersionNotFound.Error()))
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		reverted := &model.Task{}
+		if err := json.Unmarshal([]byte(event.Snapshot), reverted); err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		reverted.IsDeleted = task.IsDeleted
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		err = inTransaction(opDB, func(tx *gorm.DB) error {
+			return replaceTask(tx, currentUserID(c), task, reverted, model.TaskEventReverted)
+		})
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return respondWithTask(c, db, reverted)
+	}
+}
+
+// GetUndoHandler creates HTTP handler which reverses changes of tasks made by
+// the operation. Only the last operation of the user made within the window
+// can be undone. Undo is an operation itself, so undoing it redoes the
+// original changes
+func GetUndoHandler(db *gorm.DB, window time.Duration) echo.HandlerFunc {
+	if window <= 0 {
+		window = DefaultUndoWindow
+	}
+
+	return func(c *echo.Context) error {
+		userID := currentUserID(c)
+		id := c.Param("operation_id")
+
+		events := []model.TaskEvent{}
+		if err := db.Where("actor_id = ? and operation_id = ?", userID, id).Order("id desc").Find(&events).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		if len(events) == 0 {
+			return c.JSON(http.StatusNotFound, NewApiError("operation not found"))
+		}
+
+		last := model.TaskEvent{}
+		if err := db.Where("actor_id = ?", userID).Order("id desc").First(&last).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		if last.OperationID != id {
+			return c.JSON(http.StatusConflict, NewApiError("only the last operation can be undone"))
+		}
+		if events[0].CreatedAt.Add(window).Before(time.Now()) {
+			return c.JSON(http.StatusConflict, NewApiError("operation is too old to be undone"))
+		}
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		tasks := []model.Task{}
+		err = inTransaction(opDB, func(tx *gorm.DB) error {
+			undone := map[int64]bool{}
+			for i := range events {
+				task, err := undoTaskEvent(tx, userID, &events[i])
+				if err != nil {
+					return err
+				}
+				if !undone[task.Id] {
+					undone[task.Id] = true
+					tasks = append(tasks, *task)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
+
+		// tasks could be changed by undo of later events
+		for i := range tasks {
+			if err := db.First(&tasks[i], tasks[i].Id).Error; err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+		}
+		if err := loadTaskDetails(db, tasks); err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return c.JSON(http.StatusOK, tasks)
+	}
+}
+
+// undoTaskEvent reverses the event: created task is deleted, fields changed by
+// other events get their previous values back
+func undoTaskEvent(db *gorm.DB, userID int64, event *model.TaskEvent) (*model.Task, error) {
+	task, err := findTask(db, userID, event.TaskID)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Type == model.TaskEventCreated {
+		if task.IsDeleted {
+			return task, nil
+		}
+		before := *task
+		task.IsDeleted = true
+		if err := db.Save(task).Error; err != nil {
+			return nil, err
+		}
+		return task, recordTaskEvent(db, userID, model.TaskEventDeleted, &before, task)
+	}
+
+	previous := map[string]interface{}{}
+	var tagIDs, blockerIDs []int64
+	for _, change := range event.Changes {
+		if change.Field == taskTagsField {
+			tagIDs = parseIDs(change.Before)
+			continue
+		}
+		if change.Field == taskBlockedByField {
+			blockerIDs = parseIDs(change.Before)
+			continue
+		}
+		previous[change.Field] = change.Before
+	}
+	patch, err := json.Marshal(previous)
+	if err != nil {
+		return nil, err
+	}
+	undone, err := patchTask(task, patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(previous) > 0 {
+		if err := replaceTask(db, userID, task, undone, model.TaskEventReverted); err != nil {
+			return nil, err
+		}
+	}
+	if tagIDs != nil {
+		if err := setTaskTags(db, userID, undone, tagIDs, model.TaskEventReverted); err != nil {
+			return nil, err
+		}
+	}
+	if blockerIDs != nil {
+		if err := setTaskBlockers(db, userID, undone, blockerIDs, model.TaskEventReverted); err != nil {
+			return nil, err
+		}
+	}
+	return undone, nil
+}
+
+// recordTaskEvent saves the event with changes between two states of the
+// task and a snapshot of its new state. Event which changes nothing is not
+// recorded
+func recordTaskEvent(db *gorm.DB, actorID int64, eventType string, before, after *model.Task) error {
+	return recordTaskChanges(db, actorID, eventType, after, model.DiffTasks(before, after))
+}
+
+// recordTaskChanges saves the event with the changes and a snapshot of the
+// task. It is used directly for changes which are not fields of the task
+func recordTaskChanges(db *gorm.DB, actorID int64, eventType string, after *model.Task, changes []model.TaskChange) error {
+	event := model.TaskEvent{
+		TaskID:      after.Id,
+		Version:     after.Version,
+		ActorID:     actorID,
+		OperationID: operationID(db),
+		Type:        eventType,
+		Changes:     changes,
+	}
+	if eventType != model.TaskEventCreated && len(event.Changes) == 0 {
+		return nil
+	}
+
+	snapshot, err := json.Marshal(after)
+	if err != nil {
+		return err
+	}
+	event.Snapshot = string(snapshot)
+	if err := db.Create(&event).Error; err != nil {
+		return err
+	}
+	return publishTaskEvent(db, &event, after)
+}
+
+// outboxEvents maps types of task events to types of domain events
+var outboxEvents = map[string]string{
+	model.TaskEventCreated:   model.EventTaskCreated,
+	model.TaskEventUpdated:   model.EventTaskUpdated,
+	model.TaskEventReverted:  model.EventTaskUpdated,
+	model.TaskEventCompleted: model.EventTaskCompleted,
+	model.TaskEventDeleted:   model.EventTaskDeleted,
+	model.TaskEventRestored:  model.EventTaskRestored,
+}
+
+// publishTaskEvent writes the task event to the outbox. It is called in the
+// transaction of the change, so the event is published if and only if the
+// change is committed
+func publishTaskEvent(db *gorm.DB, event *model.TaskEvent, task *model.Task) error {
+	outboxEvent, err := model.NewOutboxEvent(task.UserID, model.EventPayload{
+		Event:      outboxEvents[event.Type],
+		OccurredAt: *event.CreatedAt,
+		Task:       task,
+		Changes:    event.Changes,
+	})
+	if err != nil {
+		return err
+	}
+	return db.Create(outboxEvent).Error
+}
+
+// withOperation returns db which tags all task events recorded through it
+// with a new operation id. The id is reported to the client, so the operation
+// can be undone
+func withOperation(db *gorm.DB) (*gorm.DB, string, error) {
+	random, err := lib.GenerateRandomBytes(16)
+	if err != nil {
+		return nil, "", err
+	}
+	id := hex.EncodeToString(random)
+	return db.Set(operationIDKey, id), id, nil
+}
+
+// operationID returns id of the operation db is tagged with
+func operationID(db *gorm.DB) string {
+	if id, ok := db.Get(operationIDKey); ok {
+		return id.(string)
+	}
+	return ""
+}
+
+// inTransaction runs the function in a transaction, which is committed if the
+// function succeeds. If db is already a transaction, it is used as is, so the
+// function becomes a part of the outer transaction
+func inTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return fn(db)
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,389 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+const icalContentType = "text/calendar; charset=utf-8"
+const icalProductID = "-//seesawlabs//ivan-kirichenko-exercise//EN"
+
+// icalUIDDomain makes UIDs of tasks which were not imported globally unique
+const icalUIDDomain = "ivan-kirichenko-exercise"
+
+// maxICalImportSize limits size of imported iCalendar data
+const maxICalImportSize = 10 << 20
+
+var errICalTooLarge = errors.New("iCalendar data is too large")
+var errICalNoTitle = errors.New("SUMMARY must be provided")
+
+// icalTaskFields lists fields of the task which are represented in VTODO
+var icalTaskFields = []string{"Title", "Description", "Priority", "StartAt", "DueAt", "IsAllDay", "RRule", "IsCompleted"}
+
+// calendarFeedResponse defines output of enable calendar feed operation
+type calendarFeedResponse struct {
+	URL string `json:"url"`
+}
+
+// GetEnableCalendarFeedHandler creates HTTP handler which generates a new
+// secret URL of current user's calendar feed. URL issued before stops working
+func GetEnableCalendarFeedHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		token, err := lib.GenerateRandomString(24)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		err = db.Model(&model.User{}).Where("id = ?", currentUserID(c)).
+			UpdateColumns(map[string]interface{}{"calendar_token": token, "updated_at": time.Now()}).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, calendarFeedResponse{URL: requestBaseURL(c) + "/calendar/" + token + ".ics"})
+	}
+}
+
+// GetDisableCalendarFeedHandler creates HTTP handler which revokes URL of
+// current user's calendar feed
+func GetDisableCalendarFeedHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		err := db.Model(&model.User{}).Where("id = ?", currentUserID(c)).
+			UpdateColumns(map[string]interface{}{"calendar_token": "", "updated_at": time.Now()}).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetCalendarFeedHandler creates HTTP handler which renders tasks with due
+// dates of the user the secret token belongs to as iCalendar. The handler is
+// public: calendar applications can not send authorization headers
+func GetCalendarFeedHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		token := strings.TrimSuffix(c.Param("token"), ".ics")
+		if token == "" {
+			return c.JSON(http.StatusNotFound, NewApiError("calendar not found"))
+		}
+
+		user := model.User{}
+		err := db.Where("calendar_token = ?", token).First(&user).Error
+		if err == gorm.RecordNotFound {
+			return c.JSON(http.StatusNotFound, NewApiError("calendar not found"))
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		tasks := []model.Task{}
+		err = db.Where("user_id = ? and is_deleted = ? and due_at is not null", user.Id, false).
+			Order("id").
+			Find(&tasks).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		calendar := newICalendar(user.Name)
+		for i := range tasks {
+			calendar.Components = append(calendar.Components, taskToICal(&tasks[i]))
+		}
+
+		buf := &bytes.Buffer{}
+		if err := calendar.Encode(buf); err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		c.Response().Header().Set(echo.ContentType, icalContentType)
+		c.Response().WriteHeader(http.StatusOK)
+		_, err = c.Response().Write(buf.Bytes())
+		return err
+	}
+}
+
+// GetImportICalHandler creates HTTP handler which imports VTODO components of
+// iCalendar data as current user's tasks. Task imported before under the same
+// UID is updated instead of creating a new one. Every component is imported
+// independently, failed ones are reported
+func GetImportICalHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		content, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxICalImportSize+1))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		if len(content) > maxICalImportSize {
+			return c.JSON(http.StatusRequestEntityTooLarge, NewApiError(errICalTooLarge.Error()))
+		}
+		calendar, err := lib.ParseICal(bytes.NewReader(content))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		userID := currentUserID(c)
+		location, err := userLocation(db, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		resp := importResponse{OperationID: opID, Errors: []importError{}}
+		for i, component := range calendar.Find("VTODO") {
+			record := importRecord{ExternalID: component.Text("UID"), Fields: icalTaskFields}
+			record.Task, record.Err = taskFromICal(component, location)
+			action, err := importTask(opDB, userID, record)
+			resp.add(i, record, action, err)
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// mergeICalTask changes fields of the existing task which are represented in
+// iCalendar, including the project, by values of the imported one
+func mergeICalTask(db *gorm.DB, actorID int64, existing, imported *model.Task) (bool, error) {
+	fields := append([]string{"ProjectID"}, icalTaskFields...)
+	return mergeImportedTask(db, actorID, existing, imported, fields)
+}
+
+// findTaskByUID loads user's task which is not deleted by UID of iCalendar
+// component. UID is either external id of imported task or UID generated
+// for the task on export
+func findTaskByUID(db *gorm.DB, userID int64, uid string) (*model.Task, error) {
+	task := &model.Task{}
+	err := db.Where("user_id = ? and external_id = ? and is_deleted = ?", userID, uid, false).
+		Order("id desc").
+		First(task).Error
+	if err == nil {
+		return task, nil
+	} else if err != gorm.RecordNotFound {
+		return nil, err
+	}
+
+	id, ok := parseTaskUID(uid)
+	if !ok {
+		return nil, errTaskNotFound
+	}
+	task, err = findTask(db, userID, id)
+	if err == nil && (task.IsDeleted || task.ExternalID != "") {
+		return nil, errTaskNotFound
+	}
+	return task, err
+}
+
+// taskUID returns UID of iCalendar component of the task
+func taskUID(task *model.Task) string {
+	if task.ExternalID != "" {
+		return task.ExternalID
+	}
+	return fmt.Sprintf("task-%d@%s", task.Id, icalUIDDomain)
+}
+
+// parseTaskUID returns id of the task from UID generated by taskUID
+func parseTaskUID(uid string) (int64, bool) {
+	if !strings.HasPrefix(uid, "task-") || !strings.HasSuffix(uid, "@"+icalUIDDomain) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(uid[len("task-"):len(uid)-len(icalUIDDomain)-1], 10, 64)
+	return id, err == nil && id > 0
+}
+
+func newICalendar(name string) *lib.ICalComponent {
+	calendar := lib.NewICalComponent("VCALENDAR")
+	calendar.Add("VERSION", "2.0")
+	calendar.Add("PRODID", icalProductID)
+	calendar.Add("CALSCALE", "GREGORIAN")
+	if name != "" {
+		calendar.AddText("X-WR-CALNAME", name)
+	}
+	return calendar
+}
+
+// taskToICal renders the task for calendar feed. All-day task is rendered as
+// VEVENT lasting from its start date till its due date, so calendars show it
+// as all-day item. VEVENT has no completion status, so it is kept in
+// non-standard X-COMPLETED property. Other tasks are rendered as VTODO
+func taskToICal(task *model.Task) *lib.ICalComponent {
+	if !task.IsAllDay || task.DueAt == nil {
+		return taskToVTodo(task)
+	}
+
+	component := lib.NewICalComponent("VEVENT")
+	start := *task.DueAt
+	if task.StartAt != nil && task.StartAt.Before(start) {
+		start = *task.StartAt
+	}
+	addICalTime(component, "DTSTART", start, true)
+	addICalTime(component, "DTEND", task.DueAt.AddDate(0, 0, 1), true)
+	if task.CompletedAt != nil {
+		component.Add("X-COMPLETED", formatICalTime(*task.CompletedAt))
+	}
+	addICalTaskProperties(component, task)
+	return component
+}
+
+// taskToVTodo renders the task as VTODO. Dates of all-day task are rendered
+// without time
+func taskToVTodo(task *model.Task) *lib.ICalComponent {
+	component := lib.NewICalComponent("VTODO")
+	if task.StartAt != nil {
+		addICalTime(component, "DTSTART", *task.StartAt, task.IsAllDay)
+	}
+	if task.DueAt != nil {
+		addICalTime(component, "DUE", *task.DueAt, task.IsAllDay)
+	}
+	if task.IsCompleted {
+		component.Add("STATUS", "COMPLETED")
+		if task.CompletedAt != nil {
+			component.Add("COMPLETED", formatICalTime(*task.CompletedAt))
+		}
+	} else {
+		component.Add("STATUS", "NEEDS-ACTION")
+	}
+	addICalTaskProperties(component, task)
+	return component
+}
+
+// addICalTaskProperties adds properties which are common for all components
+// a task is rendered as
+func addICalTaskProperties(component *lib.ICalComponent, task *model.Task) {
+	component.AddText("UID", taskUID(task))
+	if task.UpdatedAt != nil {
+		component.Add("DTSTAMP", formatICalTime(*task.UpdatedAt))
+		component.Add("LAST-MODIFIED", formatICalTime(*task.UpdatedAt))
+	}
+	if task.CreatedAt != nil {
+		component.Add("CREATED", formatICalTime(*task.CreatedAt))
+	}
+	component.Add("SEQUENCE", strconv.FormatInt(task.Version, 10))
+	component.AddText("SUMMARY", task.Title)
+	if task.Description != "" {
+		component.AddText("DESCRIPTION", task.Description)
+	}
+	if priority := icalPriority(task.Priority); priority > 0 {
+		component.Add("PRIORITY", strconv.Itoa(priority))
+	}
+	if task.RRule != "" {
+		component.Add("RRULE", task.RRule)
+	}
+}
+
+func addICalTime(component *lib.ICalComponent, name string, t time.Time, isDate bool) {
+	if isDate {
+		component.Add(name, t.Format(lib.ICalDateFormat), "VALUE", "DATE")
+	} else {
+		component.Add(name, formatICalTime(t))
+	}
+}
+
+// taskFromICal converts VTODO component into a task. Floating times are
+// interpreted in the location. Task with due date without time is all-day
+func taskFromICal(component *lib.ICalComponent, location *time.Location) (*model.Task, error) {
+	task := &model.Task{
+		ExternalID:  component.Text("UID"),
+		Title:       strings.TrimSpace(component.Text("SUMMARY")),
+		Description: component.Text("DESCRIPTION"),
+	}
+	if task.ExternalID == "" {
+		return nil, errors.New("UID must be provided")
+	}
+	if task.Title == "" {
+		return nil, errICalNoTitle
+	}
+
+	if property := component.Get("DUE"); property != nil {
+		due, isDate, err := lib.ParseICalTime(property, location)
+		if err != nil {
+			return nil, errors.New("invalid DUE: " + property.Value)
+		}
+		task.DueAt = &due
+		task.IsAllDay = isDate
+	}
+	if property := component.Get("DTSTART"); property != nil {
+		start, _, err := lib.ParseICalTime(property, location)
+		if err != nil {
+			return nil, errors.New("invalid DTSTART: " + property.Value)
+		}
+		task.StartAt = &start
+	}
+
+	if property := component.Get("PRIORITY"); property != nil {
+		priority, err := strconv.Atoi(property.Value)
+		if err != nil {
+			return nil, errors.New("invalid PRIORITY: " + property.Value)
+		}
+		task.Priority = taskPriority(priority)
+	}
+
+	if property := component.Get("RRULE"); property != nil {
+		rule, err := lib.ParseRRule(property.Value)
+		if err != nil {
+			return nil, recurrenceError{err}
+		}
+		task.RRule = rule.String()
+	}
+
+	if property := component.Get("COMPLETED"); property != nil || strings.ToUpper(component.Text("STATUS")) == "COMPLETED" {
+		completedAt := time.Now()
+		if property != nil {
+			if t, _, err := lib.ParseICalTime(property, location); err == nil {
+				completedAt = t
+			}
+		}
+		task.IsCompleted = true
+		task.CompletedAt = &completedAt
+	}
+	return task, nil
+}
+
+// icalPriority converts priority of the task, where greater is more
+// important, into iCalendar priority, where 1 is the highest and 9 is the
+// lowest one. Zero means undefined priority in both
+func icalPriority(priority int) int {
+	switch {
+	case priority <= 0:
+		return 0
+	case priority >= 9:
+		return 1
+	default:
+		return 10 - priority
+	}
+}
+
+// taskPriority converts iCalendar priority into priority of the task
+func taskPriority(priority int) int {
+	if priority <= 0 || priority > 9 {
+		return 0
+	}
+	return 10 - priority
+}
+
+func formatICalTime(t time.Time) string {
+	return t.UTC().Format(lib.ICalDateTimeFormat)
+}
+
+// requestBaseURL returns scheme and host the request was sent to. Scheme of
+// the original request is taken from the proxy header, if any
+func requestBaseURL(c *echo.Context) string {
+	scheme := "http"
+	if c.Request().TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.Request().Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request().Host
+}
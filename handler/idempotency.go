@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+const idempotentReplayedHeader = "Idempotent-Replayed"
+const maxIdempotencyKeyLength = 255
+
+// DefaultIdempotencyTTL is used when TTL of stored responses is not configured
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// DefaultIdempotencyMaxBody is used when maximum size of a body buffered for
+// the fingerprint is not configured. It matches limits of imports
+const DefaultIdempotencyMaxBody = 10 << 20
+
+// IdempotencyStorage defines some key-value storage for responses of requests
+// with idempotency keys. Add must fail if the key already exists, so only one
+// of concurrent requests with the same key is processed
+type IdempotencyStorage interface {
+	TokenStorage
+	Add(k string, x interface{}, d time.Duration) error
+}
+
+// idempotentResponse is a response stored for an idempotency key. Response is
+// nil while the first request with the key is still in progress
+type idempotentResponse struct {
+	fingerprint string
+	response    *recordedResponse
+}
+
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// responseRecorder passes response through to the client and keeps its copy
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// GetIdempotencyMiddleware creates a middleware which makes POST and PATCH
+// requests with Idempotency-Key header safe to retry. The first response for
+// the key is stored and replayed for retries of the same request. Reusing the
+// key for a different request is rejected. Must be used after JWT auth handler,
+// because keys are scoped by user. Body is buffered to fingerprint the request,
+// so bodies larger than maxBody are rejected. Multipart uploads are streamed
+// to disk by their handler and are processed without idempotency
+func GetIdempotencyMiddleware(storage IdempotencyStorage, ttl time.Duration, maxBody int64) echo.MiddlewareFunc {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if maxBody <= 0 {
+		maxBody = DefaultIdempotencyMaxBody
+	}
+
+	return func(h echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			key := req.Header.Get(idempotencyKeyHeader)
+			if key == "" || (req.Method != echo.POST && req.Method != echo.PATCH) {
+				return h(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return c.JSON(http.StatusBadRequest, NewApiError("idempotency key is too long"))
+			}
+
+			if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/") {
+				return h(c)
+			}
+
+			body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1))
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+			}
+			if int64(len(body)) > maxBody {
+				return c.JSON(http.StatusRequestEntityTooLarge,
+					NewApiError(fmt.Sprintf("body of request with idempotency key must not exceed %d bytes", maxBody)))
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			storageKey := strconv.FormatInt(currentUserID(c), 10) + ":" + key
+			// query changes meaning of requests, e.g. dry_run of import
+			fingerprint := lib.Sha1Bytes([]byte(req.Method + " " + req.URL.Path + "?" + req.URL.RawQuery + "\n" + string(body)))
+
+			if err := storage.Add(storageKey, idempotentResponse{fingerprint: fingerprint}, ttl); err != nil {
+				return replayIdempotentResponse(c, storage, storageKey, fingerprint)
+			}
+
+			recorder := &responseRecorder{ResponseWriter: c.Response().Writer()}
+			c.Response().SetWriter(recorder)
+			err = h(c)
+			c.Response().SetWriter(recorder.ResponseWriter)
+
+			// failed requests are not stored, so the client can retry them
+			if err != nil || c.Response().Status() >= http.StatusInternalServerError {
+				storage.Delete(storageKey)
+				return err
+			}
+
+			header := http.Header{}
+			for k, v := range c.Response().Header() {
+				header[k] = append([]string(nil), v...)
+			}
+			storage.Set(storageKey, idempotentResponse{
+				fingerprint: fingerprint,
+				response: &recordedResponse{
+					status: c.Response().Status(),
+					header: header,
+					body:   recorder.body.Bytes(),
+				},
+			}, ttl)
+
+			return nil
+		}
+	}
+}
+
+// replayIdempotentResponse responds with a stored response for the key
+func replayIdempotentResponse(c *echo.Context, storage IdempotencyStorage, key, fingerprint string) error {
+	cached, found := storage.Get(key)
+	stored, ok := cached.(idempotentResponse)
+	if !found || !ok {
+		return c.JSON(http.StatusConflict, NewApiError("request with this idempotency key is in progress, try again"))
+	}
+	if stored.fingerprint != fingerprint {
+		return c.JSON(http.StatusConflict, NewApiError("idempotency key was already used for another request"))
+	}
+	if stored.response == nil {
+		return c.JSON(http.StatusConflict, NewApiError("request with this idempotency key is in progress, try again"))
+	}
+
+	for k, v := range stored.response.header {
+		c.Response().Header()[k] = v
+	}
+	c.Response().Header().Set(idempotentReplayedHeader, "true")
+	c.Response().WriteHeader(stored.response.status)
+	_, err := c.Response().Write(stored.response.body)
+	return err
+}
@@ -0,0 +1,609 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// maxTaskImportSize limits size of imported data
+const maxTaskImportSize = 10 << 20
+
+// outcomes of import of a single task
+const (
+	importActionCreated   = "created"
+	importActionUpdated   = "updated"
+	importActionUnchanged = "unchanged"
+)
+
+var errImportTooLarge = errors.New("imported data is too large")
+var errImportNoTitle = errors.New("title must be provided")
+var errCSVNoTitle = errors.New("title column must be present or mapped")
+
+// importTimeFormats lists accepted formats of times in CSV and todo.txt.
+// Times without timezone are interpreted in timezone of the user
+var importTimeFormats = []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"}
+
+// jsonImportFields lists fields of the task which are imported from JSON
+var jsonImportFields = []string{
+	"ProjectID", "Title", "Description", "Priority", "StartAt", "DueAt", "IsAllDay", "RRule", "IsCompleted",
+}
+
+// importError describes an item of import which could not be applied
+type importError struct {
+	Index      int    `json:"index"`
+	ExternalID string `json:"external_id,omitempty"`
+	Error      string `json:"error"`
+}
+
+// importPreview describes what import of an item does. It is reported by
+// dry run
+type importPreview struct {
+	Index      int    `json:"index"`
+	ExternalID string `json:"external_id,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Action     string `json:"action"`
+}
+
+// importResponse defines output of import operations. Dry run changes
+// nothing, so it has no operation
+type importResponse struct {
+	OperationID string          `json:"operation_id,omitempty"`
+	DryRun      bool            `json:"dry_run,omitempty"`
+	Created     int             `json:"created"`
+	Updated     int             `json:"updated"`
+	Unchanged   int             `json:"unchanged"`
+	Errors      []importError   `json:"errors"`
+	Preview     []importPreview `json:"preview,omitempty"`
+}
+
+// add counts outcome of import of the item
+func (r *importResponse) add(index int, record importRecord, action string, err error) {
+	if err != nil {
+		r.Errors = append(r.Errors, importError{Index: index, ExternalID: record.ExternalID, Error: err.Error()})
+		return
+	}
+
+	switch action {
+	case importActionCreated:
+		r.Created++
+	case importActionUpdated:
+		r.Updated++
+	default:
+		r.Unchanged++
+	}
+	if r.DryRun {
+		r.Preview = append(r.Preview, importPreview{
+			Index:      index,
+			ExternalID: record.ExternalID,
+			Title:      record.Task.Title,
+			Action:     action,
+		})
+	}
+}
+
+// importRecord defines a task read from imported data. Only listed fields
+// were present in the data, so only they are changed in the task imported
+// before. Nil project means the project was not present. Err is set when the
+// item could not be read
+type importRecord struct {
+	ExternalID string
+	Task       *model.Task
+	Fields     []string
+	Project    *string
+	Tags       []string
+	Err        error
+}
+
+// GetImportTasksHandler creates HTTP handler which imports current user's
+// tasks from newline-delimited JSON, JSON array, CSV or todo.txt. Task
+// imported before under the same external id is updated instead of creating
+// a new one, so data exported by this service or by another tool can be
+// imported again. Columns of CSV are mapped to fields by name, other names
+// are given with map=<field>:<column> params. Dry run reports what import
+// would do, changing nothing. Every item is imported independently, failed
+// ones are reported
+func GetImportTasksHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+		content, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxTaskImportSize+1))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		if len(content) > maxTaskImportSize {
+			return c.JSON(http.StatusRequestEntityTooLarge, NewApiError(errImportTooLarge.Error()))
+		}
+
+		userID := currentUserID(c)
+		location, err := userLocation(db, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		var records []importRecord
+		switch c.Query("format") {
+		case "", transferFormatNDJSON, transferFormatJSON:
+			records, err = parseJSONImport(content)
+		case transferFormatCSV:
+			records, err = parseCSVImport(content, c.Request().URL.Query()["map"], location)
+		case transferFormatTodoTxt:
+			records, err = parseTodoTxtImport(content, location)
+		default:
+			err = errUnknownFormat
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		resp := importResponse{DryRun: dryRun, Errors: []importError{}}
+		if dryRun {
+			// everything is done in a transaction, which is rolled back
+			tx := db.Begin()
+			if tx.Error != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(tx.Error.Error()))
+			}
+			for i, record := range records {
+				action, err := importTask(tx, userID, record)
+				resp.add(i, record, action, err)
+			}
+			tx.Rollback()
+			return c.JSON(http.StatusOK, resp)
+		}
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		resp.OperationID = opID
+		for i, record := range records {
+			action, err := importTask(opDB, userID, record)
+			resp.add(i, record, action, err)
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// importTask creates the task or updates the one imported before with the same
+// external id. Tags are only added, never removed. Completion of existing
+// task goes through the regular path, so recurring task spawns the next
+// occurrence
+func importTask(db *gorm.DB, userID int64, record importRecord) (string, error) {
+	if record.Err != nil {
+		return "", record.Err
+	}
+
+	action := ""
+	err := inTransaction(db, func(tx *gorm.DB) error {
+		imported := record.Task
+		fields := append([]string{}, record.Fields...)
+		if record.Project != nil {
+			projectID, err := ensureProjectByName(tx, userID, *record.Project)
+			if err != nil {
+				return err
+			}
+			imported.ProjectID = projectID
+			fields = append(fields, "ProjectID")
+		}
+
+		var existing *model.Task
+		if record.ExternalID != "" {
+			task, err := findTaskByUID(tx, userID, record.ExternalID)
+			if err == nil {
+				existing = task
+			} else if err != errTaskNotFound {
+				return err
+			}
+		}
+
+		taskID := int64(0)
+		if existing == nil {
+			if imported.Title == "" {
+				return errImportNoTitle
+			}
+			if imported.IsCompleted {
+				imported.RRule = ""
+				if imported.CompletedAt == nil {
+					now := time.Now()
+					imported.CompletedAt = &now
+				}
+			}
+			imported.ExternalID = record.ExternalID
+			if err := createTask(tx, userID, imported); err != nil {
+				return err
+			}
+			action = importActionCreated
+			taskID = imported.Id
+		} else {
+			// the series has moved past the completed occurrence, so importing
+			// the same data again must not complete the next one
+			if imported.IsCompleted && existing.RRule != "" && imported.DueAt != nil && existing.DueAt != nil &&
+				imported.DueAt.Before(*existing.DueAt) {
+				action = importActionUnchanged
+				return nil
+			}
+
+			changed, err := mergeImportedTask(tx, userID, existing, imported, fields)
+			if err != nil {
+				return err
+			}
+			action = importActionUnchanged
+			if changed {
+				action = importActionUpdated
+			}
+			taskID = existing.Id
+		}
+
+		if len(record.Tags) == 0 {
+			return nil
+		}
+		task, err := findTask(tx, userID, taskID)
+		if err != nil {
+			return err
+		}
+		added, err := addTaskTagsByName(tx, userID, task, record.Tags)
+		if added && action == importActionUnchanged {
+			action = importActionUpdated
+		}
+		return err
+	})
+	return action, err
+}
+
+// mergeImportedTask changes the listed fields of the existing task by values
+// of the imported one. Completion goes through the regular path, so recurring
+// task spawns the next occurrence and completion is rolled up. Task which is
+// open again in imported data is reopened
+func mergeImportedTask(db *gorm.DB, actorID int64, existing, imported *model.Task, fields []string) (bool, error) {
+	values := map[string]interface{}{}
+	source := reflect.ValueOf(imported).Elem()
+	for _, name := range fields {
+		values[name] = source.FieldByName(name).Interface()
+	}
+
+	patch, err := json.Marshal(values)
+	if err != nil {
+		return false, err
+	}
+	task, err := patchTask(existing, patch)
+	if err != nil {
+		return false, err
+	}
+	if len(model.DiffTasks(existing, task)) == 0 {
+		return false, nil
+	}
+
+	// imported state is authoritative, so blocked tasks are completed anyway
+	if _, err := saveTaskChanges(db, actorID, existing, task, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// parseJSONImport reads tasks in the format they are exported in, either as
+// JSON array or as newline-delimited JSON. Task exported by this service is
+// identified by its id, so it is updated on import into the same account
+func parseJSONImport(content []byte) ([]importRecord, error) {
+	items := []json.RawMessage{}
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		for {
+			item := json.RawMessage{}
+			err := decoder.Decode(&item)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+
+	records := make([]importRecord, 0, len(items))
+	for _, item := range items {
+		keys := map[string]json.RawMessage{}
+		task := &model.Task{}
+		if json.Unmarshal(item, &keys) != nil || json.Unmarshal(item, task) != nil {
+			records = append(records, importRecord{Err: errInvalidTask})
+			continue
+		}
+
+		record := importRecord{ExternalID: task.ExternalID, Task: task}
+		if record.ExternalID == "" && task.Id > 0 {
+			record.ExternalID = taskUID(task)
+		}
+		for _, name := range jsonImportFields {
+			if _, ok := keys[name]; ok {
+				record.Fields = append(record.Fields, name)
+			}
+		}
+		for _, tag := range task.Tags {
+			record.Tags = append(record.Tags, tag.Name)
+		}
+		task.Id = 0
+		task.Tags = nil
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseCSVImport reads tasks from CSV with a header row. Columns named as
+// exported columns are mapped to the fields of the same name, mapping given
+// as <field>:<column> overrides that. Date without time of due date makes
+// the task all-day, unless the column is mapped explicitly
+func parseCSVImport(content []byte, mapping []string, location *time.Location) ([]importRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []importRecord{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	columnNames := map[string]string{}
+	for _, field := range csvColumns {
+		columnNames[field] = field
+	}
+	for _, item := range mapping {
+		parts := strings.SplitN(item, ":", 2)
+		if _, ok := columnNames[parts[0]]; !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid column mapping '%s'", item)
+		}
+		columnNames[parts[0]] = parts[1]
+	}
+	columns := map[string]int{}
+	for field, name := range columnNames {
+		for i, column := range header {
+			if strings.EqualFold(strings.TrimSpace(column), strings.TrimSpace(name)) {
+				columns[field] = i
+				break
+			}
+		}
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, errCSVNoTitle
+	}
+
+	records := []importRecord{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if _, ok := err.(*csv.ParseError); ok {
+			records = append(records, importRecord{Err: err})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, csvImportRecord(row, columns, location))
+	}
+	return records, nil
+}
+
+// csvImportRecord converts the row into the task. Empty cell clears the field
+func csvImportRecord(row []string, columns map[string]int, location *time.Location) importRecord {
+	task := &model.Task{}
+	record := importRecord{Task: task}
+	value := func(field string) (string, bool) {
+		i, ok := columns[field]
+		if !ok || i >= len(row) {
+			return "", ok
+		}
+		return strings.TrimSpace(row[i]), true
+	}
+
+	record.ExternalID, _ = value("external_id")
+	if project, ok := value("project"); ok {
+		record.Project = &project
+	}
+	if tags, ok := value("tags"); ok && tags != "" {
+		record.Tags = strings.Split(tags, ",")
+	}
+
+	task.Title, _ = value("title")
+	record.Fields = append(record.Fields, "Title")
+	if task.Title == "" {
+		record.Err = errImportNoTitle
+		return record
+	}
+	if description, ok := value("description"); ok {
+		task.Description = description
+		record.Fields = append(record.Fields, "Description")
+	}
+	if rrule, ok := value("rrule"); ok {
+		task.RRule = rrule
+		record.Fields = append(record.Fields, "RRule")
+	}
+	if priority, ok := value("priority"); ok {
+		if priority != "" {
+			p, err := strconv.Atoi(priority)
+			if err != nil {
+				record.Err = errors.New("invalid priority: " + priority)
+				return record
+			}
+			task.Priority = p
+		}
+		record.Fields = append(record.Fields, "Priority")
+	}
+
+	dueIsDate := false
+	times := []struct {
+		field  string
+		target **time.Time
+	}{{"start_at", &task.StartAt}, {"due_at", &task.DueAt}, {"completed_at", &task.CompletedAt}}
+	for _, item := range times {
+		field, target := item.field, item.target
+		text, ok := value(field)
+		if !ok || text == "" {
+			continue
+		}
+		t, isDate, err := parseImportTime(text, location)
+		if err != nil {
+			record.Err = fmt.Errorf("invalid %s: %s", field, text)
+			return record
+		}
+		*target = &t
+		if field == "due_at" {
+			dueIsDate = isDate
+		}
+	}
+	if _, ok := columns["start_at"]; ok {
+		record.Fields = append(record.Fields, "StartAt")
+	}
+	if _, ok := columns["due_at"]; ok {
+		record.Fields = append(record.Fields, "DueAt")
+	}
+
+	task.IsAllDay = dueIsDate
+	if allDay, ok := value("is_all_day"); ok && allDay != "" {
+		b, err := parseImportBool(allDay)
+		if err != nil {
+			record.Err = errors.New("invalid is_all_day: " + allDay)
+			return record
+		}
+		task.IsAllDay = b
+	}
+	if _, ok := columns["is_all_day"]; ok || task.DueAt != nil {
+		record.Fields = append(record.Fields, "IsAllDay")
+	}
+
+	completed, ok := value("is_completed")
+	if ok && completed != "" {
+		b, err := parseImportBool(completed)
+		if err != nil {
+			record.Err = errors.New("invalid is_completed: " + completed)
+			return record
+		}
+		task.IsCompleted = b
+	} else {
+		task.IsCompleted = task.CompletedAt != nil
+	}
+	if _, mapped := columns["completed_at"]; ok || mapped {
+		record.Fields = append(record.Fields, "IsCompleted")
+	}
+	return record
+}
+
+// parseTodoTxtImport reads tasks from todo.txt. Due date, threshold date,
+// recurrence rule and external id are read from due, t, rrule and uid
+// extensions. The first project is the project of the task, contexts are its
+// tags. Description is not present in todo.txt, so it is never changed
+func parseTodoTxtImport(content []byte, location *time.Location) ([]importRecord, error) {
+	records := []importRecord{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		records = append(records, todoTxtImportRecord(lib.ParseTodoTxt(line), location))
+	}
+	return records, scanner.Err()
+}
+
+func todoTxtImportRecord(item lib.TodoTxtItem, location *time.Location) importRecord {
+	task := &model.Task{
+		Title:       item.Text,
+		Priority:    taskPriorityFromTodoTxt(item.Priority),
+		IsCompleted: item.Completed,
+		CompletedAt: item.CompletionDate,
+	}
+	record := importRecord{
+		Task:   task,
+		Tags:   item.Contexts,
+		Fields: []string{"Title", "Priority", "StartAt", "DueAt", "IsAllDay", "RRule", "IsCompleted"},
+	}
+	record.ExternalID, _ = item.Extension("uid")
+	project := ""
+	if len(item.Projects) > 0 {
+		project = item.Projects[0]
+	}
+	record.Project = &project
+	if task.Title == "" {
+		record.Err = errImportNoTitle
+		return record
+	}
+
+	if due, ok := item.Extension("due"); ok {
+		t, isDate, err := parseImportTime(due, location)
+		if err != nil {
+			record.Err = errors.New("invalid due: " + due)
+			return record
+		}
+		task.DueAt = &t
+		task.IsAllDay = isDate
+	}
+	if start, ok := item.Extension("t"); ok {
+		t, _, err := parseImportTime(start, location)
+		if err != nil {
+			record.Err = errors.New("invalid t: " + start)
+			return record
+		}
+		task.StartAt = &t
+	}
+	task.RRule, _ = item.Extension("rrule")
+	return record
+}
+
+// taskPriorityFromTodoTxt converts todo.txt priority into priority of the
+// task. It is the reverse of todoTxtPriority
+func taskPriorityFromTodoTxt(priority byte) int {
+	if priority == 0 {
+		return 0
+	}
+	if p := 9 - int(priority-'A'); p > 1 {
+		return p
+	}
+	return 1
+}
+
+// parseImportBool parses boolean value. Besides values of Go syntax, yes, no
+// and x for done are accepted, as other tools use them
+func parseImportBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "y", "x":
+		return true, nil
+	case "no", "n":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// parseImportTime parses date or time. Date is returned as midnight UTC, as
+// dates of all-day tasks are kept
+func parseImportTime(value string, location *time.Location) (time.Time, bool, error) {
+	if t, err := time.Parse(lib.TodoTxtDateFormat, value); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	for _, format := range importTimeFormats {
+		if t, err := time.ParseInLocation(format, value, location); err == nil {
+			return t, false, nil
+		}
+	}
+	return time.Time{}, false, errors.New("invalid time: " + value)
+}
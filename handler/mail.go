@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/mailin"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/storage"
+)
+
+// maxMailPartDepth limits nesting of multipart messages
+const maxMailPartDepth = 5
+
+// mailNoSubject is a title of tasks made of mail without subject
+const mailNoSubject = "(no subject)"
+
+// forwardedMailName is a name of attached message which has no name of its own
+const forwardedMailName = "message.eml"
+
+var errMailMailboxUnavailable = &mailin.Error{Code: 550, Message: "5.1.1 mailbox unavailable"}
+var errMailRelayDenied = &mailin.Error{Code: 550, Message: "5.7.1 relaying is not allowed"}
+var errMailMalformed = &mailin.Error{Code: 554, Message: "5.6.0 message can not be parsed"}
+
+// mailResponse defines output of enable mail operation
+type mailResponse struct {
+	Address string `json:"address"`
+}
+
+// mailAttachment defines a file attached to received mail
+type mailAttachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// mailContent defines parts of received mail a task is made of. Message id
+// becomes external id of the task, so redelivered mail does not create
+// another task
+type mailContent struct {
+	MessageID   string
+	Subject     string
+	Text        string
+	Attachments []mailAttachment
+	hasText     bool
+}
+
+// MailTaskReceiver turns mail received by SMTP listener into tasks. Mail is
+// addressed to a secret token of the user at the domain. Subject becomes the
+// title, the first plain text part becomes the description and attachments
+// are attached to the task
+type MailTaskReceiver struct {
+	db                *gorm.DB
+	store             storage.BlobStore
+	domain            string
+	maxAttachmentSize int64
+}
+
+// NewMailTaskReceiver creates receiver of mail sent to the domain.
+// Attachments larger than maxAttachmentSize make the mail rejected
+func NewMailTaskReceiver(db *gorm.DB, store storage.BlobStore, domain string, maxAttachmentSize int64) *MailTaskReceiver {
+	return &MailTaskReceiver{
+		db:                db,
+		store:             store,
+		domain:            domain,
+		maxAttachmentSize: maxAttachmentSize,
+	}
+}
+
+// GetEnableMailHandler creates HTTP handler which generates a new address
+// current user can send mail to. Address issued before stops working
+func GetEnableMailHandler(db *gorm.DB, domain string) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		random, err := lib.GenerateRandomBytes(12)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		// local part of address is case insensitive in practice
+		token := hex.EncodeToString(random)
+		err = db.Model(&model.User{}).Where("id = ?", currentUserID(c)).
+			UpdateColumns(map[string]interface{}{"mail_token": token, "updated_at": time.Now()}).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, mailResponse{Address: token + "@" + domain})
+	}
+}
+
+// GetDisableMailHandler creates HTTP handler which revokes mail address of
+// current user
+func GetDisableMailHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		err := db.Model(&model.User{}).Where("id = ?", currentUserID(c)).
+			UpdateColumns(map[string]interface{}{"mail_token": "", "updated_at": time.Now()}).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// Recipient accepts addresses of users who enabled mail
+func (r *MailTaskReceiver) Recipient(address string) error {
+	_, err := r.findRecipient(address)
+	return err
+}
+
+// Deliver creates a task for every user the mail is addressed to. Mail is
+// parsed before anything is saved, so invalid mail creates no tasks
+func (r *MailTaskReceiver) Deliver(message *mailin.Message) error {
+	content, err := parseMailContent(message.Data, r.maxAttachmentSize)
+	if err != nil {
+		return err
+	}
+
+	delivered := map[int64]bool{}
+	for _, address := range message.To {
+		user, err := r.findRecipient(address)
+		if err != nil {
+			return err
+		}
+		if delivered[user.Id] {
+			continue
+		}
+		if err := r.createMailTask(user.Id, content); err != nil {
+			return err
+		}
+		delivered[user.Id] = true
+	}
+	return nil
+}
+
+// findRecipient loads user the address belongs to
+func (r *MailTaskReceiver) findRecipient(address string) (*model.User, error) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 || !strings.EqualFold(address[i+1:], r.domain) {
+		return nil, errMailRelayDenied
+	}
+	token := strings.ToLower(address[:i])
+	if token == "" {
+		return nil, errMailMailboxUnavailable
+	}
+
+	user := &model.User{}
+	err := r.db.Where("mail_token = ?", token).First(user).Error
+	if err == gorm.RecordNotFound {
+		return nil, errMailMailboxUnavailable
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// createMailTask saves the task with its attachments as a single operation.
+// Content stored before a failure is removed
+func (r *MailTaskReceiver) createMailTask(userID int64, content *mailContent) error {
+	opDB, _, err := withOperation(r.db)
+	if err != nil {
+		return err
+	}
+
+	stored := []string{}
+	err = inTransaction(opDB, func(tx *gorm.DB) error {
+		if content.MessageID != "" {
+			count := 0
+			err := tx.Model(&model.Task{}).Where("user_id = ? and external_id = ?", userID, content.MessageID).Count(&count).Error
+			if err != nil || count > 0 {
+				return err
+			}
+		}
+
+		task := &model.Task{
+			Title:       content.Subject,
+			Description: content.Text,
+			ExternalID:  content.MessageID,
+		}
+		if err := createTask(tx, userID, task); err != nil {
+			return err
+		}
+		for _, a := range content.Attachments {
+			attachment, err := storeAttachmentContent(tx, r.store, task, a.Name, a.ContentType, bytes.NewReader(a.Content))
+			if err != nil {
+				return err
+			}
+			stored = append(stored, attachment.StorageKey)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, key := range stored {
+			r.store.Delete(key)
+		}
+	}
+	return err
+}
+
+// parseMailContent parses the message. Attachments larger than
+// maxAttachmentSize or too many attachments make the message rejected
+func parseMailContent(data []byte, maxAttachmentSize int64) (*mailContent, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, errMailMalformed
+	}
+
+	content := &mailContent{
+		MessageID: strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>"),
+		Subject:   strings.Join(strings.Fields(decodeMailHeader(msg.Header.Get("Subject"))), " "),
+	}
+	if content.Subject == "" {
+		content.Subject = mailNoSubject
+	}
+	if err := content.addPart(textproto.MIMEHeader(msg.Header), msg.Body, 0, maxAttachmentSize); err != nil {
+		return nil, err
+	}
+	content.Text = strings.TrimSpace(content.Text)
+	return content, nil
+}
+
+// addPart walks the part of the message. Parts with file name, attachments
+// and attached messages become attachments. Other parts except the first
+// plain text one, e.g. HTML alternative, are skipped
+func (m *mailContent) addPart(header textproto.MIMEHeader, body io.Reader, depth int, maxAttachmentSize int64) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMailPartDepth {
+			return nil
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return errMailMalformed
+			}
+			if err := m.addPart(part.Header, part, depth+1, maxAttachmentSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	body = decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	switch {
+	case name != "" || disposition == "attachment" || mediaType == "message/rfc822":
+		if name == "" {
+			name = forwardedMailName
+		}
+		name = decodeMailHeader(name)
+		if len(m.Attachments) >= maxAttachmentFiles {
+			return &mailin.Error{Code: 552, Message: fmt.Sprintf("5.3.4 at most %d attachments are allowed", maxAttachmentFiles)}
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(body, maxAttachmentSize+1))
+		if err != nil {
+			return errMailMalformed
+		}
+		if int64(len(content)) > maxAttachmentSize {
+			return &mailin.Error{Code: 552, Message: fmt.Sprintf("5.3.4 attachment %s is larger than %d bytes", name, maxAttachmentSize)}
+		}
+		m.Attachments = append(m.Attachments, mailAttachment{Name: name, ContentType: mediaType, Content: content})
+	case mediaType == "text/plain" && !m.hasText:
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			return errMailMalformed
+		}
+		m.Text = decodeMailText(content, params["charset"])
+		m.hasText = true
+	}
+	return nil
+}
+
+// decodeTransferEncoding decodes base64 and quoted-printable content. Other
+// encodings leave content as it is
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// decodeMailHeader decodes encoded words of the header. Header which can not
+// be decoded is kept as it is
+func decodeMailHeader(value string) string {
+	decoder := &mime.WordDecoder{}
+	decoded, err := decoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// decodeMailText converts the text into UTF-8 with unix line endings. Only
+// Latin-1 is converted, text in other charsets is kept as it is
+func decodeMailText(content []byte, charset string) string {
+	text := string(content)
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(content))
+		for i, b := range content {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	return strings.Replace(text, "\r\n", "\n", -1)
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/mailin"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/storage"
+)
+
+func TestMailWithAttachmentCreatesTask(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&model.User{}).Where("id = ?", testUserID).UpdateColumn("mail_token", "secrettoken").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	server := mailin.NewServer("todo.test", 0, nil, NewMailTaskReceiver(db, store, "todo.test", 1024), logger)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	message := strings.Join([]string{
+		"From: sender@example.org",
+		"To: SecretToken@Todo.Test",
+		"Subject: =?utf-8?q?Report_=E2=9C=93?=",
+		"Message-Id: <report-1@example.org>",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"See the attached report.",
+		"--b1",
+		`Content-Type: text/csv; name="report.csv"`,
+		`Content-Disposition: attachment; filename="report.csv"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		"YSxiCjEsMgo=",
+		"--b1--",
+		"",
+	}, "\r\n")
+	for i := 0; i < 2; i++ {
+		if err := smtp.SendMail(l.Addr().String(), nil, "sender@example.org", []string{"SecretToken@Todo.Test"}, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks := []model.Task{}
+	if err := db.Where("user_id = ?", testUserID).Find(&tasks).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("redelivered mail must create a single task, got %d", len(tasks))
+	}
+	task := tasks[0]
+	if task.Title != "Report ✓" || task.Description != "See the attached report." || task.ExternalID != "report-1@example.org" {
+		t.Fatalf("unexpected task: %q %q %q", task.Title, task.Description, task.ExternalID)
+	}
+
+	attachments := []model.Attachment{}
+	if err := db.Where("task_id = ?", task.Id).Find(&attachments).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 || attachments[0].Name != "report.csv" || attachments[0].ContentType != "text/csv" {
+		t.Fatalf("unexpected attachments: %+v", attachments)
+	}
+	blob, err := store.Open(attachments[0].StorageKey, attachments[0].Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	content, err := ioutil.ReadAll(blob)
+	if err != nil || string(content) != "a,b\n1,2\n" {
+		t.Fatalf("unexpected attachment content %q (%v)", content, err)
+	}
+}
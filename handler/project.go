@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// what to do with tasks of a deleted project
+const (
+	projectTasksMove   = "move"
+	projectTasksDelete = "delete"
+)
+
+var errProjectNotFound = errors.New("project not found")
+
+// projectRequest defines input of create and update project operations
+type projectRequest struct {
+	Name       *string `json:"name"`
+	Color      *string `json:"color"`
+	Position   *int    `json:"position"`
+	IsArchived *bool   `json:"is_archived"`
+}
+
+func (r projectRequest) apply(project *model.Project) {
+	if r.Name != nil {
+		project.Name = strings.TrimSpace(*r.Name)
+	}
+	if r.Color != nil {
+		project.Color = *r.Color
+	}
+	if r.Position != nil {
+		project.Position = *r.Position
+	}
+	if r.IsArchived != nil {
+		project.IsArchived = *r.IsArchived
+	}
+}
+
+// GetListProjectsHandler creates HTTP handler which lists current user's
+// projects. Archived projects are listed only if requested
+func GetListProjectsHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		query := db.Where("user_id = ?", currentUserID(c))
+		if archived, _ := strconv.ParseBool(c.Query("archived")); !archived {
+			query = query.Where("is_archived = ?", false)
+		}
+
+		projects := []model.Project{}
+		if err := query.Order("position, id").Find(&projects).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, projects)
+	}
+}
+
+// GetGetProjectHandler creates HTTP handler for Get Project operation
+func GetGetProjectHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		project, err := findProjectFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, project)
+	}
+}
+
+// GetCreateProjectHandler creates HTTP handler for Create Project operation.
+// New project is put to the end of the list unless position is provided
+func GetCreateProjectHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		req := projectRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		project := model.Project{UserID: currentUserID(c)}
+		if req.Position == nil {
+			position, err := nextProjectPosition(db, project.UserID)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+			project.Position = position
+		}
+		req.apply(&project)
+		if err := project.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		if err := db.Create(&project).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusCreated, project)
+	}
+}
+
+// GetUpdateProjectHandler creates HTTP handler for Update Project operation.
+// Only provided fields are changed
+func GetUpdateProjectHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		project, err := findProjectFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		req := projectRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		req.apply(project)
+		if err := project.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		if project.IsInbox && project.IsArchived {
+			return c.JSON(http.StatusBadRequest, NewApiError("inbox project can not be archived"))
+		}
+
+		if err := db.Save(project).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, project)
+	}
+}
+
+// GetDeleteProjectHandler creates HTTP handler for Delete Project operation.
+// Depending on 'tasks' parameter, tasks of the project are either moved to
+// the inbox project (default) or deleted
+func GetDeleteProjectHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		project, err := findProjectFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+		if project.IsInbox {
+			return c.JSON(http.StatusBadRequest, NewApiError("inbox project can not be deleted"))
+		}
+
+		mode := c.Query("tasks")
+		if mode == "" {
+			mode = projectTasksMove
+		}
+		if mode != projectTasksMove && mode != projectTasksDelete {
+			return c.JSON(http.StatusBadRequest, NewApiError("tasks must be either 'move' or 'delete'"))
+		}
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		// tasks go through the regular paths, so their changes are versioned
+		// and published like any other ones
+		err = inTransaction(opDB, func(tx *gorm.DB) error {
+			tasks := []model.Task{}
+			if err := tx.Where("user_id = ? and project_id = ?", project.UserID, project.Id).Order("id").Find(&tasks).Error; err != nil {
+				return err
+			}
+
+			if mode == projectTasksMove {
+				inbox, err := ensureInboxProject(tx, project.UserID)
+				if err != nil {
+					return err
+				}
+				for i := range tasks {
+					moved := tasks[i]
+					moved.ProjectID = inbox.Id
+					if err := replaceTask(tx, project.UserID, &tasks[i], &moved, model.TaskEventUpdated); err != nil {
+						return err
+					}
+				}
+			} else {
+				for _, task := range tasks {
+					if _, err := deleteTask(tx, project.UserID, task.Id); err != nil {
+						return err
+					}
+				}
+			}
+			return tx.Delete(project).Error
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetProjectTasksHandler creates HTTP handler which lists tasks of the project
+func GetProjectTasksHandler(db *gorm.DB, cursorSecret string) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		project, err := findProjectFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		filter, err := parseTaskFilter(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		filter.ProjectID = &project.Id
+
+		return listTasks(c, db, cursorSecret, filter)
+	}
+}
+
+// findProject loads user's project by id
+func findProject(db *gorm.DB, userID, id int64) (*model.Project, error) {
+	project := &model.Project{}
+	err := db.Where("user_id = ?", userID).First(project, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, errProjectNotFound
+	}
+	return project, err
+}
+
+// findProjectFromRequest loads current user's project by id from request path.
+// Returns echo HTTP error otherwise
+func findProjectFromRequest(c *echo.Context, db *gorm.DB) (*model.Project, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	project, err := findProject(db, currentUserID(c), id)
+	if err == errProjectNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, NewApiError(err.Error()).String())
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+
+	return project, nil
+}
+
+// ensureInboxProject returns user's inbox project, creating it if needed
+func ensureInboxProject(db *gorm.DB, userID int64) (*model.Project, error) {
+	inbox := &model.Project{}
+	err := db.Where("user_id = ? and is_inbox = ?", userID, true).First(inbox).Error
+	if err != gorm.RecordNotFound {
+		return inbox, err
+	}
+
+	inbox = &model.Project{UserID: userID, Name: model.InboxProjectName, IsInbox: true}
+	return inbox, db.Create(inbox).Error
+}
+
+// projectNames maps ids of user's projects to their names
+func projectNames(db *gorm.DB, userID int64) (map[int64]string, error) {
+	projects := []model.Project{}
+	if err := db.Where("user_id = ?", userID).Find(&projects).Error; err != nil {
+		return nil, err
+	}
+
+	names := map[int64]string{}
+	for _, project := range projects {
+		names[project.Id] = project.Name
+	}
+	return names, nil
+}
+
+// ensureProjectByName returns id of user's project with the name, creating
+// the project if needed. Name with underscores matches the name with spaces,
+// because that is how todo.txt keeps names. Empty name means no project
+func ensureProjectByName(db *gorm.DB, userID int64, name string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, nil
+	}
+
+	projects := []model.Project{}
+	if err := db.Where("user_id = ?", userID).Order("is_archived, id").Find(&projects).Error; err != nil {
+		return 0, err
+	}
+	for _, project := range projects {
+		if project.Name == name {
+			return project.Id, nil
+		}
+	}
+	for _, project := range projects {
+		if todoTxtName(project.Name) == name {
+			return project.Id, nil
+		}
+	}
+
+	position, err := nextProjectPosition(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	project := model.Project{UserID: userID, Name: name, Position: position}
+	if err := db.Create(&project).Error; err != nil {
+		return 0, err
+	}
+	return project.Id, nil
+}
+
+func nextProjectPosition(db *gorm.DB, userID int64) (int, error) {
+	var position int
+	row := db.Model(&model.Project{}).Where("user_id = ?", userID).Select("coalesce(max(position), -1) + 1").Row()
+	return position, row.Scan(&position)
+}
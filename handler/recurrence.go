@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+const defaultOccurrencesRange = 90 * 24 * time.Hour
+const maxOccurrences = 500
+
+var errRecurrenceDueAt = errors.New("recurring task must have a due date")
+
+// recurrenceError defines invalid recurrence rule of a task
+type recurrenceError struct {
+	err error
+}
+
+func (e recurrenceError) Error() string {
+	return "invalid recurrence rule: " + e.err.Error()
+}
+
+// occurrence defines a single instance of a recurring task
+type occurrence struct {
+	StartAt *time.Time
+	DueAt   time.Time
+}
+
+// GetTaskOccurrencesHandler creates HTTP handler which previews occurrences of
+// the recurring task within [from, to] range. The range starts now and lasts
+// 90 days by default
+func GetTaskOccurrencesHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		from := time.Now()
+		if value := c.Query("from"); value != "" {
+			if from, err = time.Parse(time.RFC3339, value); err != nil {
+				return c.JSON(http.StatusBadRequest, NewApiError("from must be in RFC3339 format"))
+			}
+		}
+		to := from.Add(defaultOccurrencesRange)
+		if value := c.Query("to"); value != "" {
+			if to, err = time.Parse(time.RFC3339, value); err != nil {
+				return c.JSON(http.StatusBadRequest, NewApiError("to must be in RFC3339 format"))
+			}
+		}
+		if to.Before(from) {
+			return c.JSON(http.StatusBadRequest, NewApiError("to must not be before from"))
+		}
+
+		task, err := findTask(db, currentUserID(c), id)
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
+
+		occurrences, err := taskOccurrences(db, task, from, to)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		return c.JSON(http.StatusOK, occurrences)
+	}
+}
+
+// taskOccurrences returns occurrences of the task within [from, to]. Task
+// without recurrence rule occurs only once
+func taskOccurrences(db *gorm.DB, task *model.Task, from, to time.Time) ([]occurrence, error) {
+	occurrences := []occurrence{}
+	if task.DueAt == nil {
+		return occurrences, nil
+	}
+	if task.RRule == "" {
+		if !task.DueAt.Before(from) && !task.DueAt.After(to) {
+			occurrences = append(occurrences, occurrence{StartAt: task.StartAt, DueAt: *task.DueAt})
+		}
+		return occurrences, nil
+	}
+
+	rule, err := lib.ParseRRule(task.RRule)
+	if err != nil {
+		return nil, err
+	}
+	location, err := recurrenceLocation(db, task)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dueAt := range rule.Between(seriesStart(task).In(location), from, to, maxOccurrences) {
+		// occurrences before the current one are already completed
+		if dueAt.Before(*task.DueAt) {
+			continue
+		}
+		shift := dueAt.Sub(*task.DueAt)
+		occurrences = append(occurrences, occurrence{StartAt: shiftTime(task.StartAt, shift), DueAt: dueAt.UTC()})
+	}
+	return occurrences, nil
+}
+
+// checkTaskRecurrence validates recurrence rule of the task and brings it into
+// canonical form. Series start defaults to the due date of the task
+func checkTaskRecurrence(task *model.Task) error {
+	if task.RRule == "" {
+		task.SeriesStart = nil
+		return nil
+	}
+
+	rule, err := lib.ParseRRule(task.RRule)
+	if err != nil {
+		return recurrenceError{err}
+	}
+	if task.DueAt == nil {
+		return errRecurrenceDueAt
+	}
+
+	task.RRule = rule.String()
+	if task.SeriesStart == nil || task.SeriesStart.After(*task.DueAt) {
+		start := *task.DueAt
+		task.SeriesStart = &start
+	}
+	return nil
+}
+
+// spawnNextOccurrence creates the next occurrence of the recurring task being
+// completed. Tags, subtasks and reminders relative to the due date are copied
+// to the new occurrence, which takes the recurrence rule over, while the
+// completed task becomes a regular one
+func spawnNextOccurrence(db *gorm.DB, actorID int64, task *model.Task) error {
+	rule, err := lib.ParseRRule(task.RRule)
+	if err != nil {
+		return err
+	}
+	location, err := recurrenceLocation(db, task)
+	if err != nil {
+		return err
+	}
+
+	series := seriesStart(task)
+	task.RRule = ""
+	task.SeriesStart = nil
+
+	next, ok := rule.Next(series.In(location), *task.DueAt)
+	if !ok {
+		return nil
+	}
+
+	shift := next.Sub(*task.DueAt)
+	spawned := copyTask(task, shift)
+	spawned.RRule = rule.String()
+	spawned.SeriesStart = &series
+	// identity of the series in other systems passes along with the rule
+	spawned.ExternalID, task.ExternalID = task.ExternalID, ""
+	spawned.ResourceName, task.ResourceName = task.ResourceName, ""
+	if err := db.Create(spawned).Error; err != nil {
+		return err
+	}
+	if err := recordTaskEvent(db, actorID, model.TaskEventCreated, &model.Task{}, spawned); err != nil {
+		return err
+	}
+	if err := copyTaskTags(db, task.Id, spawned.Id); err != nil {
+		return err
+	}
+	if err := copyTaskReminders(db, task, spawned); err != nil {
+		return err
+	}
+	return copySubtasks(db, actorID, task, spawned, shift)
+}
+
+// copySubtasks copies all subtasks of the source task under the target one.
+// Copies are open and their dates are shifted the same way as dates of the
+// target task
+func copySubtasks(db *gorm.DB, actorID int64, source, target *model.Task, shift time.Duration) error {
+	level := map[int64]int64{source.Id: target.Id}
+	for len(level) > 0 {
+		parentIDs := make([]int64, 0, len(level))
+		for id := range level {
+			parentIDs = append(parentIDs, id)
+		}
+
+		children := []model.Task{}
+		err := db.Where("user_id = ? and is_deleted = ? and parent_id in (?)", source.UserID, false, parentIDs).
+			Order("id").
+			Find(&children).Error
+		if err != nil {
+			return err
+		}
+
+		next := map[int64]int64{}
+		for i := range children {
+			child := copyTask(&children[i], shift)
+			child.ParentID = level[children[i].ParentID]
+			if err := db.Create(child).Error; err != nil {
+				return err
+			}
+			if err := recordTaskEvent(db, actorID, model.TaskEventCreated, &model.Task{}, child); err != nil {
+				return err
+			}
+			if err := copyTaskTags(db, children[i].Id, child.Id); err != nil {
+				return err
+			}
+			next[children[i].Id] = child.Id
+		}
+		level = next
+	}
+
+	return nil
+}
+
+// copyTask returns open copy of the task with dates shifted. Recurrence rule
+// is not copied
+func copyTask(task *model.Task, shift time.Duration) *model.Task {
+	copied := *task
+	copied.Id = 0
+	copied.Tags = nil
+	copied.IsBlocked = false
+	copied.IsCompleted = false
+	copied.CompletedAt = nil
+	copied.CreatedAt = nil
+	copied.UpdatedAt = nil
+	copied.Version = 0
+	copied.RRule = ""
+	copied.SeriesStart = nil
+	copied.ExternalID = ""
+	copied.ResourceName = ""
+	copied.StartAt = shiftTime(task.StartAt, shift)
+	copied.DueAt = shiftTime(task.DueAt, shift)
+	return &copied
+}
+
+func copyTaskTags(db *gorm.DB, sourceID, targetID int64) error {
+	return db.Exec("insert into task_tags (task_id, tag_id) select ?, tag_id from task_tags where task_id = ?",
+		targetID, sourceID).Error
+}
+
+// recurrenceLocation returns location the recurrence rule of the task is
+// expanded in. All-day tasks do not depend on timezone, so UTC is used for them
+func recurrenceLocation(db *gorm.DB, task *model.Task) (*time.Location, error) {
+	if task.IsAllDay {
+		return time.UTC, nil
+	}
+	return userLocation(db, task.UserID)
+}
+
+func seriesStart(task *model.Task) time.Time {
+	if task.SeriesStart != nil {
+		return *task.SeriesStart
+	}
+	return *task.DueAt
+}
+
+func shiftTime(t *time.Time, shift time.Duration) *time.Time {
+	if t == nil {
+		return nil
+	}
+	shifted := t.Add(shift).UTC()
+	return &shifted
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+var errReminderNotFound = errors.New("reminder not found")
+
+// reminderRequest defines input of create reminder operation
+type reminderRequest struct {
+	Channel   string     `json:"channel"`
+	RemindAt  *time.Time `json:"remind_at"`
+	BeforeDue int        `json:"before_due"`
+}
+
+// GetListRemindersHandler creates HTTP handler which lists reminders of the task
+func GetListRemindersHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		reminders := []model.Reminder{}
+		if err := db.Where("task_id = ?", task.Id).Order("id").Find(&reminders).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, reminders)
+	}
+}
+
+// GetCreateReminderHandler creates HTTP handler which adds a reminder to the
+// task. Reminder can be delivered only through one of configured channels
+func GetCreateReminderHandler(db *gorm.DB, channels []string) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, err := findTaskFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		req := reminderRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		reminder := model.Reminder{
+			UserID:    task.UserID,
+			TaskID:    task.Id,
+			Channel:   req.Channel,
+			RemindAt:  req.RemindAt,
+			BeforeDue: req.BeforeDue,
+		}
+		if err := reminder.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		if !containsString(channels, reminder.Channel) {
+			return c.JSON(http.StatusBadRequest, NewApiError("channel must be one of: "+strings.Join(channels, ", ")))
+		}
+		if reminder.RemindAt == nil && task.DueAt == nil {
+			return c.JSON(http.StatusBadRequest, NewApiError("task has no due date, remind_at must be provided"))
+		}
+
+		dueAt, err := taskDueTime(db, task)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		reminder.Schedule(dueAt)
+		if err := db.Create(&reminder).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusCreated, reminder)
+	}
+}
+
+// GetDeleteReminderHandler creates HTTP handler which removes the reminder
+func GetDeleteReminderHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		reminder, err := findReminderFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		if err := db.Delete(reminder).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetReminderDeliveriesHandler creates HTTP handler which lists delivery
+// attempts of the reminder
+func GetReminderDeliveriesHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		reminder, err := findReminderFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		deliveries := []model.ReminderDelivery{}
+		if err := db.Where("reminder_id = ?", reminder.Id).Order("id").Find(&deliveries).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// rescheduleTaskReminders moves pending reminders relative to the due date
+// of the task after the date is changed
+func rescheduleTaskReminders(db *gorm.DB, task *model.Task) error {
+	reminders := []model.Reminder{}
+	err := db.Where("task_id = ? and remind_at is null and status in (?)",
+		task.Id, []string{model.ReminderPending, model.ReminderCanceled}).
+		Find(&reminders).Error
+	if err != nil {
+		return err
+	}
+
+	if len(reminders) == 0 {
+		return nil
+	}
+
+	dueAt, err := taskDueTime(db, task)
+	if err != nil {
+		return err
+	}
+	for i := range reminders {
+		reminders[i].Schedule(dueAt)
+		if err := db.Save(&reminders[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTaskReminders copies reminders relative to the due date from one
+// occurrence of a recurring task to the next one
+func copyTaskReminders(db *gorm.DB, source, target *model.Task) error {
+	reminders := []model.Reminder{}
+	if err := db.Where("task_id = ? and remind_at is null", source.Id).Find(&reminders).Error; err != nil {
+		return err
+	}
+	if len(reminders) == 0 {
+		return nil
+	}
+
+	dueAt, err := taskDueTime(db, target)
+	if err != nil {
+		return err
+	}
+	for _, reminder := range reminders {
+		copied := model.Reminder{
+			UserID:    target.UserID,
+			TaskID:    target.Id,
+			Channel:   reminder.Channel,
+			BeforeDue: reminder.BeforeDue,
+		}
+		copied.Schedule(dueAt)
+		if err := db.Create(&copied).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taskDueTime returns the moment the task is due. Timezone of the user is
+// loaded only for all-day tasks, which are due at midnight in it
+func taskDueTime(db *gorm.DB, task *model.Task) (*time.Time, error) {
+	if task.DueAt == nil || !task.IsAllDay {
+		return task.DueAt, nil
+	}
+	location, err := userLocation(db, task.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return task.DueTime(location), nil
+}
+
+// findReminderFromRequest loads reminder of current user's task. Ids of both
+// are provided in the path of the request
+func findReminderFromRequest(c *echo.Context, db *gorm.DB) (*model.Reminder, error) {
+	task, err := findTaskFromRequest(c, db)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(c.Param("reminder_id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	reminder := &model.Reminder{}
+	err = db.Where("task_id = ?", task.Id).First(reminder, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, NewApiError(errReminderNotFound.Error()).String())
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+	return reminder, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+func TestReminderOfAllDayTaskUsesUserTimezone(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	if err := db.Model(&model.User{}).Where("id = ?", testUserID).UpdateColumn("timezone", "America/Los_Angeles").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	due := time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)
+	task := &model.Task{Title: "Pay rent", DueAt: &due, IsAllDay: true}
+	if err := createTask(db, testUserID, task); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestServer()
+	e.Post("/task/:id/reminders", GetCreateReminderHandler(db, []string{model.ReminderChannelLog}))
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/task/%d/reminders", task.Id), strings.NewReader(`{"channel":"log","before_due":60}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	reminder := model.Reminder{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &reminder); err != nil {
+		t.Fatal(err)
+	}
+	// an hour before midnight of March 20 in Los Angeles, UTC-7 in summer time
+	expected := time.Date(2026, 3, 20, 6, 0, 0, 0, time.UTC)
+	if reminder.NotifyAt == nil || !reminder.NotifyAt.Equal(expected) {
+		t.Fatalf("expected reminder at %s, got %v", expected, reminder.NotifyAt)
+	}
+
+	// winter time, UTC-8
+	moved := *task
+	due = time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	moved.DueAt = &due
+	if err := replaceTask(db, testUserID, task, &moved, model.TaskEventUpdated); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&reminder, reminder.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	expected = time.Date(2026, 1, 10, 7, 0, 0, 0, time.UTC)
+	if reminder.NotifyAt == nil || !reminder.NotifyAt.Equal(expected) {
+		t.Fatalf("expected rescheduled reminder at %s, got %v", expected, reminder.NotifyAt)
+	}
+}
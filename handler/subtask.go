@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+var errParentNotFound = errors.New("parent task not found")
+var errTaskCycle = errors.New("task can not be moved under itself or its subtask")
+
+// taskNode defines a task with all its subtasks
+type taskNode struct {
+	model.Task
+	Subtasks []*taskNode `json:"Subtasks"`
+}
+
+// GetTaskSubtreeHandler creates HTTP handler which responds with the task and
+// all its subtasks of any depth. Deleted subtasks are omitted
+func GetTaskSubtreeHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		task, err := findTask(db, currentUserID(c), id)
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
+
+		root := &taskNode{Task: *task, Subtasks: []*taskNode{}}
+		level := map[int64]*taskNode{root.Id: root}
+		// subtasks are loaded level by level, so depth is not limited and
+		// no recursive queries are required from the database
+		for len(level) > 0 {
+			parentIDs := make([]int64, 0, len(level))
+			for id := range level {
+				parentIDs = append(parentIDs, id)
+			}
+
+			children := []model.Task{}
+			err := db.Where("user_id = ? and is_deleted = ? and parent_id in (?)", task.UserID, false, parentIDs).
+				Order("id").
+				Find(&children).Error
+			if err == nil {
+				err = loadTaskDetails(db, children)
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+
+			next := map[int64]*taskNode{}
+			for _, child := range children {
+				node := &taskNode{Task: child, Subtasks: []*taskNode{}}
+				level[child.ParentID].Subtasks = append(level[child.ParentID].Subtasks, node)
+				next[child.Id] = node
+			}
+			level = next
+		}
+
+		return c.JSON(http.StatusOK, root)
+	}
+}
+
+// checkTaskParent ensures that parent of the task belongs to the same user and
+// that the task is not moved under itself or any of its subtasks
+func checkTaskParent(db *gorm.DB, task *model.Task) error {
+	visited := map[int64]bool{task.Id: true}
+	for parentID := task.ParentID; parentID != 0; {
+		if visited[parentID] {
+			return errTaskCycle
+		}
+		visited[parentID] = true
+
+		parent, err := findTask(db, task.UserID, parentID)
+		if err == errTaskNotFound {
+			return errParentNotFound
+		} else if err != nil {
+			return err
+		}
+		parentID = parent.ParentID
+	}
+
+	return nil
+}
+
+// rollUpCompletion completes the parent task configured to be auto-completed
+// when all its subtasks are completed. Completion goes up to the root task
+func rollUpCompletion(db *gorm.DB, userID, parentID int64) error {
+	for parentID != 0 {
+		parent, err := findTask(db, userID, parentID)
+		if err != nil {
+			return err
+		}
+		if !parent.AutoComplete || parent.IsCompleted {
+			return nil
+		}
+		if blocked, err := isTaskBlocked(db, parent); err != nil || blocked {
+			return err
+		}
+
+		open := 0
+		err = db.Model(&model.Task{}).
+			Where("user_id = ? and parent_id = ? and is_deleted = ? and is_completed = ?", userID, parent.Id, false, false).
+			Count(&open).Error
+		if err != nil || open > 0 {
+			return err
+		}
+
+		if err := markTaskCompleted(db, userID, parent); err != nil {
+			return err
+		}
+		parentID = parent.ParentID
+	}
+
+	return nil
+}
@@ -0,0 +1,466 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// policies of resolving conflicting changes of the same field made on the
+// server and on a client
+const (
+	SyncPolicyReject         = "reject"
+	SyncPolicyLastWriterWins = "lww"
+)
+
+// syncTokenMargin covers events which were written, but not yet committed,
+// when sync token was issued
+const syncTokenMargin = time.Minute
+
+var errInvalidSyncToken = errors.New("invalid sync token")
+var errSyncTokenExpired = errors.New("sync token has expired, sync from scratch")
+var errBaseVersionNotFound = errors.New("base version of the task not found")
+
+// syncToken defines position of a client in the outbox. All events up to the
+// id are known to the client. Issue time tells whether later events could be
+// purged from the outbox already
+type syncToken struct {
+	ID       int64 `json:"id"`
+	IssuedAt int64 `json:"at"`
+}
+
+func (t syncToken) String() string {
+	content, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func parseSyncToken(value string) (syncToken, error) {
+	token := syncToken{}
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return token, errInvalidSyncToken
+	}
+	if err := json.Unmarshal(content, &token); err != nil || token.ID < 0 {
+		return token, errInvalidSyncToken
+	}
+	return token, nil
+}
+
+// syncTombstone identifies a task which was deleted
+type syncTombstone struct {
+	ID      int64 `json:"id"`
+	Version int64 `json:"version"`
+}
+
+// syncPullResponse defines output of sync pull operation
+type syncPullResponse struct {
+	Token   string          `json:"token"`
+	Tasks   []model.Task    `json:"tasks"`
+	Deleted []syncTombstone `json:"deleted"`
+	HasMore bool            `json:"has_more"`
+}
+
+// syncChange defines a change of a task made by a client. Task without id is
+// created. Base version is the version of the task the change was made to.
+// Modification time is used to resolve conflicts by last writer wins policy
+type syncChange struct {
+	ID          int64           `json:"id"`
+	ClientID    string          `json:"client_id"`
+	BaseVersion int64           `json:"base_version"`
+	ModifiedAt  *time.Time      `json:"modified_at"`
+	Deleted     bool            `json:"deleted"`
+	Task        json.RawMessage `json:"task"`
+}
+
+// syncPushRequest defines input of sync push operation
+type syncPushRequest struct {
+	Changes []syncChange `json:"changes"`
+}
+
+// syncConflict describes fields changed both on the server and by the client.
+// Client values of the fields were not applied
+type syncConflict struct {
+	Fields []string        `json:"fields"`
+	Server *model.Task     `json:"server"`
+	Client json.RawMessage `json:"client"`
+}
+
+// syncResult defines outcome of a single change of sync push request
+type syncResult struct {
+	Index    int           `json:"index"`
+	ClientID string        `json:"client_id,omitempty"`
+	Status   int           `json:"status"`
+	Task     *model.Task   `json:"task,omitempty"`
+	Conflict *syncConflict `json:"conflict,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// syncPushResponse defines output of sync push operation
+type syncPushResponse struct {
+	OperationID string       `json:"operation_id"`
+	Results     []syncResult `json:"results"`
+}
+
+// IsSyncPolicy tells whether the policy of resolving sync conflicts is known
+func IsSyncPolicy(policy string) bool {
+	return policy == "" || policy == SyncPolicyReject || policy == SyncPolicyLastWriterWins
+}
+
+// GetSyncPullHandler creates HTTP handler which returns current user's tasks
+// changed since the sync token, and tombstones of deleted ones. Without the
+// token all existing tasks are returned. Changes are read from the outbox,
+// so the token expires once events after it may have been purged
+func GetSyncPullHandler(db *gorm.DB, retention time.Duration) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		userID := currentUserID(c)
+		resp := syncPullResponse{Tasks: []model.Task{}, Deleted: []syncTombstone{}}
+		now := time.Now()
+
+		since := c.Query("since")
+		if since == "" {
+			last := model.OutboxEvent{}
+			err := db.Order("id desc").First(&last).Error
+			if err != nil && err != gorm.RecordNotFound {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+			if err := db.Where("user_id = ? and is_deleted = ?", userID, false).Order("id").Find(&resp.Tasks).Error; err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+			if err := loadTaskDetails(db, resp.Tasks); err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+			resp.Token = syncToken{ID: last.Id, IssuedAt: now.Unix()}.String()
+			return c.JSON(http.StatusOK, resp)
+		}
+
+		token, err := parseSyncToken(since)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		if now.Sub(time.Unix(token.IssuedAt, 0)) > retention-syncTokenMargin {
+			return c.JSON(http.StatusGone, NewApiError(errSyncTokenExpired.Error()))
+		}
+		limit, _, err := parsePagination(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		// every changed task is returned once, ordered by its last change, so
+		// the page ends at the last change of its last task
+		rows, err := db.Table(model.OutboxEvent{}.TableName()).
+			Select("task_id, max(id) as last_id").
+			Where("user_id = ? and id > ? and task_id > 0", userID, token.ID).
+			Group("task_id").
+			Order("last_id").
+			Limit(limit + 1).
+			Rows()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		ids := []int64{}
+		next := token
+		for rows.Next() {
+			var taskID, lastID int64
+			if err := rows.Scan(&taskID, &lastID); err != nil {
+				rows.Close()
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+			if len(ids) == limit {
+				resp.HasMore = true
+				break
+			}
+			ids = append(ids, taskID)
+			next.ID = lastID
+		}
+		rows.Close()
+		// events after the page were written after the previous token was
+		// issued, so it defines expiration of the next one
+		if !resp.HasMore {
+			next.IssuedAt = now.Unix()
+		}
+		resp.Token = next.String()
+
+		if len(ids) == 0 {
+			return c.JSON(http.StatusOK, resp)
+		}
+
+		tasks := []model.Task{}
+		if err := db.Where("user_id = ? and id in (?)", userID, ids).Find(&tasks).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		found := map[int64]bool{}
+		for _, task := range tasks {
+			found[task.Id] = true
+			if task.IsDeleted {
+				resp.Deleted = append(resp.Deleted, syncTombstone{ID: task.Id, Version: task.Version})
+			} else {
+				resp.Tasks = append(resp.Tasks, task)
+			}
+		}
+		// tasks purged from trash leave only their ids
+		for _, id := range ids {
+			if !found[id] {
+				resp.Deleted = append(resp.Deleted, syncTombstone{ID: id})
+			}
+		}
+		if err := loadTaskDetails(db, resp.Tasks); err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// GetSyncPushHandler creates HTTP handler which applies changes made by a
+// client offline. Every change is applied independently. Change made to an
+// outdated version of the task is merged with changes made on the server
+// since then. Fields changed both ways are resolved by the policy: either the
+// client value is rejected, or the later change wins
+func GetSyncPushHandler(db *gorm.DB, policy string, maxChanges int) echo.HandlerFunc {
+	if policy == "" {
+		policy = SyncPolicyReject
+	}
+	if maxChanges <= 0 {
+		maxChanges = DefaultBulkMaxOperations
+	}
+
+	return func(c *echo.Context) error {
+		req := syncPushRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if len(req.Changes) == 0 {
+			return c.JSON(http.StatusBadRequest, NewApiError("no changes provided"))
+		}
+		if len(req.Changes) > maxChanges {
+			return c.JSON(http.StatusRequestEntityTooLarge,
+				NewApiError(fmt.Sprintf("too many changes, at most %d are allowed", maxChanges)),
+			)
+		}
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		userID := currentUserID(c)
+		now := time.Now()
+		resp := syncPushResponse{OperationID: opID, Results: make([]syncResult, len(req.Changes))}
+		status := http.StatusOK
+		for i, change := range req.Changes {
+			if change.ModifiedAt == nil {
+				change.ModifiedAt = &now
+			}
+			result := applySyncChange(opDB, userID, policy, change)
+			result.Index = i
+			result.ClientID = change.ClientID
+			if result.Status != http.StatusOK && result.Status != http.StatusCreated {
+				status = http.StatusMultiStatus
+			}
+			resp.Results[i] = result
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return c.JSON(status, resp)
+	}
+}
+
+// applySyncChange applies a single change of the client in a transaction
+func applySyncChange(db *gorm.DB, userID int64, policy string, change syncChange) syncResult {
+	if change.ID == 0 {
+		task := &model.Task{}
+		if err := json.Unmarshal(change.Task, task); err != nil {
+			return syncResult{Status: http.StatusBadRequest, Error: errInvalidTask.Error()}
+		}
+		if err := createTask(db, userID, task); err != nil {
+			return syncResult{Status: taskErrorStatus(err), Error: err.Error()}
+		}
+		return syncResult{Status: http.StatusCreated, Task: task}
+	}
+
+	result := syncResult{Status: http.StatusOK}
+	err := inTransaction(db, func(tx *gorm.DB) error {
+		existing, err := findTask(tx, userID, change.ID)
+		if err != nil {
+			return err
+		}
+
+		base := existing
+		if change.BaseVersion > existing.Version {
+			return errBaseVersionNotFound
+		} else if change.BaseVersion != existing.Version {
+			if base, err = findTaskVersion(tx, existing.Id, change.BaseVersion); err != nil {
+				return err
+			}
+		}
+		serverChanges, err := serverChangeTimes(tx, base, existing)
+		if err != nil {
+			return err
+		}
+
+		if change.Deleted {
+			return applySyncDelete(tx, userID, policy, change, existing, serverChanges, &result)
+		}
+		return applySyncUpdate(tx, userID, policy, change, base, existing, serverChanges, &result)
+	})
+	if err != nil {
+		status := taskErrorStatus(err)
+		if err == errBaseVersionNotFound {
+			status = http.StatusConflict
+		}
+		return syncResult{Status: status, Error: err.Error()}
+	}
+	return result
+}
+
+// applySyncUpdate merges fields changed by the client into the existing task.
+// Fields also changed on the server since the base version are resolved by
+// the policy and reported as conflict, if client values were not applied
+func applySyncUpdate(db *gorm.DB, userID int64, policy string, change syncChange, base, existing *model.Task,
+	serverChanges map[string]time.Time, result *syncResult) error {
+
+	client, err := patchTask(base, change.Task)
+	if err != nil {
+		return err
+	}
+	values := map[string]json.RawMessage{}
+	content, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, &values); err != nil {
+		return err
+	}
+
+	// fields which already have client values on the server are skipped
+	differs := map[string]bool{}
+	for _, diff := range model.DiffTasks(existing, client) {
+		differs[diff.Field] = true
+	}
+
+	patch := map[string]json.RawMessage{}
+	rejected := []string{}
+	for _, clientChange := range model.DiffTasks(base, client) {
+		field := clientChange.Field
+		if !differs[field] {
+			continue
+		}
+		if changedAt, conflict := serverChanges[field]; conflict &&
+			(policy == SyncPolicyReject || !change.ModifiedAt.After(changedAt)) {
+			rejected = append(rejected, field)
+			continue
+		}
+		patch[field] = values[field]
+	}
+
+	if len(rejected) > 0 {
+		result.Conflict = &syncConflict{Fields: rejected, Server: existing, Client: change.Task}
+		if len(patch) == 0 {
+			result.Status = http.StatusConflict
+			return nil
+		}
+	}
+	if len(patch) == 0 {
+		result.Task = existing
+		return nil
+	}
+
+	merged, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	patched, err := patchTask(existing, merged)
+	if err != nil {
+		return err
+	}
+	task, err := saveTaskChanges(db, userID, existing, patched, false)
+	if err != nil {
+		return err
+	}
+	result.Task = task
+	return nil
+}
+
+// applySyncDelete deletes the task, unless it was changed on the server since
+// the base version and the policy keeps the server changes
+func applySyncDelete(db *gorm.DB, userID int64, policy string, change syncChange, existing *model.Task,
+	serverChanges map[string]time.Time, result *syncResult) error {
+
+	fields := []string{}
+	for field, changedAt := range serverChanges {
+		if policy == SyncPolicyReject || !change.ModifiedAt.After(changedAt) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) > 0 {
+		result.Status = http.StatusConflict
+		result.Conflict = &syncConflict{Fields: fields, Server: existing, Client: change.Task}
+		return nil
+	}
+
+	task, err := deleteTask(db, userID, existing.Id)
+	if err != nil {
+		return err
+	}
+	result.Task = task
+	return nil
+}
+
+// findTaskVersion restores the task as it was at the version from snapshots
+// of its events. Save which changes nothing increases version without an
+// event, so the latest snapshot not newer than the version is taken
+func findTaskVersion(db *gorm.DB, taskID, version int64) (*model.Task, error) {
+	event := model.TaskEvent{}
+	err := db.Where("task_id = ? and version <= ?", taskID, version).Order("version desc, id desc").First(&event).Error
+	if err == gorm.RecordNotFound || (err == nil && event.Snapshot == "") {
+		return nil, errBaseVersionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	task := &model.Task{}
+	if err := json.Unmarshal([]byte(event.Snapshot), task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// serverChangeTimes returns fields which differ between base and existing
+// state of the task with time of the latest change of every field
+func serverChangeTimes(db *gorm.DB, base, existing *model.Task) (map[string]time.Time, error) {
+	times := map[string]time.Time{}
+	if base.Version == existing.Version {
+		return times, nil
+	}
+
+	changed := map[string]bool{}
+	for _, change := range model.DiffTasks(base, existing) {
+		changed[change.Field] = true
+	}
+
+	events := []model.TaskEvent{}
+	if err := db.Where("task_id = ? and version > ?", existing.Id, base.Version).Order("id").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		for _, change := range event.Changes {
+			if changed[change.Field] && event.CreatedAt != nil {
+				times[change.Field] = *event.CreatedAt
+			}
+		}
+	}
+	// field could be changed by a save without event, e.g. on migration
+	for field := range changed {
+		if _, ok := times[field]; !ok {
+			times[field] = *existing.UpdatedAt
+		}
+	}
+	return times, nil
+}
@@ -0,0 +1,527 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// tagRequest defines input of create and update tag operations
+type tagRequest struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// taskTagsField is a name of changes of task tags in task events. Changes
+// keep sorted ids of tags
+const taskTagsField = "Tags"
+
+// mergeTagsRequest defines input of merge tags operation
+type mergeTagsRequest struct {
+	Into int64 `json:"into"`
+}
+
+// GetListTagsHandler creates HTTP handler which lists current user's tags
+func GetListTagsHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		tags := []model.Tag{}
+		if err := db.Where("user_id = ?", currentUserID(c)).Order("name").Find(&tags).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, tags)
+	}
+}
+
+// GetCreateTagHandler creates HTTP handler for Create Tag operation
+func GetCreateTagHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		req := tagRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		tag := model.Tag{UserID: currentUserID(c), Name: strings.TrimSpace(req.Name), Color: req.Color}
+		if err := validateTagName(db, tag); err != nil {
+			return err
+		}
+
+		if err := db.Create(&tag).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusCreated, tag)
+	}
+}
+
+// GetUpdateTagHandler creates HTTP handler which renames the tag or changes
+// its color
+func GetUpdateTagHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		tag, err := findOwnTag(c, db, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		req := tagRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if req.Name != "" {
+			tag.Name = strings.TrimSpace(req.Name)
+		}
+		if req.Color != "" {
+			tag.Color = req.Color
+		}
+		if err := validateTagName(db, *tag); err != nil {
+			return err
+		}
+
+		if err := db.Save(tag).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, tag)
+	}
+}
+
+// GetDeleteTagHandler creates HTTP handler for Delete Tag operation. Tag is
+// removed from all tasks as a single operation
+func GetDeleteTagHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		tag, err := findOwnTag(c, db, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		err = inTransaction(opDB, func(tx *gorm.DB) error {
+			err := retagTasks(tx, currentUserID(c), tag.Id, func(tagIDs []int64) []int64 {
+				return withoutTagID(tagIDs, tag.Id)
+			})
+			if err != nil {
+				return err
+			}
+			return tx.Delete(tag).Error
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetMergeTagsHandler creates HTTP handler which moves all tasks of the tag
+// into another tag and deletes the former one
+func GetMergeTagsHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		source, err := findOwnTag(c, db, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		req := mergeTagsRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if req.Into == source.Id {
+			return c.JSON(http.StatusBadRequest, NewApiError("tag can not be merged into itself"))
+		}
+		target, err := findOwnTag(c, db, strconv.FormatInt(req.Into, 10))
+		if err != nil {
+			return err
+		}
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		err = inTransaction(opDB, func(tx *gorm.DB) error {
+			err := retagTasks(tx, currentUserID(c), source.Id, func(tagIDs []int64) []int64 {
+				return append(withoutTagID(tagIDs, source.Id), target.Id)
+			})
+			if err != nil {
+				return err
+			}
+			return tx.Delete(source).Error
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return c.JSON(http.StatusOK, target)
+	}
+}
+
+// GetAddTaskTagHandler creates HTTP handler which puts the tag on the task
+func GetAddTaskTagHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, tag, err := findTaskAndTag(c, db)
+		if err != nil {
+			return err
+		}
+
+		return changeTaskTags(c, db, task, func(tagIDs []int64) []int64 {
+			return append(tagIDs, tag.Id)
+		})
+	}
+}
+
+// GetRemoveTaskTagHandler creates HTTP handler which removes the tag from the
+// task
+func GetRemoveTaskTagHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		task, tag, err := findTaskAndTag(c, db)
+		if err != nil {
+			return err
+		}
+
+		return changeTaskTags(c, db, task, func(tagIDs []int64) []int64 {
+			kept := []int64{}
+			for _, id := range tagIDs {
+				if id != tag.Id {
+					kept = append(kept, id)
+				}
+			}
+			return kept
+		})
+	}
+}
+
+// changeTaskTags replaces tags of the task by the result of change as an
+// operation and responds with the changed task
+func changeTaskTags(c *echo.Context, db *gorm.DB, task *model.Task, change func(tagIDs []int64) []int64) error {
+	opDB, opID, err := withOperation(db)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+	}
+	err = inTransaction(opDB, func(tx *gorm.DB) error {
+		tagIDs, err := taskTagIDs(tx, task.Id)
+		if err != nil {
+			return err
+		}
+		return setTaskTags(tx, currentUserID(c), task, change(tagIDs), model.TaskEventUpdated)
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+	}
+	if task, err = findTask(db, currentUserID(c), task.Id); err != nil {
+		return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+	}
+
+	c.Response().Header().Set(OperationIDHeader, opID)
+	return respondWithTask(c, db, task)
+}
+
+// retagTasks changes tags of every user's task which has the tag, e.g. when
+// the tag is deleted. Every task records the change on its own
+func retagTasks(db *gorm.DB, userID, tagID int64, change func(tagIDs []int64) []int64) error {
+	tasks := []model.Task{}
+	err := db.Where("user_id = ? and id in (select task_id from task_tags where tag_id = ?)", userID, tagID).
+		Order("id").
+		Find(&tasks).Error
+	if err != nil {
+		return err
+	}
+	for i := range tasks {
+		tagIDs, err := taskTagIDs(db, tasks[i].Id)
+		if err != nil {
+			return err
+		}
+		if err := setTaskTags(db, userID, &tasks[i], change(tagIDs), model.TaskEventUpdated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTaskTags replaces tags of the task by the tags with the ids and records
+// the change as an event of given type. Tags are not a column of the task,
+// so the task is saved explicitly: its version grows like with any other
+// change. Ids of tags which no longer exist, e.g. restored by undo, are
+// skipped. Nothing is saved if tags do not change
+func setTaskTags(db *gorm.DB, actorID int64, task *model.Task, tagIDs []int64, eventType string) error {
+	before, err := taskTagIDs(db, task.Id)
+	if err != nil {
+		return err
+	}
+	after, err := existingTagIDs(db, task.UserID, uniqueIDs(tagIDs))
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+
+	if err := db.Exec("delete from task_tags where task_id = ?", task.Id).Error; err != nil {
+		return err
+	}
+	for _, id := range after {
+		if err := db.Exec("insert into task_tags (task_id, tag_id) values (?, ?)", task.Id, id).Error; err != nil {
+			return err
+		}
+	}
+
+	previous := *task
+	task.Tags = nil
+	if err := db.Save(task).Error; err != nil {
+		return err
+	}
+	changes := append(model.DiffTasks(&previous, task), model.TaskChange{Field: taskTagsField, Before: before, After: after})
+	return recordTaskChanges(db, actorID, eventType, task, changes)
+}
+
+// taskTagIDs returns sorted ids of tags of the task
+func taskTagIDs(db *gorm.DB, taskID int64) ([]int64, error) {
+	rows, err := db.Table("task_tags").Select("tag_id").Where("task_id = ?", taskID).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return uniqueIDs(ids), rows.Err()
+}
+
+// existingTagIDs keeps ids of user's tags which exist. Order is preserved
+func existingTagIDs(db *gorm.DB, userID int64, ids []int64) ([]int64, error) {
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	found := []int64{}
+	if err := db.Model(&model.Tag{}).Where("user_id = ? and id in (?)", userID, ids).Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+	exists := map[int64]bool{}
+	for _, id := range found {
+		exists[id] = true
+	}
+	existing := []int64{}
+	for _, id := range ids {
+		if exists[id] {
+			existing = append(existing, id)
+		}
+	}
+	return existing, nil
+}
+
+// withoutTagID returns the ids except the one
+func withoutTagID(ids []int64, tagID int64) []int64 {
+	without := []int64{}
+	for _, id := range ids {
+		if id != tagID {
+			without = append(without, id)
+		}
+	}
+	return without
+}
+
+// uniqueIDs sorts the ids and removes duplicates
+func uniqueIDs(ids []int64) []int64 {
+	sorted := append([]int64{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	unique := []int64{}
+	for i, id := range sorted {
+		if i == 0 || id != sorted[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// parseIDs reads ids from a change loaded from the database, where numbers
+// are decoded as float64
+func parseIDs(value interface{}) []int64 {
+	if ids, ok := value.([]int64); ok {
+		return ids
+	}
+	ids := []int64{}
+	items, _ := value.([]interface{})
+	for _, item := range items {
+		if id, ok := item.(float64); ok {
+			ids = append(ids, int64(id))
+		}
+	}
+	return ids
+}
+
+// loadTaskTags fills tags of the tasks. Gorm can not preload many to many
+// associations, so tags of all tasks are loaded with two queries instead
+func loadTaskTags(db *gorm.DB, tasks []model.Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	taskIDs := make([]int64, 0, len(tasks))
+	for _, task := range tasks {
+		taskIDs = append(taskIDs, task.Id)
+	}
+
+	rows, err := db.Table("task_tags").Select("task_id, tag_id").Where("task_id in (?)", taskIDs).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tagIDsByTask := map[int64][]int64{}
+	tagIDs := []int64{}
+	for rows.Next() {
+		var taskID, tagID int64
+		if err := rows.Scan(&taskID, &tagID); err != nil {
+			return err
+		}
+		tagIDsByTask[taskID] = append(tagIDsByTask[taskID], tagID)
+		tagIDs = append(tagIDs, tagID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range tasks {
+		tasks[i].Tags = []model.Tag{}
+	}
+	if len(tagIDs) == 0 {
+		return nil
+	}
+
+	tags := []model.Tag{}
+	if err := db.Where("id in (?)", tagIDs).Order("name").Find(&tags).Error; err != nil {
+		return err
+	}
+	for i := range tasks {
+		ids := map[int64]bool{}
+		for _, id := range tagIDsByTask[tasks[i].Id] {
+			ids[id] = true
+		}
+		for _, tag := range tags {
+			if ids[tag.Id] {
+				tasks[i].Tags = append(tasks[i].Tags, tag)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addTaskTagsByName puts user's tags with the names on the task, creating
+// missing tags. Name with underscores matches the name with spaces, because
+// that is how todo.txt keeps names. Returns whether any tag was added
+func addTaskTagsByName(db *gorm.DB, userID int64, task *model.Task, names []string) (bool, error) {
+	tags := []model.Tag{}
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&tags).Error; err != nil {
+		return false, err
+	}
+	before, err := taskTagIDs(db, task.Id)
+	if err != nil {
+		return false, err
+	}
+
+	tagIDs := append([]int64{}, before...)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		var tag *model.Tag
+		for i := range tags {
+			if strings.EqualFold(tags[i].Name, name) || strings.EqualFold(todoTxtName(tags[i].Name), name) {
+				tag = &tags[i]
+				break
+			}
+		}
+		if tag == nil {
+			tags = append(tags, model.Tag{UserID: userID, Name: name})
+			tag = &tags[len(tags)-1]
+			if err := db.Create(tag).Error; err != nil {
+				return false, err
+			}
+		}
+		tagIDs = append(tagIDs, tag.Id)
+	}
+
+	tagIDs = uniqueIDs(tagIDs)
+	if len(tagIDs) == len(before) {
+		return false, nil
+	}
+	return true, setTaskTags(db, userID, task, tagIDs, model.TaskEventUpdated)
+}
+
+// validateTagName checks the tag and ensures that user has no other tag with
+// the same name. Returns echo HTTP error otherwise
+func validateTagName(db *gorm.DB, tag model.Tag) error {
+	if err := tag.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	count := 0
+	err := db.Model(&model.Tag{}).
+		Where("user_id = ? and lower(name) = ? and id <> ?", tag.UserID, strings.ToLower(tag.Name), tag.Id).
+		Count(&count).Error
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, NewApiError("tag with this name already exists").String())
+	}
+
+	return nil
+}
+
+// findOwnTag loads current user's tag by id. Returns echo HTTP error otherwise
+func findOwnTag(c *echo.Context, db *gorm.DB, param string) (*model.Tag, error) {
+	id, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	tag := &model.Tag{}
+	err = db.Where("user_id = ?", currentUserID(c)).First(tag, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, NewApiError("tag not found").String())
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+
+	return tag, nil
+}
+
+// findTaskAndTag loads current user's task and tag by ids from request path.
+// Returns echo HTTP error otherwise
+func findTaskAndTag(c *echo.Context, db *gorm.DB) (*model.Task, *model.Tag, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	task, err := findTask(db, currentUserID(c), id)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(taskErrorStatus(err), NewApiError(err.Error()).String())
+	}
+
+	tag, err := findOwnTag(c, db, c.Param("tag_id"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return task, tag, nil
+}
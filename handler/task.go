@@ -1,14 +1,94 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/labstack/echo"
 	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
 )
 
+const defaultTaskListLimit = 50
+const maxTaskListLimit = 500
+const exportBatchSize = 500
+const ndjsonContentType = "application/x-ndjson"
+
+// GetListTasksHandler creates HTTP handler for List Tasks operation
+func GetListTasksHandler(db *gorm.DB, cursorSecret string) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		filter, err := parseTaskFilter(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		return listTasks(c, db, cursorSecret, filter)
+	}
+}
+
+// GetExportTasksHandler creates HTTP handler which streams all current user's
+// tasks matching the filter as newline-delimited JSON, JSON array, CSV or
+// todo.txt. Tasks are read in batches, so the whole list is never loaded into
+// memory
+func GetExportTasksHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		filter, err := parseTaskFilter(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		if filter.Location, err = userLocation(db, currentUserID(c)); err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		projects, err := projectNames(db, currentUserID(c))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		encoder, contentType, err := newTaskEncoder(c.Query("format"), c.Response(), projects)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(echo.ContentType, contentType)
+		c.Response().WriteHeader(http.StatusOK)
+
+		query := db.Where("user_id = ?", currentUserID(c)).Scopes(filter.Scope)
+		batch := query
+		for {
+			tasks := []model.Task{}
+			if err := batch.Limit(exportBatchSize).Find(&tasks).Error; err != nil {
+				// headers are already sent, so the only thing we can do is
+				// to break the stream, letting client know it is incomplete
+				return err
+			}
+			if err := loadTaskDetails(db, tasks); err != nil {
+				return err
+			}
+
+			for i := range tasks {
+				if err := encoder.Encode(&tasks[i]); err != nil {
+					return err
+				}
+			}
+			c.Response().Flush()
+
+			if len(tasks) < exportBatchSize {
+				return encoder.Close()
+			}
+
+			after, err := filter.AfterScope(model.NewTaskCursor(filter, tasks[len(tasks)-1]))
+			if err != nil {
+				return err
+			}
+			batch = query.Scopes(after)
+		}
+	}
+}
+
 // GetGetTaskHandler creates HTTP handler for Get Task operation
 func GetGetTaskHandler(db *gorm.DB) echo.HandlerFunc {
 	return func(c *echo.Context) error {
@@ -17,12 +97,12 @@ func GetGetTaskHandler(db *gorm.DB) echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
 		}
 
-		task := model.Task{}
-		if err := db.First(&task, id).Error; err != nil {
-			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		task, err := findTask(db, currentUserID(c), id)
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
 		}
 
-		return c.JSON(http.StatusOK, task)
+		return respondWithTask(c, db, task)
 	}
 }
 
@@ -34,15 +114,21 @@ func GetCreateTaskHandler(db *gorm.DB) echo.HandlerFunc {
 			return err
 		}
 
-		if err := db.Create(&task).Error; err != nil {
+		opDB, opID, err := withOperation(db)
+		if err != nil {
 			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
 		}
+		if err := createTask(opDB, currentUserID(c), &task); err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
 
+		c.Response().Header().Set(OperationIDHeader, opID)
 		return c.JSON(http.StatusCreated, task)
 	}
 }
 
-// GetUpdateTaskHandler creates HTTP handler for Update Task operation
+// GetUpdateTaskHandler creates HTTP handler for Update Task operation. Only
+// fields present in the request are changed
 func GetUpdateTaskHandler(db *gorm.DB) echo.HandlerFunc {
 	return func(c *echo.Context) error {
 		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
@@ -50,33 +136,493 @@ func GetUpdateTaskHandler(db *gorm.DB) echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
 		}
 
-		task := model.Task{}
-		if err := c.Bind(&task); err != nil {
-			return err
+		patch, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
 		}
-		task.Id = id
 
-		if err := db.Save(&task).Error; err != nil {
+		opDB, opID, err := withOperation(db)
+		if err != nil {
 			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
 		}
+		if _, err := updateTask(opDB, currentUserID(c), id, patch); err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
 
+		c.Response().Header().Set(OperationIDHeader, opID)
 		return c.NoContent(http.StatusNoContent)
 	}
 }
 
-// GetDeleteTaskHandler creates HTTP handler for Delete Task operation
+// GetCompleteTaskHandler creates HTTP handler for Complete Task operation.
+// Blocked task can be completed only if 'force' parameter is set
+func GetCompleteTaskHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		force, _ := strconv.ParseBool(c.Query("force"))
+
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		task, err := completeTask(opDB, currentUserID(c), id, force)
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return respondWithTask(c, db, task)
+	}
+}
+
+// GetDeleteTaskHandler creates HTTP handler for Delete Task operation. Task is
+// not removed from the database, but only marked as deleted
 func GetDeleteTaskHandler(db *gorm.DB) echo.HandlerFunc {
+	return getTaskActionHandler(db, deleteTask)
+}
+
+// GetRestoreTaskHandler creates HTTP handler for Restore Task operation, which
+// reverts deletion of the task
+func GetRestoreTaskHandler(db *gorm.DB) echo.HandlerFunc {
+	return getTaskActionHandler(db, restoreTask)
+}
+
+// taskAction defines an operation which changes state of user's task by its id
+type taskAction func(db *gorm.DB, userID, id int64) (*model.Task, error)
+
+// getTaskActionHandler creates HTTP handler which performs the action with a
+// task from request path and responds with the changed task
+func getTaskActionHandler(db *gorm.DB, action taskAction) echo.HandlerFunc {
 	return func(c *echo.Context) error {
 		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
 			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
 		}
 
-		task := model.Task{Id: id}
-		if err := db.Delete(&task).Error; err != nil {
+		opDB, opID, err := withOperation(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		task, err := action(opDB, currentUserID(c), id)
+		if err != nil {
+			return c.JSON(taskErrorStatus(err), NewApiError(err.Error()))
+		}
+
+		c.Response().Header().Set(OperationIDHeader, opID)
+		return respondWithTask(c, db, task)
+	}
+}
+
+// listTasks responds with a page of current user's tasks matching the filter.
+// Page can be selected either by offset or by cursor from the previous page.
+// Cursor of the next page is returned in a header, when page is full
+func listTasks(c *echo.Context, db *gorm.DB, cursorSecret string, filter model.TaskFilter) error {
+	limit, offset, err := parsePagination(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+	}
+
+	if filter.Location, err = userLocation(db, currentUserID(c)); err != nil {
+		return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+	}
+
+	query := db.Where("user_id = ?", currentUserID(c)).Scopes(filter.Scope)
+	if value := c.Query("cursor"); value != "" {
+		if offset > 0 {
+			return c.JSON(http.StatusBadRequest, NewApiError("cursor and offset can not be used together"))
+		}
+		cursor, err := decodeCursor(value, cursorSecret)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		after, err := filter.AfterScope(cursor)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		query = query.Scopes(after)
+	}
+
+	tasks := []model.Task{}
+	if err := query.Limit(limit).Offset(offset).Find(&tasks).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+	}
+	if err := loadTaskDetails(db, tasks); err != nil {
+		return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+	}
+
+	if len(tasks) == limit {
+		next, err := encodeCursor(model.NewTaskCursor(filter, tasks[len(tasks)-1]), cursorSecret)
+		if err != nil {
 			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
 		}
+		c.Response().Header().Set(NextCursorHeader, next)
+	}
+
+	return c.JSON(http.StatusOK, tasks)
+}
+
+// parseTaskFilter reads task filter from query parameters of the request
+func parseTaskFilter(c *echo.Context) (model.TaskFilter, error) {
+	filter := model.TaskFilter{
+		Status:  c.Query("status"),
+		Search:  c.Query("search"),
+		TagMode: c.Query("tag_mode"),
+		Due:     c.Query("due"),
+		OrderBy: c.Query("order_by"),
+	}
+
+	if value := c.Query("project_id"); value != "" {
+		projectID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return filter, err
+		}
+		filter.ProjectID = &projectID
+	}
 
-		return c.JSON(http.StatusOK, task)
+	if value := c.Query("tags"); value != "" {
+		for _, item := range strings.Split(value, ",") {
+			tagID, err := strconv.ParseInt(strings.TrimSpace(item), 10, 64)
+			if err != nil {
+				return filter, err
+			}
+			filter.Tags = append(filter.Tags, tagID)
+		}
 	}
+
+	for param, target := range map[string]**int{
+		"min_priority": &filter.MinPriority,
+		"max_priority": &filter.MaxPriority,
+	} {
+		if value := c.Query(param); value != "" {
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return filter, err
+			}
+			*target = &priority
+		}
+	}
+
+	return filter, filter.Validate()
+}
+
+var errInvalidLimit = errors.New("limit must be a positive number")
+
+// parsePagination reads limit and offset from query parameters of the
+// request. Limit above the maximum is reduced to it
+func parsePagination(c *echo.Context) (limit int, offset int, err error) {
+	limit = defaultTaskListLimit
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			return
+		}
+	}
+	if limit <= 0 {
+		return 0, 0, errInvalidLimit
+	}
+	if limit > maxTaskListLimit {
+		limit = maxTaskListLimit
+	}
+
+	if value := c.Query("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil {
+			return
+		}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	return
+}
+
+var errTaskNotFound = errors.New("task not found")
+var errInvalidTask = errors.New("task must be a JSON object")
+
+// respondWithTask responds with the task including all its computed details
+func respondWithTask(c *echo.Context, db *gorm.DB, task *model.Task) error {
+	tasks := []model.Task{*task}
+	if err := loadTaskDetails(db, tasks); err != nil {
+		return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+	}
+
+	return c.JSON(http.StatusOK, tasks[0])
+}
+
+// loadTaskDetails fills fields of the tasks which are not stored in the
+// tasks table
+func loadTaskDetails(db *gorm.DB, tasks []model.Task) error {
+	if err := loadTaskTags(db, tasks); err != nil {
+		return err
+	}
+	if err := loadTaskBlocked(db, tasks); err != nil {
+		return err
+	}
+	return loadTaskCommentCounts(db, tasks)
+}
+
+// taskErrorStatus returns HTTP status which corresponds to an error of a task
+// operation
+func taskErrorStatus(err error) int {
+	if _, ok := err.(recurrenceError); ok {
+		return http.StatusBadRequest
+	}
+
+	switch err {
+	case errTaskNotFound:
+		return http.StatusNotFound
+	case errProjectNotFound, errParentNotFound, errTaskCycle, errRecurrenceDueAt, errInvalidTask:
+		return http.StatusBadRequest
+	case errTaskBlocked, errDependencyCycle:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// findTask loads user's task by id
+func findTask(db *gorm.DB, userID, id int64) (*model.Task, error) {
+	task := &model.Task{}
+	err := db.Where("user_id = ?", userID).First(task, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, errTaskNotFound
+	}
+	return task, err
+}
+
+// findTaskFromRequest loads current user's task which id is provided in
+// the path of the request
+func findTaskFromRequest(c *echo.Context, db *gorm.DB) (*model.Task, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	task, err := findTask(db, currentUserID(c), id)
+	if err != nil {
+		return nil, echo.NewHTTPError(taskErrorStatus(err), NewApiError(err.Error()).String())
+	}
+	return task, nil
+}
+
+// createTask saves new task of the user. Tags are managed by separate
+// operations, so they are ignored here
+func createTask(db *gorm.DB, userID int64, task *model.Task) error {
+	task.Id = 0
+	task.UserID = userID
+	task.Tags = nil
+	if err := checkTaskProject(db, task); err != nil {
+		return err
+	}
+	if err := checkTaskParent(db, task); err != nil {
+		return err
+	}
+	if err := checkTaskRecurrence(task); err != nil {
+		return err
+	}
+	return inTransaction(db, func(tx *gorm.DB) error {
+		if err := tx.Create(task).Error; err != nil {
+			return err
+		}
+		return recordTaskEvent(tx, userID, model.TaskEventCreated, &model.Task{}, task)
+	})
+}
+
+// updateTask changes fields of the user's existing task which are present in
+// the JSON patch
+func updateTask(db *gorm.DB, userID, id int64, patch []byte) (*model.Task, error) {
+	var task *model.Task
+	err := inTransaction(db, func(tx *gorm.DB) error {
+		existing, err := findTask(tx, userID, id)
+		if err != nil {
+			return err
+		}
+		patched, err := patchTask(existing, patch)
+		if err != nil {
+			return err
+		}
+		task, err = saveTaskChanges(tx, userID, existing, patched, false)
+		return err
+	})
+	return task, err
+}
+
+// saveTaskChanges saves changed task of the user. Completion and deletion
+// are not plain field changes: they go through their own operations, so
+// blocked tasks are completed only if forced, completion is rolled up, the
+// next occurrence is spawned and events have proper types. Reopening is
+// a plain change. Time of completion is never taken from the changed task
+func saveTaskChanges(db *gorm.DB, userID int64, existing, task *model.Task, force bool) (*model.Task, error) {
+	complete := task.IsCompleted && !existing.IsCompleted
+	setDeleted := task.IsDeleted != existing.IsDeleted
+	deleted := task.IsDeleted
+
+	task.IsCompleted = task.IsCompleted && existing.IsCompleted
+	task.CompletedAt = nil
+	if task.IsCompleted {
+		task.CompletedAt = existing.CompletedAt
+	}
+	task.IsDeleted = existing.IsDeleted
+
+	if len(model.DiffTasks(existing, task)) > 0 || (!complete && !setDeleted) {
+		if err := replaceTask(db, userID, existing, task, model.TaskEventUpdated); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if complete {
+		if task, err = completeTask(db, userID, existing.Id, force); err != nil {
+			return nil, err
+		}
+	}
+	if setDeleted {
+		if task, err = setTaskDeleted(db, userID, existing.Id, deleted); err != nil {
+			return nil, err
+		}
+	}
+	return task, nil
+}
+
+// patchTask returns a copy of the task with fields taken from the JSON patch.
+// Fields missing in the patch keep their values. The copy shares no pointers
+// with the task, so the task still describes the state before the patch
+func patchTask(task *model.Task, patch []byte) (*model.Task, error) {
+	content, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	patched := &model.Task{}
+	if err := json.Unmarshal(content, patched); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, patched); err != nil {
+		return nil, errInvalidTask
+	}
+	return patched, nil
+}
+
+// replaceTask saves new state of the existing task and records the change
+// as an event of given type on behalf of the actor
+func replaceTask(db *gorm.DB, actorID int64, existing, task *model.Task, eventType string) error {
+	task.Id = existing.Id
+	task.UserID = existing.UserID
+	task.CreatedAt = existing.CreatedAt
+	task.Version = existing.Version
+	task.ResourceName = existing.ResourceName
+	task.Tags = nil
+	// series start is kept while the recurrence rule is not changed, so COUNT
+	// is still counted from the first occurrence. New rule starts a new series
+	if task.RRule == existing.RRule {
+		if task.SeriesStart == nil {
+			task.SeriesStart = existing.SeriesStart
+		}
+	} else if task.SeriesStart != nil && existing.SeriesStart != nil && task.SeriesStart.Equal(*existing.SeriesStart) {
+		task.SeriesStart = nil
+	}
+	if err := checkTaskProject(db, task); err != nil {
+		return err
+	}
+	if err := checkTaskParent(db, task); err != nil {
+		return err
+	}
+	if err := checkTaskRecurrence(task); err != nil {
+		return err
+	}
+	if err := db.Save(task).Error; err != nil {
+		return err
+	}
+	if err := recordTaskEvent(db, actorID, eventType, existing, task); err != nil {
+		return err
+	}
+	return rescheduleTaskReminders(db, task)
+}
+
+// checkTaskProject ensures that task is put into a project of the same user
+func checkTaskProject(db *gorm.DB, task *model.Task) error {
+	if task.ProjectID == 0 {
+		return nil
+	}
+	_, err := findProject(db, task.UserID, task.ProjectID)
+	return err
+}
+
+// completeTask marks user's task as completed. Blocked task is completed only
+// if forced. Parent tasks are completed as well, if they are configured to
+// roll up completion of subtasks
+func completeTask(db *gorm.DB, userID, id int64, force bool) (*model.Task, error) {
+	task, err := findTask(db, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if task.IsCompleted {
+		return task, nil
+	}
+
+	if !force {
+		if blocked, err := isTaskBlocked(db, task); err != nil {
+			return nil, err
+		} else if blocked {
+			return nil, errTaskBlocked
+		}
+	}
+
+	return task, inTransaction(db, func(tx *gorm.DB) error {
+		if err := markTaskCompleted(tx, userID, task); err != nil {
+			return err
+		}
+		return rollUpCompletion(tx, userID, task.ParentID)
+	})
+}
+
+// markTaskCompleted completes the task on behalf of the actor. The next
+// occurrence of recurring task is created at the same time
+func markTaskCompleted(db *gorm.DB, actorID int64, task *model.Task) error {
+	before := *task
+	now := time.Now()
+	task.IsCompleted = true
+	task.CompletedAt = &now
+	if task.RRule != "" {
+		if err := spawnNextOccurrence(db, actorID, task); err != nil {
+			return err
+		}
+	}
+	if err := db.Save(task).Error; err != nil {
+		return err
+	}
+	return recordTaskEvent(db, actorID, model.TaskEventCompleted, &before, task)
+}
+
+// deleteTask marks user's task as deleted
+func deleteTask(db *gorm.DB, userID, id int64) (*model.Task, error) {
+	return setTaskDeleted(db, userID, id, true)
+}
+
+// restoreTask reverts deletion of user's task
+func restoreTask(db *gorm.DB, userID, id int64) (*model.Task, error) {
+	return setTaskDeleted(db, userID, id, false)
+}
+
+func setTaskDeleted(db *gorm.DB, userID, id int64, deleted bool) (*model.Task, error) {
+	task, err := findTask(db, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if task.IsDeleted == deleted {
+		return task, nil
+	}
+
+	before := *task
+	task.IsDeleted = deleted
+	eventType := model.TaskEventRestored
+	if deleted {
+		eventType = model.TaskEventDeleted
+	}
+	return task, inTransaction(db, func(tx *gorm.DB) error {
+		if err := tx.Save(task).Error; err != nil {
+			return err
+		}
+		return recordTaskEvent(tx, userID, eventType, &before, task)
+	})
 }
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// userRequest defines input of update user operation
+type userRequest struct {
+	Timezone *string `json:"timezone"`
+	Email    *string `json:"email"`
+}
+
+// GetGetUserHandler creates HTTP handler which responds with profile of
+// current user
+func GetGetUserHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		user := model.User{}
+		if err := db.First(&user, currentUserID(c)).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// GetUpdateUserHandler creates HTTP handler which updates settings of current
+// user
+func GetUpdateUserHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		user := model.User{}
+		if err := db.First(&user, currentUserID(c)).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		req := userRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if req.Timezone != nil {
+			user.Timezone = *req.Timezone
+		}
+		if req.Email != nil {
+			user.Email = strings.TrimSpace(*req.Email)
+		}
+		if _, err := user.Location(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+		if user.Email != "" {
+			if _, err := mail.ParseAddress(user.Email); err != nil {
+				return c.JSON(http.StatusBadRequest, NewApiError("invalid email: "+user.Email))
+			}
+		}
+
+		if err := db.Save(&user).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// userLocation returns timezone of the user
+func userLocation(db *gorm.DB, userID int64) (*time.Location, error) {
+	user := model.User{}
+	if err := db.Select("timezone").First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	return user.Location()
+}
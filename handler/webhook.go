@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// webhookRequest defines input of create and update webhook operations
+type webhookRequest struct {
+	URL      *string   `json:"url"`
+	Events   *[]string `json:"events"`
+	Secret   *string   `json:"secret"`
+	IsActive *bool     `json:"is_active"`
+}
+
+func (r webhookRequest) apply(webhook *model.Webhook) {
+	if r.URL != nil {
+		webhook.URL = strings.TrimSpace(*r.URL)
+	}
+	if r.Events != nil {
+		webhook.EventTypes = *r.Events
+	}
+	if r.Secret != nil {
+		webhook.Secret = *r.Secret
+	}
+	if r.IsActive != nil {
+		webhook.IsActive = *r.IsActive
+	}
+}
+
+// GetListWebhooksHandler creates HTTP handler which lists current user's
+// webhooks
+func GetListWebhooksHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		webhooks := []model.Webhook{}
+		if err := db.Where("user_id = ?", currentUserID(c)).Order("id").Find(&webhooks).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, webhooks)
+	}
+}
+
+// GetGetWebhookHandler creates HTTP handler for Get Webhook operation
+func GetGetWebhookHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		webhook, err := findWebhookFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, webhook)
+	}
+}
+
+// GetCreateWebhookHandler creates HTTP handler for Create Webhook operation.
+// Webhook is active by default. Secret is generated unless provided
+func GetCreateWebhookHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		req := webhookRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		webhook := model.Webhook{UserID: currentUserID(c), IsActive: true}
+		if req.Secret == nil {
+			secret, err := lib.GenerateRandomString(24)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+			}
+			webhook.Secret = secret
+		}
+		req.apply(&webhook)
+		if err := webhook.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		if err := db.Create(&webhook).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusCreated, webhook)
+	}
+}
+
+// GetUpdateWebhookHandler creates HTTP handler for Update Webhook operation.
+// Only provided fields are changed
+func GetUpdateWebhookHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		webhook, err := findWebhookFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		req := webhookRequest{}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		req.apply(webhook)
+		if err := webhook.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		if err := db.Save(webhook).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, webhook)
+	}
+}
+
+// GetDeleteWebhookHandler creates HTTP handler for Delete Webhook operation.
+// Deliveries of the webhook are removed as well
+func GetDeleteWebhookHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		webhook, err := findWebhookFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		err = inTransaction(db, func(tx *gorm.DB) error {
+			if err := tx.Where("webhook_id = ?", webhook.Id).Delete(model.WebhookDelivery{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(webhook).Error
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetWebhookDeliveriesHandler creates HTTP handler which lists deliveries of
+// the webhook from the latest one. Deliveries can be filtered by 'status'
+func GetWebhookDeliveriesHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		webhook, err := findWebhookFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		limit, offset, err := parsePagination(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, NewApiError(err.Error()))
+		}
+
+		query := db.Where("webhook_id = ?", webhook.Id)
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+
+		deliveries := []model.WebhookDelivery{}
+		if err := query.Order("id desc").Limit(limit).Offset(offset).Find(&deliveries).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// GetTestWebhookHandler creates HTTP handler which queues a test event for
+// the webhook, even if it is not active. The event is delivered in background
+// as any other one
+func GetTestWebhookHandler(db *gorm.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		webhook, err := findWebhookFromRequest(c, db)
+		if err != nil {
+			return err
+		}
+
+		payload, err := json.Marshal(model.EventPayload{Event: model.WebhookEventTest, OccurredAt: time.Now()})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+		delivery := model.NewWebhookDelivery(webhook.Id, 0, model.WebhookEventTest, string(payload))
+		if err := db.Create(delivery).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, NewApiError(err.Error()))
+		}
+
+		return c.JSON(http.StatusAccepted, delivery)
+	}
+}
+
+// findWebhookFromRequest loads current user's webhook which id is provided in
+// the path of the request
+func findWebhookFromRequest(c *echo.Context, db *gorm.DB) (*model.Webhook, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, NewApiError(err.Error()).String())
+	}
+
+	webhook := &model.Webhook{}
+	err = db.Where("user_id = ?", currentUserID(c)).First(webhook, id).Error
+	if err == gorm.RecordNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, NewApiError(errWebhookNotFound.Error()).String())
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, NewApiError(err.Error()).String())
+	}
+	return webhook, nil
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/live"
+	"golang.org/x/net/websocket"
+)
+
+// wsAuthTimeout limits time a client has to send auth message after connecting
+const wsAuthTimeout = 10 * time.Second
+
+// wsPingInterval is a period of heartbeat messages. Client which sends nothing
+// during two periods is considered gone
+const wsPingInterval = 30 * time.Second
+
+// wsWriteTimeout limits time of sending a single message
+const wsWriteTimeout = 10 * time.Second
+
+// types of WebSocket messages besides task events
+const (
+	wsMessageAuth  = "auth"
+	wsMessageReady = "ready"
+	wsMessagePing  = "ping"
+	wsMessageError = "error"
+)
+
+var errSocketAuthRequired = errors.New("auth message with token expected")
+var errSocketTooSlow = errors.New("client does not keep up with events")
+
+// wsMessage defines messages exchanged over WebSocket connection. Task events
+// are sent with id of the event and its payload in data
+type wsMessage struct {
+	Type  string          `json:"type"`
+	Token string          `json:"token,omitempty"`
+	ID    int64           `json:"id,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// GetWebSocketHandler creates WebSocket handler which pushes events of
+// current user's tasks. Client authenticates with JWT token in 'token' query
+// parameter or in the first message. Server sends ping messages, and client
+// must send something, e.g. pong message, at least once per two pings.
+// Connection of a client which does not keep up with events is closed
+func GetWebSocketHandler(hub *live.Hub, jwtSecret string) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		ws := c.Socket()
+		defer ws.Close()
+
+		userID, err := authenticateSocket(ws, c.Query("token"), jwtSecret)
+		if err != nil {
+			sendSocketMessage(ws, wsMessage{Type: wsMessageError, Error: err.Error()})
+			return nil
+		}
+
+		subscription := hub.Subscribe(userID)
+		defer hub.Cancel(subscription)
+
+		if err := sendSocketMessage(ws, wsMessage{Type: wsMessageReady}); err != nil {
+			return nil
+		}
+
+		gone := make(chan struct{})
+		go readSocket(ws, gone)
+
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+
+		for {
+			var msg wsMessage
+			select {
+			case event, ok := <-subscription.Events:
+				if !ok {
+					if subscription.Dropped() {
+						sendSocketMessage(ws, wsMessage{Type: wsMessageError, Error: errSocketTooSlow.Error()})
+					}
+					return nil
+				}
+				msg = wsMessage{Type: event.Type, ID: event.Id, Data: json.RawMessage(event.Payload)}
+			case <-ticker.C:
+				msg = wsMessage{Type: wsMessagePing}
+			case <-gone:
+				return nil
+			}
+
+			if err := sendSocketMessage(ws, msg); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// authenticateSocket returns ID of the user the token was issued to. Unless
+// the token is provided in the query, it is read from the first message
+func authenticateSocket(ws *websocket.Conn, token, jwtSecret string) (int64, error) {
+	if token == "" {
+		ws.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+		msg := wsMessage{}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil || msg.Type != wsMessageAuth || msg.Token == "" {
+			return 0, errSocketAuthRequired
+		}
+		token = msg.Token
+	}
+
+	return parseJwtToken(token, jwtSecret)
+}
+
+// readSocket reads messages of the client until it disconnects or stays
+// silent for too long. Content of messages is ignored, they only prove the
+// client is alive
+func readSocket(ws *websocket.Conn, gone chan<- struct{}) {
+	defer close(gone)
+	for {
+		ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		msg := wsMessage{}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+	}
+}
+
+func sendSocketMessage(ws *websocket.Conn, msg wsMessage) error {
+	ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return websocket.JSON.Send(ws, msg)
+}
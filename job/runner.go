@@ -0,0 +1,346 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+	"golang.org/x/net/context"
+)
+
+const tickInterval = time.Second
+const defaultTimeout = 5 * time.Minute
+
+// lockGrace is added to the timeout of a job when it is locked, so the lock
+// outlives the run and expires only if the instance holding it died. Lock of
+// a running job is extended by the grace period until the job returns
+const lockGrace = time.Minute
+
+// ErrNotFound is returned when a job is not registered
+var ErrNotFound = errors.New("job not found")
+
+// ErrLocked is returned when a job is already running in some instance
+var ErrLocked = errors.New("job is already running")
+
+// Func defines work of a job. It should return as soon as the context is done
+type Func func(ctx context.Context) error
+
+// Definition defines a named job which runs on schedule
+type Definition struct {
+	Name     string
+	Schedule string
+	Timeout  time.Duration
+	Run      Func
+}
+
+type entry struct {
+	definition Definition
+	schedule   Schedule
+	next       time.Time
+}
+
+// Runner runs registered jobs on their schedules. State of jobs and their
+// locks are kept in the database, so only one instance of the application
+// runs a job at a time
+type Runner struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+	owner  string
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	running map[string]bool
+}
+
+// NewRunner creates runner without any jobs
+func NewRunner(db *gorm.DB, logger *logrus.Logger) *Runner {
+	hostname, _ := os.Hostname()
+	return &Runner{
+		db:      db,
+		logger:  logger,
+		owner:   fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		entries: map[string]*entry{},
+		running: map[string]bool{},
+	}
+}
+
+// Add registers the job. Default timeout is 5 minutes
+func (r *Runner) Add(definition Definition) error {
+	schedule, err := ParseSchedule(definition.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %s", definition.Name, err.Error())
+	}
+	if definition.Timeout <= 0 {
+		definition.Timeout = defaultTimeout
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[definition.Name] = &entry{definition: definition, schedule: schedule}
+	return nil
+}
+
+// Start stores registered jobs in the database and starts running them in
+// background
+func (r *Runner) Start() error {
+	now := time.Now()
+	for _, e := range r.entries {
+		job := model.Job{}
+		if err := r.db.Where(model.Job{Name: e.definition.Name}).FirstOrCreate(&job).Error; err != nil {
+			return err
+		}
+
+		job.Schedule = e.definition.Schedule
+		job.Timeout = durationMs(e.definition.Timeout)
+		// schedule could be changed since the last start
+		next := e.schedule.Next(now)
+		if job.NextRunAt == nil || next.IsZero() || job.NextRunAt.After(next) {
+			job.NextRunAt = nextRunAt(next)
+		}
+		if err := r.db.Save(&job).Error; err != nil {
+			return err
+		}
+		if job.NextRunAt != nil {
+			e.next = *job.NextRunAt
+		}
+	}
+
+	go r.loop()
+	return nil
+}
+
+// Jobs returns state of all registered jobs
+func (r *Runner) Jobs() ([]model.Job, error) {
+	names := []string{}
+	r.mu.Lock()
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	jobs := []model.Job{}
+	err := r.db.Where("name in (?)", names).Order("name").Find(&jobs).Error
+	return jobs, err
+}
+
+// Trigger runs the job in background right now, regardless of its schedule
+func (r *Runner) Trigger(name string) error {
+	r.mu.Lock()
+	e, ok := r.entries[name]
+	r.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+
+	acquired, err := r.lock(e, false)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return ErrLocked
+	}
+
+	go r.run(e)
+	return nil
+}
+
+func (r *Runner) loop() {
+	for now := range time.Tick(tickInterval) {
+		r.mu.Lock()
+		due := []*entry{}
+		for _, e := range r.entries {
+			// zero time of the next run means the job is never run by schedule
+			if !r.running[e.definition.Name] && !e.next.IsZero() && !e.next.After(now) {
+				due = append(due, e)
+			}
+		}
+		r.mu.Unlock()
+
+		for _, e := range due {
+			acquired, err := r.lock(e, true)
+			if err != nil {
+				r.logger.Errorf("could not lock job %s: %s", e.definition.Name, err.Error())
+				continue
+			}
+			if !acquired {
+				// the job is running or was already run by another instance
+				r.refreshNext(e)
+				continue
+			}
+			go r.run(e)
+		}
+	}
+}
+
+// lock acquires lock of the job in the database. Scheduled run acquires the
+// lock only if the job is due, so instances do not run it one after another
+func (r *Runner) lock(e *entry, scheduled bool) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running[e.definition.Name] {
+		return false, nil
+	}
+
+	now := time.Now()
+	query := r.db.Model(&model.Job{}).
+		Where("name = ? and (locked_until is null or locked_until < ?)", e.definition.Name, now)
+	if scheduled {
+		query = query.Where("next_run_at is not null and next_run_at <= ?", now)
+	}
+	result := query.UpdateColumns(map[string]interface{}{
+		"locked_by":    r.owner,
+		"locked_until": now.Add(e.definition.Timeout + lockGrace),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	r.running[e.definition.Name] = true
+	return true, nil
+}
+
+// run runs the locked job, records results of the run and releases the lock
+func (r *Runner) run(e *entry) {
+	name := e.definition.Name
+	defer func() {
+		r.mu.Lock()
+		delete(r.running, name)
+		r.mu.Unlock()
+	}()
+
+	started := time.Now()
+	stop := make(chan struct{})
+	go r.keepLocked(e, stop)
+	status, err := r.execute(e)
+	close(stop)
+	duration := time.Since(started)
+
+	fields := logrus.Fields{
+		"job":                  name,
+		"status":               status,
+		"measure#job.duration": duration.Nanoseconds(),
+	}
+	if err != nil {
+		fields["count#job.failure"] = 1
+		r.logger.WithFields(fields).Errorf("job %s failed: %s", name, err.Error())
+	} else {
+		r.logger.WithFields(fields).Infof("job %s finished", name)
+	}
+
+	next := e.schedule.Next(time.Now())
+	r.mu.Lock()
+	e.next = next
+	r.mu.Unlock()
+
+	job := model.Job{}
+	if dbErr := r.db.Where("name = ?", name).First(&job).Error; dbErr != nil {
+		r.logger.Errorf("could not save state of job %s: %s", name, dbErr.Error())
+		return
+	}
+	job.LastRunAt = &started
+	job.LastStatus = status
+	job.LastDuration = durationMs(duration)
+	job.LastError = ""
+	job.RunCount++
+	if err != nil {
+		job.LastError = err.Error()
+		job.FailureCount++
+	}
+	job.NextRunAt = nextRunAt(next)
+	job.LockedBy = ""
+	job.LockedUntil = nil
+	if dbErr := r.db.Save(&job).Error; dbErr != nil {
+		r.logger.Errorf("could not save state of job %s: %s", name, dbErr.Error())
+	}
+}
+
+// execute runs the job with timeout. Panic of the job is reported as failure.
+// Job which ignores its context is waited for, so it is never run twice at a
+// time
+func (r *Runner) execute(e *entry) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.definition.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("panic: %v", p)
+			}
+		}()
+		done <- e.definition.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return model.JobStatusFailed, err
+		}
+		return model.JobStatusSucceeded, nil
+	case <-ctx.Done():
+		r.logger.Warnf("job %s timed out after %s, waiting for it to return", e.definition.Name, e.definition.Timeout)
+		<-done
+		return model.JobStatusTimeout, fmt.Errorf("timed out after %s", e.definition.Timeout)
+	}
+}
+
+// keepLocked extends lock of the running job until stop is closed
+func (r *Runner) keepLocked(e *entry, stop chan struct{}) {
+	ticker := time.NewTicker(lockGrace / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			err := r.db.Model(&model.Job{}).
+				Where("name = ? and locked_by = ?", e.definition.Name, r.owner).
+				UpdateColumns(map[string]interface{}{"locked_until": now.Add(lockGrace)}).Error
+			if err != nil {
+				r.logger.Errorf("could not extend lock of job %s: %s", e.definition.Name, err.Error())
+			}
+		}
+	}
+}
+
+// refreshNext loads time of the next run which could be set by another instance
+func (r *Runner) refreshNext(e *entry) {
+	job := model.Job{}
+	if err := r.db.Where("name = ?", e.definition.Name).First(&job).Error; err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job.NextRunAt == nil {
+		e.next = time.Time{}
+	} else if job.NextRunAt.After(e.next) {
+		e.next = *job.NextRunAt
+	} else {
+		// job is still running somewhere, check again later
+		e.next = time.Now().Add(tickInterval)
+	}
+}
+
+// nextRunAt converts time of the next run for the database. Job which never
+// runs again has no time of the next run
+func nextRunAt(next time.Time) *time.Time {
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
+
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
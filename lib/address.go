@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrNonPublicAddress is returned for addresses which are not reachable from
+// the internet, e.g. loopback or private ones
+var ErrNonPublicAddress = errors.New("address is not public")
+
+// sharedAddressSpace is a range of carrier-grade NAT, RFC 6598
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublicIP checks that the address is not loopback, private, link-local,
+// multicast, shared or unspecified
+func IsPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// CheckPublicHost resolves the host and checks that all its addresses are
+// public
+func CheckPublicHost(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if !IsPublicIP(ip) {
+			return ErrNonPublicAddress
+		}
+	}
+	return nil
+}
+
+// PublicDialControl is a net.Dialer control function which refuses to
+// connect to addresses which are not public. It checks the address actually
+// dialed, so a host can not resolve differently after it was checked
+func PublicDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+		return ErrNonPublicAddress
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// formats of iCalendar values
+const (
+	ICalDateFormat     = "20060102"
+	ICalDateTimeFormat = "20060102T150405Z"
+	icalLocalFormat    = "20060102T150405"
+)
+
+// icalLineLength is a maximum length of a content line in octets. Longer
+// lines are folded
+const icalLineLength = 75
+
+// ICalProperty defines a content line of iCalendar object
+type ICalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// ICalComponent defines iCalendar component, e.g. VCALENDAR or VTODO, with its
+// properties and nested components
+type ICalComponent struct {
+	Name       string
+	Properties []ICalProperty
+	Components []*ICalComponent
+}
+
+// NewICalComponent creates empty component
+func NewICalComponent(name string) *ICalComponent {
+	return &ICalComponent{Name: name}
+}
+
+// Add appends a property with the raw value. Params are given as name and
+// value pairs
+func (c *ICalComponent) Add(name, value string, params ...string) {
+	property := ICalProperty{Name: name, Value: value}
+	if len(params) > 0 {
+		property.Params = map[string]string{}
+		for i := 0; i+1 < len(params); i += 2 {
+			property.Params[params[i]] = params[i+1]
+		}
+	}
+	c.Properties = append(c.Properties, property)
+}
+
+// AddText appends a property with the text value escaped
+func (c *ICalComponent) AddText(name, value string) {
+	c.Add(name, ICalEscape(value))
+}
+
+// Get returns the first property with the name or nil
+func (c *ICalComponent) Get(name string) *ICalProperty {
+	for i := range c.Properties {
+		if c.Properties[i].Name == name {
+			return &c.Properties[i]
+		}
+	}
+	return nil
+}
+
+// Text returns unescaped value of the first property with the name
+func (c *ICalComponent) Text(name string) string {
+	if property := c.Get(name); property != nil {
+		return ICalUnescape(property.Value)
+	}
+	return ""
+}
+
+// Find returns nested components with the name, including components nested
+// into them
+func (c *ICalComponent) Find(name string) []*ICalComponent {
+	found := []*ICalComponent{}
+	for _, component := range c.Components {
+		if component.Name == name {
+			found = append(found, component)
+		}
+		found = append(found, component.Find(name)...)
+	}
+	return found
+}
+
+// Encode writes the component in iCalendar format
+func (c *ICalComponent) Encode(w io.Writer) error {
+	if err := writeICalLine(w, "BEGIN:"+c.Name); err != nil {
+		return err
+	}
+	for _, property := range c.Properties {
+		line := property.Name
+		for name, value := range property.Params {
+			if strings.ContainsAny(value, ":;,") {
+				value = `"` + value + `"`
+			}
+			line += ";" + name + "=" + value
+		}
+		if err := writeICalLine(w, line+":"+property.Value); err != nil {
+			return err
+		}
+	}
+	for _, component := range c.Components {
+		if err := component.Encode(w); err != nil {
+			return err
+		}
+	}
+	return writeICalLine(w, "END:"+c.Name)
+}
+
+// writeICalLine writes the content line folded into lines of limited length.
+// Folding never splits a multibyte character
+func writeICalLine(w io.Writer, line string) error {
+	folded := ""
+	limit := icalLineLength
+	for len(line) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		folded += line[:n] + "\r\n "
+		line = line[n:]
+		// continuation lines start with a space, which counts in the length
+		limit = icalLineLength - 1
+	}
+	_, err := io.WriteString(w, folded+line+"\r\n")
+	return err
+}
+
+// ParseICal reads the first component of iCalendar stream
+func ParseICal(r io.Reader) (*ICalComponent, error) {
+	lines, err := readICalLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var stack []*ICalComponent
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		property, err := parseICalLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToUpper(property.Name) {
+		case "BEGIN":
+			component := NewICalComponent(strings.ToUpper(property.Value))
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, component)
+			}
+			stack = append(stack, component)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(property.Value) {
+				return nil, errors.New("unexpected END:" + property.Value)
+			}
+			if len(stack) == 1 {
+				return stack[0], nil
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, errors.New("property outside of component: " + property.Name)
+			}
+			component := stack[len(stack)-1]
+			component.Properties = append(component.Properties, property)
+		}
+	}
+	return nil, errors.New("unexpected end of iCalendar data")
+}
+
+// readICalLines splits the stream into unfolded content lines
+func readICalLines(r io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseICalLine splits content line into name, params and value. Colons and
+// semicolons in quoted param values are not separators
+func parseICalLine(line string) (ICalProperty, error) {
+	property := ICalProperty{}
+	quoted := false
+	start := 0
+	var params []string
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			params = append(params, line[start:i])
+			start = i + 1
+		case r == ':' && !quoted:
+			params = append(params, line[start:i])
+			property.Name = strings.ToUpper(params[0])
+			for _, param := range params[1:] {
+				parts := strings.SplitN(param, "=", 2)
+				if len(parts) != 2 {
+					return property, errors.New("invalid parameter in line: " + line)
+				}
+				if property.Params == nil {
+					property.Params = map[string]string{}
+				}
+				property.Params[strings.ToUpper(parts[0])] = strings.Trim(parts[1], `"`)
+			}
+			property.Value = line[i+1:]
+			return property, nil
+		}
+	}
+	return property, errors.New("invalid content line: " + line)
+}
+
+// ICalEscape escapes text value
+func ICalEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// ICalUnescape restores text value from its escaped form
+func ICalUnescape(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(value)
+}
+
+// ParseICalTime parses DATE or DATE-TIME value of the property. Floating time
+// and time in unknown timezone are interpreted in the location
+func ParseICalTime(property *ICalProperty, location *time.Location) (t time.Time, isDate bool, err error) {
+	value := property.Value
+	if property.Params["VALUE"] == "DATE" || len(value) == len(ICalDateFormat) {
+		t, err = time.Parse(ICalDateFormat, value)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse(ICalDateTimeFormat, value)
+		return t, false, err
+	}
+	if tzid := property.Params["TZID"]; tzid != "" {
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			location = tz
+		}
+	}
+	t, err = time.ParseInLocation(icalLocalFormat, value, location)
+	return t, false, err
+}
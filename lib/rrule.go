@@ -0,0 +1,377 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recurrence frequencies supported by RRule
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// maxRRulePeriods limits number of periods the rule is expanded for, so rules
+// which never match again can not hang the caller
+const maxRRulePeriods = 10000
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+var rruleUntilFormats = []string{"20060102T150405Z", "20060102T150405", "20060102"}
+
+// RRuleWeekday defines a day of week in BYDAY part of the rule. N selects only
+// n-th such day within the month or year, counting from the end if negative.
+// Zero N selects every such day
+type RRuleWeekday struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// RRule defines a subset of iCalendar (RFC 5545) recurrence rule. Supported
+// parts are FREQ, INTERVAL, BYDAY, BYMONTHDAY, COUNT and UNTIL. Weeks start on
+// Monday
+type RRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []RRuleWeekday
+	ByMonthDay []int
+	Count      int
+	Until      *time.Time
+}
+
+// ParseRRule parses recurrence rule like "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=10".
+// Optional "RRULE:" prefix is allowed
+func ParseRRule(value string) (*RRule, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return nil, errors.New("empty recurrence rule")
+	}
+
+	rule := &RRule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid recurrence rule part '%s'", part)
+		}
+		name, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		var err error
+		switch name {
+		case "FREQ":
+			if value != FreqDaily && value != FreqWeekly && value != FreqMonthly && value != FreqYearly {
+				return nil, fmt.Errorf("unsupported recurrence frequency '%s'", value)
+			}
+			rule.Freq = value
+		case "INTERVAL":
+			rule.Interval, err = parsePositiveInt(name, value)
+		case "COUNT":
+			rule.Count, err = parsePositiveInt(name, value)
+		case "UNTIL":
+			rule.Until, err = parseRRuleUntil(value)
+		case "BYDAY":
+			rule.ByDay, err = parseRRuleByDay(value)
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseRRuleByMonthDay(value)
+		case "WKST":
+			if value != "MO" {
+				err = errors.New("only weeks starting on MO are supported")
+			}
+		default:
+			err = fmt.Errorf("unsupported recurrence rule part '%s'", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, errors.New("recurrence frequency must be provided")
+	}
+	if rule.Count > 0 && rule.Until != nil {
+		return nil, errors.New("COUNT and UNTIL can not be used together")
+	}
+	for _, day := range rule.ByDay {
+		if day.N != 0 && rule.Freq != FreqMonthly && rule.Freq != FreqYearly {
+			return nil, errors.New("numbered BYDAY is allowed only for MONTHLY and YEARLY rules")
+		}
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq == FreqWeekly {
+		return nil, errors.New("BYMONTHDAY is not allowed for WEEKLY rules")
+	}
+
+	return rule, nil
+}
+
+// String returns the rule in iCalendar format
+func (r *RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, 0, len(r.ByDay))
+		for _, day := range r.ByDay {
+			name := strings.ToUpper(day.Weekday.String()[:2])
+			if day.N != 0 {
+				name = strconv.Itoa(day.N) + name
+			}
+			days = append(days, name)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, 0, len(r.ByMonthDay))
+		for _, day := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(day))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(rruleUntilFormats[0]))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Between returns at most limit occurrences of the rule within [from, to].
+// Occurrences are counted from dtstart and keep its time of day and location
+func (r *RRule) Between(dtstart, from, to time.Time, limit int) []time.Time {
+	occurrences := []time.Time{}
+	r.iterate(dtstart, func(t time.Time) bool {
+		if t.After(to) {
+			return false
+		}
+		if !t.Before(from) {
+			occurrences = append(occurrences, t)
+		}
+		return len(occurrences) < limit
+	})
+	return occurrences
+}
+
+// Next returns the first occurrence of the rule after the moment. Returns
+// false if the recurrence has ended
+func (r *RRule) Next(dtstart, after time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	r.iterate(dtstart, func(t time.Time) bool {
+		if t.After(after) {
+			next, found = t, true
+			return false
+		}
+		return true
+	})
+	return next, found
+}
+
+// iterate calls fn for every occurrence in chronological order, until fn
+// returns false or the recurrence ends. As defined by RFC 5545, dtstart is
+// always the first occurrence, even if it does not match the rule
+func (r *RRule) iterate(dtstart time.Time, fn func(time.Time) bool) {
+	if !fn(dtstart) || r.Count == 1 {
+		return
+	}
+
+	count := 1
+	for period := 0; period < maxRRulePeriods; period++ {
+		for _, t := range r.expand(dtstart, period) {
+			if !t.After(dtstart) {
+				continue
+			}
+			if r.Until != nil && t.After(*r.Until) {
+				return
+			}
+			count++
+			if !fn(t) || (r.Count > 0 && count >= r.Count) {
+				return
+			}
+		}
+	}
+}
+
+// expand returns sorted occurrences of the rule within n-th period after dtstart
+func (r *RRule) expand(dtstart time.Time, n int) []time.Time {
+	year, month, day := dtstart.Date()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), dtstart.Nanosecond(), dtstart.Location())
+	}
+	step := n * r.Interval
+
+	var days []time.Time
+	switch r.Freq {
+	case FreqDaily:
+		t := at(year, month, day+step)
+		if r.matchesWeekday(t) && r.matchesMonthDay(t) {
+			days = append(days, t)
+		}
+	case FreqWeekly:
+		monday := at(year, month, day-(int(dtstart.Weekday())+6)%7+7*step)
+		if len(r.ByDay) == 0 {
+			days = append(days, monday.AddDate(0, 0, (int(dtstart.Weekday())+6)%7))
+		}
+		for _, byDay := range r.ByDay {
+			days = append(days, monday.AddDate(0, 0, (int(byDay.Weekday)+6)%7))
+		}
+	case FreqMonthly:
+		first := at(year, month+time.Month(step), 1)
+		days = r.expandRange(first, first.AddDate(0, 1, 0), dtstart)
+	case FreqYearly:
+		if len(r.ByDay) == 0 && len(r.ByMonthDay) == 0 {
+			t := at(year+step, month, day)
+			// skip years without such date, e.g. February 29
+			if t.Day() == day {
+				days = append(days, t)
+			}
+			break
+		}
+		first := at(year+step, time.January, 1)
+		days = r.expandRange(first, first.AddDate(1, 0, 0), dtstart)
+	}
+
+	sort.Sort(timeSlice(days))
+	return days
+}
+
+// expandRange returns days within [start, end) matching BYDAY and BYMONTHDAY
+// parts. Day of month of dtstart is used if none of them is provided
+func (r *RRule) expandRange(start, end, dtstart time.Time) []time.Time {
+	days := []time.Time{}
+	byDay := map[time.Time]bool{}
+	for _, spec := range r.ByDay {
+		matches := []time.Time{}
+		for t := start; t.Before(end); t = t.AddDate(0, 0, 1) {
+			if t.Weekday() == spec.Weekday {
+				matches = append(matches, t)
+			}
+		}
+		switch {
+		case spec.N == 0:
+			for _, t := range matches {
+				byDay[t] = true
+			}
+		case spec.N > 0 && spec.N <= len(matches):
+			byDay[matches[spec.N-1]] = true
+		case spec.N < 0 && -spec.N <= len(matches):
+			byDay[matches[len(matches)+spec.N]] = true
+		}
+	}
+
+	for t := start; t.Before(end); t = t.AddDate(0, 0, 1) {
+		switch {
+		case len(r.ByDay) == 0 && len(r.ByMonthDay) == 0:
+			if t.Day() == dtstart.Day() {
+				days = append(days, t)
+			}
+		case len(r.ByDay) > 0 && !byDay[t]:
+		case len(r.ByMonthDay) > 0 && !r.matchesMonthDay(t):
+		default:
+			days = append(days, t)
+		}
+	}
+	return days
+}
+
+func (r *RRule) matchesWeekday(t time.Time) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, day := range r.ByDay {
+		if day.Weekday == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RRule) matchesMonthDay(t time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, day := range r.ByMonthDay {
+		if day == t.Day() || (day < 0 && daysInMonth+day+1 == t.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePositiveInt(name, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return n, nil
+}
+
+func parseRRuleUntil(value string) (*time.Time, error) {
+	for i, format := range rruleUntilFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			// date without time includes the whole day
+			if i == len(rruleUntilFormats)-1 {
+				t = t.Add(24*time.Hour - time.Nanosecond)
+			}
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid UNTIL '%s'", value)
+}
+
+func parseRRuleByDay(value string) ([]RRuleWeekday, error) {
+	days := []RRuleWeekday{}
+	for _, item := range strings.Split(value, ",") {
+		if len(item) < 2 {
+			return nil, fmt.Errorf("invalid BYDAY '%s'", item)
+		}
+		weekday, ok := rruleWeekdays[item[len(item)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("invalid BYDAY '%s'", item)
+		}
+
+		day := RRuleWeekday{Weekday: weekday}
+		if prefix := item[:len(item)-2]; prefix != "" {
+			n, err := strconv.Atoi(prefix)
+			if err != nil || n == 0 || n > 53 || n < -53 {
+				return nil, fmt.Errorf("invalid BYDAY '%s'", item)
+			}
+			day.N = n
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+func parseRRuleByMonthDay(value string) ([]int, error) {
+	days := []int{}
+	for _, item := range strings.Split(value, ",") {
+		day, err := strconv.Atoi(item)
+		if err != nil || day == 0 || day > 31 || day < -31 {
+			return nil, fmt.Errorf("invalid BYMONTHDAY '%s'", item)
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// timeSlice allows to sort times
+type timeSlice []time.Time
+
+func (s timeSlice) Len() int           { return len(s) }
+func (s timeSlice) Less(i, j int) bool { return s[i].Before(s[j]) }
+func (s timeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -67,6 +67,11 @@ func HMACSha256(s, k string) string {
 	return HMAC(sha256.New, s, k)
 }
 
+// Sha256 calculates Sha256 hash
+func Sha256(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
 // Sha1Bytes calculates Sha1 hash
 func Sha1Bytes(s []byte) string {
 	h := sha1.New()
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"strings"
+	"time"
+)
+
+// TodoTxtDateFormat is a format of dates in todo.txt
+const TodoTxtDateFormat = "2006-01-02"
+
+// TodoTxtExtension defines key:value pair of todo.txt item, e.g. due:2016-01-02
+type TodoTxtExtension struct {
+	Key   string
+	Value string
+}
+
+// TodoTxtItem defines a line of todo.txt file. Text is a description of the
+// item without projects, contexts and extensions. Words of the text which
+// would be read as something else, e.g. +word or key:value, are escaped with
+// a backslash in the line. Priority is a letter from A to Z or zero if not set
+type TodoTxtItem struct {
+	Completed      bool
+	Priority       byte
+	CompletionDate *time.Time
+	CreationDate   *time.Time
+	Text           string
+	Projects       []string
+	Contexts       []string
+	Extensions     []TodoTxtExtension
+}
+
+// Extension returns value of the first extension with the key
+func (i *TodoTxtItem) Extension(key string) (string, bool) {
+	for _, extension := range i.Extensions {
+		if extension.Key == key {
+			return extension.Value, true
+		}
+	}
+	return "", false
+}
+
+// String renders the item as a line of todo.txt. Projects, contexts and
+// extensions follow the text
+func (i *TodoTxtItem) String() string {
+	parts := []string{}
+	if i.Completed {
+		parts = append(parts, "x")
+		if i.CompletionDate != nil {
+			parts = append(parts, i.CompletionDate.Format(TodoTxtDateFormat))
+		}
+	} else if i.Priority != 0 {
+		parts = append(parts, "("+string(i.Priority)+")")
+	}
+	// creation date is only allowed after completion date of completed item
+	if i.CreationDate != nil && (!i.Completed || i.CompletionDate != nil) {
+		parts = append(parts, i.CreationDate.Format(TodoTxtDateFormat))
+	}
+	if i.Text != "" {
+		parts = append(parts, escapeTodoTxtText(i.Text))
+	}
+	for _, project := range i.Projects {
+		parts = append(parts, "+"+project)
+	}
+	for _, context := range i.Contexts {
+		parts = append(parts, "@"+context)
+	}
+	for _, extension := range i.Extensions {
+		parts = append(parts, extension.Key+":"+extension.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseTodoTxt parses a line of todo.txt. Priority of completed item is
+// kept in pri extension by convention
+func ParseTodoTxt(line string) TodoTxtItem {
+	item := TodoTxtItem{}
+	words := strings.Fields(line)
+
+	if len(words) > 0 && words[0] == "x" {
+		item.Completed = true
+		words = words[1:]
+		if date, ok := parseTodoTxtDate(words); ok {
+			item.CompletionDate = &date
+			words = words[1:]
+		}
+	} else if len(words) > 0 && isTodoTxtPriority(words[0]) {
+		item.Priority = words[0][1]
+		words = words[1:]
+	}
+	if date, ok := parseTodoTxtDate(words); ok {
+		item.CreationDate = &date
+		words = words[1:]
+	}
+
+	text := []string{}
+	for _, word := range words {
+		switch {
+		case len(word) > 1 && word[0] == '\\':
+			text = append(text, word[1:])
+		case len(word) > 1 && word[0] == '+':
+			item.Projects = append(item.Projects, word[1:])
+		case len(word) > 1 && word[0] == '@':
+			item.Contexts = append(item.Contexts, word[1:])
+		case isTodoTxtExtension(word):
+			parts := strings.SplitN(word, ":", 2)
+			item.Extensions = append(item.Extensions, TodoTxtExtension{Key: parts[0], Value: parts[1]})
+		default:
+			text = append(text, word)
+		}
+	}
+	item.Text = strings.Join(text, " ")
+
+	if pri, ok := item.Extension("pri"); ok && item.Priority == 0 && len(pri) == 1 && pri[0] >= 'A' && pri[0] <= 'Z' {
+		item.Priority = pri[0]
+	}
+	return item
+}
+
+func parseTodoTxtDate(words []string) (time.Time, bool) {
+	if len(words) == 0 {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(TodoTxtDateFormat, words[0])
+	return date, err == nil
+}
+
+func isTodoTxtPriority(word string) bool {
+	return len(word) == 3 && word[0] == '(' && word[2] == ')' && word[1] >= 'A' && word[1] <= 'Z'
+}
+
+// escapeTodoTxtText prefixes words which would not be read back as text with
+// a backslash: projects, contexts, extensions and, at the start of the text,
+// completion mark, priority and dates. Words starting with a backslash are
+// escaped as well
+func escapeTodoTxtText(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		escape := word[0] == '\\' || (len(word) > 1 && (word[0] == '+' || word[0] == '@')) || isTodoTxtExtension(word)
+		if i == 0 {
+			_, isDate := parseTodoTxtDate(words)
+			escape = escape || word == "x" || isTodoTxtPriority(word) || isDate
+		}
+		if escape {
+			words[i] = "\\" + word
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// isTodoTxtExtension checks if the word is key:value pair. Links, e.g.
+// http://example.com, are not extensions
+func isTodoTxtExtension(word string) bool {
+	i := strings.Index(word, ":")
+	return i > 0 && i < len(word)-1 && !strings.HasPrefix(word[i+1:], "/") && !strings.ContainsAny(word[:i], "/")
+}
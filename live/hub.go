@@ -0,0 +1,91 @@
+package live
+
+import (
+	"sync"
+
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+// subscriptionBuffer is a number of events kept for a subscriber which has not
+// received them yet
+const subscriptionBuffer = 64
+
+// Subscription receives events of a single user. Events channel is closed when
+// the subscription is dropped: either it was canceled, or the subscriber did
+// not keep up with events
+type Subscription struct {
+	UserID int64
+	Events <-chan *model.OutboxEvent
+
+	events  chan *model.OutboxEvent
+	dropped bool
+}
+
+// Dropped tells whether the subscription was dropped because its subscriber was
+// too slow. It must be checked only after Events channel is closed
+func (s *Subscription) Dropped() bool {
+	return s.dropped
+}
+
+// Hub passes events to clients connected to this instance of the application.
+// Publishing never blocks: subscription which buffer is full is dropped, so a
+// slow client does not delay anybody else
+type Hub struct {
+	mu            sync.Mutex
+	subscriptions map[int64]map[*Subscription]bool
+}
+
+// NewHub creates hub without subscriptions
+func NewHub() *Hub {
+	return &Hub{subscriptions: map[int64]map[*Subscription]bool{}}
+}
+
+// Subscribe creates subscription to events of the user
+func (h *Hub) Subscribe(userID int64) *Subscription {
+	events := make(chan *model.OutboxEvent, subscriptionBuffer)
+	s := &Subscription{UserID: userID, Events: events, events: events}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscriptions[userID] == nil {
+		h.subscriptions[userID] = map[*Subscription]bool{}
+	}
+	h.subscriptions[userID][s] = true
+	return s
+}
+
+// Cancel removes the subscription. Canceling dropped subscription does nothing
+func (h *Hub) Cancel(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// Publish passes the event to subscriptions of its user
+func (h *Hub) Publish(event *model.OutboxEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subscriptions[event.UserID] {
+		select {
+		case s.events <- event:
+		default:
+			s.dropped = true
+			h.remove(s)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) remove(s *Subscription) {
+	subscriptions := h.subscriptions[s.UserID]
+	if !subscriptions[s] {
+		return
+	}
+
+	delete(subscriptions, s)
+	if len(subscriptions) == 0 {
+		delete(h.subscriptions, s.UserID)
+	}
+	close(s.events)
+}
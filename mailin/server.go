@@ -0,0 +1,415 @@
+package mailin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultMaxSize is used when maximum size of a message is not configured
+const DefaultMaxSize = 25 << 20
+
+// commandTimeout is a period client must send the next command within
+const commandTimeout = 5 * time.Minute
+
+// maxRecipients limits number of recipients of a single message
+const maxRecipients = 100
+
+// maxCommandLength limits length of a command line including CRLF, as
+// RFC 5321 does
+const maxCommandLength = 512
+
+var errLineTooLong = errors.New("line too long")
+
+// maxSessions limits number of sessions served at once. Clients connected
+// above the limit are asked to try again later
+const maxSessions = 100
+
+// Message defines a message received from a client. From and To are addresses
+// of the envelope, Data is the message as it was sent
+type Message struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// Handler decides which recipients exist and accepts received messages.
+// Returned *Error is reported to the client with its code, other errors are
+// reported as temporary failures, so the client retries later
+type Handler interface {
+	Recipient(address string) error
+	Deliver(message *Message) error
+}
+
+// Error defines a reply which rejects a command
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return strconv.Itoa(e.Code) + " " + e.Message
+}
+
+// Server receives messages over SMTP and passes them to the handler. It is
+// meant to be the final destination of messages: it does not relay, and does
+// not support TLS or authentication. Allowed senders are addresses or
+// domains, checked against sender of the envelope. Empty list allows any
+// sender
+type Server struct {
+	domain         string
+	maxSize        int64
+	allowedSenders []string
+	handler        Handler
+	logger         *logrus.Logger
+	sessions       chan struct{}
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// NewServer creates server which introduces itself with the domain. Default
+// maximum size of a message is 25 MiB
+func NewServer(domain string, maxSize int64, allowedSenders []string, handler Handler, logger *logrus.Logger) *Server {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	return &Server{
+		domain:         domain,
+		maxSize:        maxSize,
+		allowedSenders: allowedSenders,
+		handler:        handler,
+		logger:         logger,
+		sessions:       make(chan struct{}, maxSessions),
+	}
+}
+
+// ListenAndServe accepts connections on the address until the server is
+// closed
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		select {
+		case s.sessions <- struct{}{}:
+			go func() {
+				defer func() { <-s.sessions }()
+				s.serveConn(conn)
+			}()
+		default:
+			go s.rejectConn(conn)
+		}
+	}
+}
+
+// Close stops accepting connections. Sessions in progress are not
+// interrupted
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// rejectConn tells the client the server is busy and closes the connection
+func (s *Server) rejectConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	fmt.Fprintf(conn, "421 %s 4.3.2 too many connections, try again later\r\n", s.domain)
+}
+
+// session keeps state of a single connection. Commands are read from the
+// buffered reader directly, so their length can be limited, and message data
+// is read through textproto
+type session struct {
+	server *Server
+	reader *bufio.Reader
+	writer *bufio.Writer
+	text   *textproto.Reader
+	helo   string
+	from   string
+	to     []string
+	// hasFrom distinguishes null sender of bounces from missing MAIL command
+	hasFrom bool
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	sess := &session{
+		server: s,
+		reader: reader,
+		writer: bufio.NewWriter(conn),
+		text:   textproto.NewReader(reader),
+	}
+
+	sess.reply(220, s.domain+" ESMTP ready")
+	for {
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+		line, err := sess.readCommand()
+		if err == errLineTooLong {
+			sess.reply(500, "5.5.6 line too long")
+			return
+		} else if err != nil {
+			return
+		}
+
+		command, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			command, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if quit := sess.handle(strings.ToUpper(command), arg); quit {
+			return
+		}
+	}
+}
+
+// readCommand reads a command line without CRLF. Line longer than
+// maxCommandLength is not read till its end
+func (sess *session) readCommand() (string, error) {
+	line := []byte{}
+	for {
+		chunk, err := sess.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxCommandLength {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// handle runs the command and tells whether the session is over
+func (sess *session) handle(command, arg string) bool {
+	switch command {
+	case "HELO", "EHLO":
+		if arg == "" {
+			sess.reply(501, "5.5.4 domain must be provided")
+			return false
+		}
+		sess.reset()
+		sess.helo = arg
+		if command == "HELO" {
+			sess.reply(250, sess.server.domain)
+		} else {
+			sess.reply(250, sess.server.domain, "SIZE "+strconv.FormatInt(sess.server.maxSize, 10), "8BITMIME", "PIPELINING")
+		}
+	case "MAIL":
+		sess.mail(arg)
+	case "RCPT":
+		sess.rcpt(arg)
+	case "DATA":
+		sess.data()
+	case "RSET":
+		sess.reset()
+		sess.reply(250, "2.0.0 OK")
+	case "NOOP":
+		sess.reply(250, "2.0.0 OK")
+	case "VRFY":
+		sess.reply(252, "2.5.0 cannot verify user")
+	case "QUIT":
+		sess.reply(221, "2.0.0 bye")
+		return true
+	default:
+		sess.reply(502, "5.5.1 command not implemented")
+	}
+	return false
+}
+
+func (sess *session) mail(arg string) {
+	if sess.helo == "" {
+		sess.reply(503, "5.5.1 send HELO first")
+		return
+	}
+	if sess.hasFrom {
+		sess.reply(503, "5.5.1 sender already specified")
+		return
+	}
+	address, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		sess.reply(501, "5.5.4 syntax: MAIL FROM:<address>")
+		return
+	}
+	if size, err := strconv.ParseInt(params["SIZE"], 10, 64); err == nil && size > sess.server.maxSize {
+		sess.reply(552, "5.3.4 message is too large")
+		return
+	}
+	// bounces are never turned into tasks
+	if address == "" || !sess.server.senderAllowed(address) {
+		sess.reply(550, "5.7.1 sender is not allowed")
+		return
+	}
+
+	sess.from = address
+	sess.hasFrom = true
+	sess.reply(250, "2.1.0 OK")
+}
+
+func (sess *session) rcpt(arg string) {
+	if !sess.hasFrom {
+		sess.reply(503, "5.5.1 send MAIL first")
+		return
+	}
+	address, _, ok := parsePath(arg, "TO:")
+	if !ok || address == "" {
+		sess.reply(501, "5.5.4 syntax: RCPT TO:<address>")
+		return
+	}
+	if len(sess.to) >= maxRecipients {
+		sess.reply(452, "4.5.3 too many recipients")
+		return
+	}
+	if err := sess.server.handler.Recipient(address); err != nil {
+		sess.replyError(err)
+		return
+	}
+
+	sess.to = append(sess.to, address)
+	sess.reply(250, "2.1.5 OK")
+}
+
+// data reads the message. Message larger than the limit is read till its
+// end, so the session can go on, and rejected
+func (sess *session) data() {
+	if len(sess.to) == 0 {
+		sess.reply(503, "5.5.1 send RCPT first")
+		return
+	}
+	sess.reply(354, "end data with <CR><LF>.<CR><LF>")
+
+	reader := sess.text.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, sess.server.maxSize+1))
+	if err != nil {
+		return
+	}
+	if int64(len(data)) > sess.server.maxSize {
+		io.Copy(ioutil.Discard, reader)
+		sess.reset()
+		sess.reply(552, "5.3.4 message is too large")
+		return
+	}
+
+	message := &Message{From: sess.from, To: sess.to, Data: data}
+	sess.reset()
+	if err := sess.server.handler.Deliver(message); err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.reply(250, "2.0.0 OK")
+}
+
+func (sess *session) reset() {
+	sess.from = ""
+	sess.hasFrom = false
+	sess.to = nil
+}
+
+// replyError reports error of the handler. Unexpected errors are logged and
+// reported as temporary
+func (sess *session) replyError(err error) {
+	if e, ok := err.(*Error); ok {
+		sess.reply(e.Code, e.Message)
+		return
+	}
+	sess.server.logger.Errorf("could not receive mail: %s", err.Error())
+	sess.reply(451, "4.3.0 temporary failure, try again later")
+}
+
+// reply writes the reply. Several lines are written as multiline reply
+func (sess *session) reply(code int, lines ...string) {
+	for i, line := range lines {
+		separator := " "
+		if i < len(lines)-1 {
+			separator = "-"
+		}
+		fmt.Fprintf(sess.writer, "%d%s%s\r\n", code, separator, line)
+	}
+	sess.writer.Flush()
+}
+
+// senderAllowed checks the address against allowed senders. Entry without
+// local part, e.g. example.com or @example.com, allows the whole domain
+func (s *Server) senderAllowed(address string) bool {
+	if len(s.allowedSenders) == 0 {
+		return true
+	}
+
+	address = strings.ToLower(address)
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, allowed := range s.allowedSenders {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if strings.Contains(strings.TrimPrefix(allowed, "@"), "@") {
+			if allowed == address {
+				return true
+			}
+		} else if strings.TrimPrefix(allowed, "@") == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePath parses argument of MAIL and RCPT commands: the prefix, address in
+// angle brackets and optional params. Empty address is the null sender
+func parsePath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	end := strings.IndexByte(arg, '>')
+	if !strings.HasPrefix(arg, "<") || end < 0 {
+		return "", nil, false
+	}
+
+	address := arg[1:end]
+	// source routes are obsolete, only the mailbox is kept
+	if i := strings.IndexByte(address, ':'); i >= 0 && strings.HasPrefix(address, "@") {
+		address = address[i+1:]
+	}
+	params := map[string]string{}
+	for _, param := range strings.Fields(arg[end+1:]) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) == 2 {
+			params[strings.ToUpper(parts[0])] = parts[1]
+		} else {
+			params[strings.ToUpper(parts[0])] = ""
+		}
+	}
+	return address, params, true
+}
@@ -0,0 +1,223 @@
+package mailin
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// testHandler accepts recipients at example.com and keeps delivered messages
+type testHandler struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func (h *testHandler) Recipient(address string) error {
+	if !strings.HasSuffix(address, "@example.com") {
+		return &Error{Code: 550, Message: "5.1.1 mailbox unavailable"}
+	}
+	return nil
+}
+
+func (h *testHandler) Deliver(message *Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, message)
+	return nil
+}
+
+func (h *testHandler) delivered() []*Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.messages
+}
+
+func newTestServer(maxSize int64, allowedSenders []string, handler Handler) *Server {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return NewServer("example.com", maxSize, allowedSenders, handler, logger)
+}
+
+// startTestServer serves SMTP on a random local port. The returned function
+// stops the server
+func startTestServer(t *testing.T, s *Server) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(done)
+	}()
+	return l.Addr().String(), func() {
+		s.Close()
+		<-done
+	}
+}
+
+// replyCode returns code of the reply the error is made of
+func replyCode(err error) int {
+	if e, ok := err.(*textproto.Error); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestServerAcceptsAllowedSender(t *testing.T) {
+	handler := &testHandler{}
+	addr, stop := startTestServer(t, newTestServer(0, []string{"@allowed.com", "someone@other.com"}, handler))
+	defer stop()
+
+	message := "Subject: Hello\r\n\r\nBody\r\n"
+	if err := smtp.SendMail(addr, nil, "sender@allowed.com", []string{"token@example.com"}, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(addr, nil, "Someone@Other.com", []string{"token@example.com"}, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := handler.delivered()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].From != "sender@allowed.com" || len(messages[0].To) != 1 || messages[0].To[0] != "token@example.com" {
+		t.Fatalf("unexpected envelope: %s %v", messages[0].From, messages[0].To)
+	}
+	if !strings.Contains(string(messages[0].Data), "Subject: Hello") {
+		t.Fatalf("unexpected data: %q", messages[0].Data)
+	}
+}
+
+func TestServerRejectsBlockedSender(t *testing.T) {
+	handler := &testHandler{}
+	addr, stop := startTestServer(t, newTestServer(0, []string{"@allowed.com"}, handler))
+	defer stop()
+
+	err := smtp.SendMail(addr, nil, "sender@blocked.com", []string{"token@example.com"}, []byte("Subject: Hello\r\n\r\nBody\r\n"))
+	if replyCode(err) != 550 {
+		t.Fatalf("expected reply 550, got %v", err)
+	}
+	err = smtp.SendMail(addr, nil, "sender@allowed.com", []string{"token@elsewhere.com"}, []byte("Subject: Hello\r\n\r\nBody\r\n"))
+	if replyCode(err) != 550 {
+		t.Fatalf("expected reply 550 for unknown recipient, got %v", err)
+	}
+	if n := len(handler.delivered()); n != 0 {
+		t.Fatalf("expected no messages, got %d", n)
+	}
+}
+
+func TestServerRejectsOversizeMessage(t *testing.T) {
+	handler := &testHandler{}
+	addr, stop := startTestServer(t, newTestServer(100, nil, handler))
+	defer stop()
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("token@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: Large\r\n\r\n" + strings.Repeat("x", 200) + "\r\n"))
+	if err := w.Close(); replyCode(err) != 552 {
+		t.Fatalf("expected reply 552, got %v", err)
+	}
+
+	// session goes on after rejected message
+	if err := client.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("token@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err = client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: Small\r\n\r\nBody\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(handler.delivered()); n != 1 {
+		t.Fatalf("expected 1 message, got %d", n)
+	}
+}
+
+func TestServerLimitsSessions(t *testing.T) {
+	s := newTestServer(0, nil, &testHandler{})
+	s.sessions = make(chan struct{}, 1)
+	addr, stop := startTestServer(t, s)
+	defer stop()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	line, err := bufio.NewReader(first).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("expected greeting, got %q (%v)", line, err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	line, err = bufio.NewReader(second).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "421 ") {
+		t.Fatalf("expected busy reply, got %q (%v)", line, err)
+	}
+}
+
+func TestServerRejectsLongCommandLine(t *testing.T) {
+	addr, stop := startTestServer(t, newTestServer(0, nil, &testHandler{}))
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	// the longest allowed line is still served
+	if err := text.PrintfLine("NOOP %s", strings.Repeat("x", maxCommandLength-len("NOOP \r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := text.PrintfLine("NOOP %s", strings.Repeat("x", 100000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(500); err != nil {
+		t.Fatalf("expected reply 500, got %v", err)
+	}
+	if _, err := text.ReadLine(); err == nil {
+		t.Fatalf("connection must be closed")
+	}
+}
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// Attachment defines a file attached to a task. Content of the file is kept in
+// a blob storage under StorageKey
+type Attachment struct {
+	Id          int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	UserID      int64      `sql:"index" json:"-"`
+	TaskID      int64      `sql:"index" json:"task_id"`
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type"`
+	SHA256      string     `gorm:"column:sha256" json:"sha256"`
+	StorageKey  string     `json:"-"`
+	CreatedAt   *time.Time `json:"created_at"`
+}
+
+// BeforeSave sets creation time of the attachment
+func (a *Attachment) BeforeSave() error {
+	if a.CreatedAt == nil {
+		now := time.Now()
+		a.CreatedAt = &now
+	}
+	return nil
+}
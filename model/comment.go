@@ -0,0 +1,62 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// MaxCommentLength limits length of a comment body
+const MaxCommentLength = 10000
+
+// Comment defines a message in discussion of a task. Body is kept in markdown
+// as it was written, rendering is up to clients. Previous versions of edited
+// comment are kept as revisions
+type Comment struct {
+	Id        int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	TaskID    int64      `sql:"index" json:"task_id"`
+	AuthorID  int64      `sql:"index" json:"author_id"`
+	Body      string     `sql:"type:text" json:"body"`
+	EditedAt  *time.Time `json:"edited_at"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// Validate checks that comment is not empty and not too long
+func (c Comment) Validate() error {
+	if strings.TrimSpace(c.Body) == "" {
+		return errors.New("comment body must be provided")
+	}
+	if len(c.Body) > MaxCommentLength {
+		return errors.New("comment body is too long")
+	}
+	return nil
+}
+
+// BeforeSave sets timestamps of the comment
+func (c *Comment) BeforeSave() error {
+	now := time.Now()
+	if c.CreatedAt == nil {
+		c.CreatedAt = &now
+	}
+	c.UpdatedAt = &now
+	return nil
+}
+
+// CommentRevision keeps body of a comment before it was edited
+type CommentRevision struct {
+	Id        int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	CommentID int64      `sql:"index" json:"comment_id"`
+	EditorID  int64      `json:"editor_id"`
+	Body      string     `sql:"type:text" json:"body"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+// BeforeSave sets creation time of the revision
+func (r *CommentRevision) BeforeSave() error {
+	if r.CreatedAt == nil {
+		now := time.Now()
+		r.CreatedAt = &now
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// TaskDependency defines that the task can not be completed until the
+// blocking task is completed
+type TaskDependency struct {
+	Id          int64 `gorm:"primary_key" sql:"AUTO_INCREMENT"`
+	UserID      int64 `sql:"index"`
+	TaskID      int64 `sql:"index"`
+	BlockedByID int64 `sql:"index"`
+	CreatedAt   *time.Time
+}
+
+// BeforeSave sets creation time of the dependency
+func (d *TaskDependency) BeforeSave() error {
+	if d.CreatedAt == nil {
+		now := time.Now()
+		d.CreatedAt = &now
+	}
+	return nil
+}
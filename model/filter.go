@@ -0,0 +1,272 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// task statuses which can be used in filters
+const (
+	TaskStatusOpen      = "open"
+	TaskStatusCompleted = "completed"
+)
+
+// due date ranges which can be used in filters
+const (
+	DueOverdue  = "overdue"
+	DueToday    = "today"
+	DueThisWeek = "week"
+)
+
+// modes of filtering by tags
+const (
+	TagModeAny = "any"
+	TagModeAll = "all"
+)
+
+// taskOrder defines sorting of tasks by some column. Id is always used as a
+// tie-breaker, so any order is stable and can be paginated with a cursor
+type taskOrder struct {
+	column string
+	desc   bool
+}
+
+// taskOrders maps public order names to task orders
+var taskOrders = map[string]taskOrder{
+	"":            {"id", false},
+	"priority":    {"priority", true},
+	"-priority":   {"priority", false},
+	"created_at":  {"created_at", false},
+	"-created_at": {"created_at", true},
+	"updated_at":  {"updated_at", false},
+	"-updated_at": {"updated_at", true},
+	"due_at":      {"due_at", false},
+	"-due_at":     {"due_at", true},
+}
+
+func (o taskOrder) clause() string {
+	if o.column == "id" {
+		return "id" + o.direction()
+	}
+	return o.column + o.direction() + ", id" + o.direction()
+}
+
+func (o taskOrder) direction() string {
+	if o.desc {
+		return " desc"
+	}
+	return ""
+}
+
+func (o taskOrder) comparison() string {
+	if o.desc {
+		return "<"
+	}
+	return ">"
+}
+
+// TaskFilter defines criteria to select tasks. It is used both for ad-hoc
+// listing and for filters saved by users. Due date ranges are calculated in
+// the location of the filter, which is not saved and should be set to the
+// timezone of the user before applying the filter
+type TaskFilter struct {
+	ProjectID   *int64  `json:"project_id,omitempty"`
+	Status      string  `json:"status,omitempty"`
+	MinPriority *int    `json:"min_priority,omitempty"`
+	MaxPriority *int    `json:"max_priority,omitempty"`
+	Search      string  `json:"search,omitempty"`
+	Tags        []int64 `json:"tags,omitempty"`
+	TagMode     string  `json:"tag_mode,omitempty"`
+	Due         string  `json:"due,omitempty"`
+	OrderBy     string  `json:"order_by,omitempty"`
+
+	Location *time.Location `json:"-"`
+}
+
+// Validate checks that filter contains only known values
+func (f TaskFilter) Validate() error {
+	if f.Status != "" && f.Status != TaskStatusOpen && f.Status != TaskStatusCompleted {
+		return errors.New("status must be either 'open' or 'completed'")
+	}
+	if _, ok := taskOrders[f.OrderBy]; !ok {
+		return errors.New("unknown order: " + f.OrderBy)
+	}
+	if f.Due != "" && f.Due != DueOverdue && f.Due != DueToday && f.Due != DueThisWeek {
+		return errors.New("due must be one of 'overdue', 'today' or 'week'")
+	}
+	if f.TagMode != "" && f.TagMode != TagModeAny && f.TagMode != TagModeAll {
+		return errors.New("tag_mode must be either 'any' or 'all'")
+	}
+	if f.MinPriority != nil && f.MaxPriority != nil && *f.MinPriority > *f.MaxPriority {
+		return errors.New("min_priority can not be greater than max_priority")
+	}
+	return nil
+}
+
+// Scope applies filter conditions to the query. Should be used with
+// gorm.DB.Scopes
+func (f TaskFilter) Scope(db *gorm.DB) *gorm.DB {
+	db = db.Where("is_deleted = ?", false)
+
+	if f.ProjectID != nil {
+		db = db.Where("project_id = ?", *f.ProjectID)
+	}
+
+	switch f.Status {
+	case TaskStatusOpen:
+		db = db.Where("is_completed = ?", false)
+	case TaskStatusCompleted:
+		db = db.Where("is_completed = ?", true)
+	}
+	if f.MinPriority != nil {
+		db = db.Where("priority >= ?", *f.MinPriority)
+	}
+	if f.MaxPriority != nil {
+		db = db.Where("priority <= ?", *f.MaxPriority)
+	}
+	if f.Search != "" {
+		pattern := "%" + strings.ToLower(f.Search) + "%"
+		db = db.Where("lower(title) like ? or lower(description) like ?", pattern, pattern)
+	}
+	if len(f.Tags) > 0 && f.TagMode == TagModeAll {
+		db = db.Where("id in (select task_id from task_tags where tag_id in (?) group by task_id having count(distinct tag_id) = ?)",
+			f.Tags, len(uniqueIDs(f.Tags)))
+	} else if len(f.Tags) > 0 {
+		db = db.Where("id in (select task_id from task_tags where tag_id in (?))", f.Tags)
+	}
+	if f.Due != "" {
+		db = f.dueScope(db, time.Now())
+	}
+
+	return db.Order(taskOrders[f.OrderBy].clause())
+}
+
+// dueScope selects tasks due in the range of the filter. Timed tasks are
+// compared by the moment, all-day tasks are compared by the calendar date in
+// location of the filter
+func (f TaskFilter) dueScope(db *gorm.DB, now time.Time) *gorm.DB {
+	location := f.Location
+	if location == nil {
+		location = time.UTC
+	}
+	now = now.In(location)
+	year, month, day := now.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, location)
+	todayDate := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+
+	if f.Due == DueOverdue {
+		return db.Where("is_completed = ? and due_at is not null and "+
+			"((is_all_day = ? and due_at < ?) or (is_all_day = ? and due_at < ?))",
+			false, false, now, true, todayDate)
+	}
+
+	days := 1
+	if f.Due == DueThisWeek {
+		// week ends on Sunday
+		days = 7 - (int(now.Weekday())+6)%7
+	}
+	return db.Where("(is_all_day = ? and due_at >= ? and due_at < ?) or (is_all_day = ? and due_at >= ? and due_at < ?)",
+		false, today, today.AddDate(0, 0, days), true, todayDate, todayDate.AddDate(0, 0, days))
+}
+
+func uniqueIDs(ids []int64) map[int64]bool {
+	unique := map[int64]bool{}
+	for _, id := range ids {
+		unique[id] = true
+	}
+	return unique
+}
+
+// TaskCursor points to the last task of a page. It allows to continue listing
+// right after that task regardless of inserts and deletes made meanwhile
+type TaskCursor struct {
+	OrderBy  string     `json:"o,omitempty"`
+	ID       int64      `json:"id"`
+	Priority int        `json:"p,omitempty"`
+	Time     *time.Time `json:"t,omitempty"`
+}
+
+// NewTaskCursor creates cursor pointing to the task listed with the filter
+func NewTaskCursor(f TaskFilter, task Task) TaskCursor {
+	cursor := TaskCursor{OrderBy: f.OrderBy, ID: task.Id}
+	switch taskOrders[f.OrderBy].column {
+	case "priority":
+		cursor.Priority = task.Priority
+	case "created_at":
+		cursor.Time = task.CreatedAt
+	case "updated_at":
+		cursor.Time = task.UpdatedAt
+	case "due_at":
+		cursor.Time = task.DueAt
+	}
+	return cursor
+}
+
+// AfterScope returns scope which selects tasks following the cursor in order
+// of the filter. Should be used with gorm.DB.Scopes
+func (f TaskFilter) AfterScope(cursor TaskCursor) (func(*gorm.DB) *gorm.DB, error) {
+	if cursor.OrderBy != f.OrderBy {
+		return nil, errors.New("cursor was issued for another order")
+	}
+
+	order := taskOrders[f.OrderBy]
+	cmp := order.comparison()
+	return func(db *gorm.DB) *gorm.DB {
+		switch order.column {
+		case "id":
+			return db.Where("id "+cmp+" ?", cursor.ID)
+		case "priority":
+			return db.Where("priority "+cmp+" ? or (priority = ? and id "+cmp+" ?)",
+				cursor.Priority, cursor.Priority, cursor.ID)
+		default:
+			// tasks saved before timestamps were filled have null values,
+			// which go first in ascending order
+			if cursor.Time == nil && order.desc {
+				return db.Where(order.column+" is null and id < ?", cursor.ID)
+			} else if cursor.Time == nil {
+				return db.Where(order.column+" is not null or id > ?", cursor.ID)
+			}
+			condition := order.column + " " + cmp + " ? or (" + order.column + " = ? and id " + cmp + " ?)"
+			if order.desc {
+				condition += " or " + order.column + " is null"
+			}
+			return db.Where(condition, *cursor.Time, *cursor.Time, cursor.ID)
+		}
+	}, nil
+}
+
+// SavedFilter defines a named task filter, e.g. "High priority open".
+// System filters are shared between all users and can not be modified
+type SavedFilter struct {
+	Id        int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	UserID    int64      `sql:"index" json:"-"`
+	Name      string     `json:"name"`
+	Query     string     `sql:"type:text" json:"-"`
+	Filter    TaskFilter `sql:"-" json:"filter"`
+	IsSystem  bool       `json:"is_system"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// BeforeSave serializes filter criteria to be stored in the database
+func (f *SavedFilter) BeforeSave() error {
+	content, err := json.Marshal(f.Filter)
+	if err != nil {
+		return err
+	}
+	f.Query = string(content)
+	return nil
+}
+
+// AfterFind restores filter criteria from the database
+func (f *SavedFilter) AfterFind() error {
+	f.Filter = TaskFilter{}
+	if f.Query == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(f.Query), &f.Filter)
+}
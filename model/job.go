@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// job run statuses
+const (
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusTimeout   = "timeout"
+)
+
+// Job keeps state of a background job shared by all instances of the
+// application. Instance runs the job only while it holds the lock, which
+// expires by itself if the instance dies
+type Job struct {
+	Id           int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"-"`
+	Name         string     `sql:"unique_index" json:"name"`
+	Schedule     string     `json:"schedule"`
+	Timeout      int64      `json:"timeout_ms"`
+	NextRunAt    *time.Time `json:"next_run_at"`
+	LastRunAt    *time.Time `json:"last_run_at"`
+	LastStatus   string     `json:"last_status"`
+	LastError    string     `json:"last_error"`
+	LastDuration int64      `json:"last_duration_ms"`
+	RunCount     int64      `json:"run_count"`
+	FailureCount int64      `json:"failure_count"`
+	LockedBy     string     `json:"locked_by"`
+	LockedUntil  *time.Time `json:"locked_until"`
+}
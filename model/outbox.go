@@ -0,0 +1,75 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// types of domain events published through the outbox
+const (
+	EventTaskCreated   = "task.created"
+	EventTaskUpdated   = "task.updated"
+	EventTaskCompleted = "task.completed"
+	EventTaskDeleted   = "task.deleted"
+	EventTaskRestored  = "task.restored"
+)
+
+// EventPayload defines content of a domain event
+type EventPayload struct {
+	Event      string       `json:"event"`
+	OccurredAt time.Time    `json:"occurred_at"`
+	Task       *Task        `json:"task,omitempty"`
+	Changes    []TaskChange `json:"changes,omitempty"`
+}
+
+// OutboxEvent is a domain event written in the same transaction as the change
+// it describes. Ids of events grow monotonically, so they define the order of
+// publishing
+type OutboxEvent struct {
+	Id        int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	UserID    int64      `sql:"index" json:"-"`
+	TaskID    int64      `json:"task_id"`
+	Type      string     `json:"type"`
+	Payload   string     `sql:"type:text" json:"-"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+// TableName returns name of the outbox table
+func (OutboxEvent) TableName() string {
+	return "outbox"
+}
+
+// NewOutboxEvent creates event of the user with serialized payload
+func NewOutboxEvent(userID int64, payload EventPayload) (*OutboxEvent, error) {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &OutboxEvent{UserID: userID, Type: payload.Event, Payload: string(content)}
+	if payload.Task != nil {
+		event.TaskID = payload.Task.Id
+	}
+	return event, nil
+}
+
+// BeforeSave sets timestamp of the event
+func (e *OutboxEvent) BeforeSave() error {
+	if e.CreatedAt == nil {
+		now := time.Now()
+		e.CreatedAt = &now
+	}
+	return nil
+}
+
+// OutboxOffset keeps id of the last event handled by the subscriber. Instance
+// of the application publishes events to the subscriber only while it holds
+// the lock, which expires by itself if the instance dies
+type OutboxOffset struct {
+	Id          int64  `gorm:"primary_key" sql:"AUTO_INCREMENT"`
+	Subscriber  string `sql:"unique_index"`
+	Position    int64  `gorm:"column:position"`
+	LockedBy    string
+	LockedUntil *time.Time
+	UpdatedAt   *time.Time
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// InboxProjectName is a name of the project which collects tasks of deleted
+// projects
+const InboxProjectName = "Inbox"
+
+// Project defines a list which groups user's tasks
+type Project struct {
+	Id         int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	UserID     int64      `sql:"index" json:"-"`
+	Name       string     `json:"name"`
+	Color      string     `json:"color"`
+	Position   int        `json:"position"`
+	IsArchived bool       `json:"is_archived"`
+	IsInbox    bool       `json:"is_inbox"`
+	CreatedAt  *time.Time `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+}
+
+// Validate checks that project has a name and a color in #rrggbb format
+func (p Project) Validate() error {
+	if p.Name == "" {
+		return errors.New("project name must be provided")
+	}
+	if p.Color != "" && !colorRegexp.MatchString(p.Color) {
+		return errors.New("project color must be in #rrggbb format")
+	}
+	return nil
+}
+
+// BeforeSave sets timestamps of the project
+func (p *Project) BeforeSave() error {
+	now := time.Now()
+	if p.CreatedAt == nil {
+		p.CreatedAt = &now
+	}
+	p.UpdatedAt = &now
+	return nil
+}
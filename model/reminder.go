@@ -0,0 +1,95 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// channels reminders can be delivered through
+const (
+	ReminderChannelLog     = "log"
+	ReminderChannelEmail   = "email"
+	ReminderChannelWebhook = "webhook"
+)
+
+// reminder statuses
+const (
+	ReminderPending  = "pending"
+	ReminderSent     = "sent"
+	ReminderFailed   = "failed"
+	ReminderCanceled = "canceled"
+)
+
+// Reminder defines a notification about a task. Reminder fires either at
+// absolute time or some minutes before the task is due. NotifyAt keeps the
+// time of the next delivery attempt, so scheduled reminders survive restarts
+type Reminder struct {
+	Id        int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	UserID    int64      `sql:"index" json:"-"`
+	TaskID    int64      `sql:"index" json:"task_id"`
+	Channel   string     `json:"channel"`
+	RemindAt  *time.Time `json:"remind_at"`
+	BeforeDue int        `json:"before_due"`
+	NotifyAt  *time.Time `sql:"index" json:"notify_at"`
+	Status    string     `sql:"index" json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error"`
+	SentAt    *time.Time `json:"sent_at"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// Validate checks that the reminder fires either at absolute time or before
+// the task is due
+func (r Reminder) Validate() error {
+	if r.Channel == "" {
+		return errors.New("reminder channel must be provided")
+	}
+	if r.RemindAt != nil && r.BeforeDue != 0 {
+		return errors.New("either remind_at or before_due must be provided, not both")
+	}
+	if r.BeforeDue < 0 {
+		return errors.New("before_due must not be negative")
+	}
+	return nil
+}
+
+// Schedule calculates time of the first delivery attempt for the moment the
+// task is due, see Task.DueTime. Reminder relative to due date of a task
+// without one is canceled
+func (r *Reminder) Schedule(dueAt *time.Time) {
+	r.Status = ReminderPending
+	r.Attempts = 0
+	r.LastError = ""
+	switch {
+	case r.RemindAt != nil:
+		notifyAt := *r.RemindAt
+		r.NotifyAt = &notifyAt
+	case dueAt != nil:
+		notifyAt := dueAt.Add(-time.Duration(r.BeforeDue) * time.Minute)
+		r.NotifyAt = &notifyAt
+	default:
+		r.NotifyAt = nil
+		r.Status = ReminderCanceled
+	}
+}
+
+// BeforeSave sets timestamps of the reminder
+func (r *Reminder) BeforeSave() error {
+	now := time.Now()
+	if r.CreatedAt == nil {
+		r.CreatedAt = &now
+	}
+	r.UpdatedAt = &now
+	return nil
+}
+
+// ReminderDelivery records a single attempt to deliver a reminder
+type ReminderDelivery struct {
+	Id          int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	ReminderID  int64      `sql:"index" json:"reminder_id"`
+	Channel     string     `json:"channel"`
+	IsSuccess   bool       `json:"is_success"`
+	Error       string     `json:"error"`
+	AttemptedAt *time.Time `json:"attempted_at"`
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+var colorRegexp = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// Tag defines a label which user can put on tasks to categorize them
+type Tag struct {
+	Id        int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	UserID    int64      `sql:"index" json:"-"`
+	Name      string     `json:"name"`
+	Color     string     `json:"color"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// Validate checks that tag has a name and a color in #rrggbb format
+func (t Tag) Validate() error {
+	if t.Name == "" {
+		return errors.New("tag name must be provided")
+	}
+	if t.Color != "" && !colorRegexp.MatchString(t.Color) {
+		return errors.New("tag color must be in #rrggbb format")
+	}
+	return nil
+}
+
+// BeforeSave sets timestamps of the tag
+func (t *Tag) BeforeSave() error {
+	now := time.Now()
+	if t.CreatedAt == nil {
+		t.CreatedAt = &now
+	}
+	t.UpdatedAt = &now
+	return nil
+}
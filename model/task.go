@@ -2,15 +2,78 @@ package model
 
 import "time"
 
-// Task defines some todo-task to keep in our database
+// Task defines some todo-task to keep in our database. Task can be a subtask
+// of another one. Task with AutoComplete flag is completed as soon as all its
+// subtasks are completed. Task is blocked while any of tasks it depends on
+// is open. Dates of all-day tasks do not depend on timezone: they are stored
+// as midnight UTC and interpreted in timezone of the user. Recurring task keeps
+// its recurrence rule only while open: completing it creates the next
+// occurrence, which takes the rule over. Version grows with every save of the
+// task. External id identifies the task in another system it was imported
+// from, e.g. UID of iCalendar component. Resource name is a name CalDAV
+// client stored the task under, kept only when it differs from the UID
 type Task struct {
-	Id          int64 `gorm:"primary_key",sql:"AUTO_INCREMENT"`
-	Title       string
-	Description string
-	Priority    int
-	CreatedAt   *time.Time
-	UpdatedAt   *time.Time
-	CompletedAt *time.Time
-	IsDeleted   bool
-	IsCompleted bool
+	Id           int64 `gorm:"primary_key" sql:"AUTO_INCREMENT"`
+	UserID       int64 `sql:"index"`
+	ProjectID    int64 `sql:"index"`
+	ParentID     int64 `sql:"index"`
+	Title        string
+	Description  string
+	Priority     int
+	CreatedAt    *time.Time
+	UpdatedAt    *time.Time
+	CompletedAt  *time.Time
+	StartAt      *time.Time
+	DueAt        *time.Time `sql:"index"`
+	IsAllDay     bool
+	RRule        string `gorm:"column:rrule"`
+	SeriesStart  *time.Time
+	IsDeleted    bool
+	IsCompleted  bool
+	AutoComplete bool
+	Version      int64
+	ExternalID   string `sql:"index"`
+	ResourceName string `sql:"index" json:"-"`
+	Tags         []Tag  `gorm:"many2many:task_tags;" json:"Tags,omitempty"`
+	IsBlocked    bool   `sql:"-"`
+	CommentCount int    `sql:"-"`
+}
+
+// BeforeSave sets timestamps of the task. Gorm can not set them by itself,
+// because they are defined as pointers
+func (t *Task) BeforeSave() error {
+	now := time.Now()
+	if t.CreatedAt == nil {
+		t.CreatedAt = &now
+	}
+	t.UpdatedAt = &now
+	t.Version++
+
+	if t.IsAllDay {
+		t.StartAt = toDate(t.StartAt)
+		t.DueAt = toDate(t.DueAt)
+		t.SeriesStart = toDate(t.SeriesStart)
+	}
+	return nil
+}
+
+// DueTime returns the moment the task is due. Due date of all-day task
+// starts at midnight in the location of its user
+func (t *Task) DueTime(location *time.Location) *time.Time {
+	if t.DueAt == nil || !t.IsAllDay {
+		return t.DueAt
+	}
+	year, month, day := t.DueAt.Date()
+	due := time.Date(year, month, day, 0, 0, 0, 0, location)
+	return &due
+}
+
+// toDate converts time to midnight UTC of the same calendar date
+func toDate(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	year, month, day := t.Date()
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return &date
 }
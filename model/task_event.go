@@ -0,0 +1,110 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// types of task events
+const (
+	TaskEventCreated   = "created"
+	TaskEventUpdated   = "updated"
+	TaskEventCompleted = "completed"
+	TaskEventDeleted   = "deleted"
+	TaskEventRestored  = "restored"
+	TaskEventReverted  = "reverted"
+)
+
+// TaskChange defines change of a single field of the task
+type TaskChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// TaskEvent records a change of the task made by some user. Changes are
+// stored as JSON, because set of fields differs from event to event. Snapshot
+// keeps the whole task as it was saved, so the task can be reverted to its
+// version. Events of a single request share the operation id
+type TaskEvent struct {
+	Id          int64        `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	TaskID      int64        `sql:"index" json:"task_id"`
+	Version     int64        `json:"version"`
+	ActorID     int64        `sql:"index" json:"actor_id"`
+	OperationID string       `sql:"index" json:"operation_id"`
+	Type        string       `json:"type"`
+	Diff        string       `sql:"type:text" json:"-"`
+	Changes     []TaskChange `sql:"-" json:"changes"`
+	Snapshot    string       `sql:"type:text" json:"-"`
+	CreatedAt   *time.Time   `json:"created_at"`
+}
+
+// BeforeSave serializes changes and sets timestamp of the event
+func (e *TaskEvent) BeforeSave() error {
+	if e.CreatedAt == nil {
+		now := time.Now()
+		e.CreatedAt = &now
+	}
+
+	content, err := json.Marshal(e.Changes)
+	if err != nil {
+		return err
+	}
+	e.Diff = string(content)
+	return nil
+}
+
+// AfterFind restores changes from their serialized form
+func (e *TaskEvent) AfterFind() error {
+	if e.Diff == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(e.Diff), &e.Changes)
+}
+
+// taskUntrackedFields are not recorded in task events: they are either
+// immutable or maintained automatically
+var taskUntrackedFields = map[string]bool{
+	"Id":        true,
+	"UserID":    true,
+	"CreatedAt": true,
+	"UpdatedAt": true,
+	"Version":   true,
+}
+
+// DiffTasks returns changes of stored fields between two states of the task.
+// Fields which are not stored in the tasks table are ignored
+func DiffTasks(before, after *Task) []TaskChange {
+	changes := []TaskChange{}
+	beforeValue := reflect.ValueOf(before).Elem()
+	afterValue := reflect.ValueOf(after).Elem()
+
+	t := beforeValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if taskUntrackedFields[field.Name] || field.Tag.Get("sql") == "-" || field.Type.Kind() == reflect.Slice {
+			continue
+		}
+
+		b := beforeValue.Field(i).Interface()
+		a := afterValue.Field(i).Interface()
+		if !equalFields(b, a) {
+			changes = append(changes, TaskChange{Field: field.Name, Before: b, After: a})
+		}
+	}
+	return changes
+}
+
+// equalFields compares values of task fields. Times are compared as instants,
+// because the same time can be loaded from the database in another location
+func equalFields(a, b interface{}) bool {
+	if ta, ok := a.(*time.Time); ok {
+		tb := b.(*time.Time)
+		if ta == nil || tb == nil {
+			return ta == tb
+		}
+		return ta.Equal(*tb)
+	}
+	return reflect.DeepEqual(a, b)
+}
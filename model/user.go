@@ -0,0 +1,49 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// User defines a person who authenticated in our system via OAuth provider.
+// Timezone is an IANA timezone name, which is used to interpret dates of
+// all-day tasks and date based filters. Email is used to deliver reminders.
+// Admins can manage the application via /admin endpoints. Calendar token is
+// a secret part of URL of the user's calendar feed. CalDAV password is kept
+// as sha256 hash. Mail token is a secret local part of the address which
+// turns received mail into tasks
+type User struct {
+	Id             int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	FacebookID     string     `sql:"unique_index" json:"-"`
+	Name           string     `json:"name"`
+	Timezone       string     `json:"timezone"`
+	Email          string     `json:"email"`
+	IsAdmin        bool       `json:"is_admin"`
+	CalendarToken  string     `sql:"index" json:"-"`
+	CalDAVPassword string     `gorm:"column:caldav_password" json:"-"`
+	MailToken      string     `sql:"index" json:"-"`
+	CreatedAt      *time.Time `json:"created_at"`
+	UpdatedAt      *time.Time `json:"updated_at"`
+}
+
+// Location returns timezone of the user. UTC is used if timezone is not set
+func (u User) Location() (*time.Location, error) {
+	if u.Timezone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return nil, errors.New("unknown timezone: " + u.Timezone)
+	}
+	return location, nil
+}
+
+// BeforeSave sets timestamps of the user
+func (u *User) BeforeSave() error {
+	now := time.Now()
+	if u.CreatedAt == nil {
+		u.CreatedAt = &now
+	}
+	u.UpdatedAt = &now
+	return nil
+}
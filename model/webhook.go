@@ -0,0 +1,152 @@
+package model
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/seesawlabs/ivan-kirichenko-exercise/lib"
+)
+
+// WebhookEventTest is a type of event sent to check the webhook
+const WebhookEventTest = "webhook.test"
+
+// WebhookEvents lists event types webhooks can subscribe to
+var WebhookEvents = []string{
+	EventTaskCreated,
+	EventTaskUpdated,
+	EventTaskCompleted,
+	EventTaskDeleted,
+	EventTaskRestored,
+}
+
+// webhook delivery statuses. Delivery which failed all its attempts becomes
+// dead and is not retried anymore
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryDead      = "dead"
+)
+
+// Webhook defines a subscription of user's system to events of user's tasks.
+// Payloads are signed with the secret, so the receiver can verify them
+type Webhook struct {
+	Id         int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	UserID     int64      `sql:"index" json:"-"`
+	URL        string     `gorm:"column:url" json:"url"`
+	Events     string     `json:"-"`
+	EventTypes []string   `sql:"-" json:"events"`
+	Secret     string     `json:"secret"`
+	IsActive   bool       `json:"is_active"`
+	CreatedAt  *time.Time `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+}
+
+// Validate checks that webhook has an absolute http(s) URL of a public host
+// and subscribes to known events. Internal services must not be reachable
+// via webhooks, so hosts resolving to loopback, private or link-local
+// addresses are rejected
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook url must be an absolute http or https URL")
+	}
+	if err := lib.CheckPublicHost(u.Hostname()); err != nil {
+		return errors.New("webhook url must point to a public host")
+	}
+	if len(w.EventTypes) == 0 {
+		return errors.New("webhook events must be provided")
+	}
+	for _, event := range w.EventTypes {
+		if !w.knownEvent(event) {
+			return errors.New("unknown webhook event: " + event)
+		}
+	}
+	if w.Secret == "" {
+		return errors.New("webhook secret must not be empty")
+	}
+	return nil
+}
+
+func (w Webhook) knownEvent(event string) bool {
+	for _, known := range WebhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribed checks whether the webhook receives events of the type
+func (w Webhook) Subscribed(event string) bool {
+	for _, subscribed := range w.EventTypes {
+		if event == subscribed {
+			return true
+		}
+	}
+	return false
+}
+
+// BeforeSave serializes event types and sets timestamps of the webhook
+func (w *Webhook) BeforeSave() error {
+	now := time.Now()
+	if w.CreatedAt == nil {
+		w.CreatedAt = &now
+	}
+	w.UpdatedAt = &now
+	w.Events = strings.Join(w.EventTypes, ",")
+	return nil
+}
+
+// AfterFind restores event types from their serialized form
+func (w *Webhook) AfterFind() error {
+	w.EventTypes = []string{}
+	if w.Events != "" {
+		w.EventTypes = strings.Split(w.Events, ",")
+	}
+	return nil
+}
+
+// WebhookDelivery is a payload to be delivered to the webhook. It keeps
+// the outcome of the last attempt and time of the next one. EventID refers to
+// the outbox event the delivery was created for
+type WebhookDelivery struct {
+	Id            int64      `gorm:"primary_key" sql:"AUTO_INCREMENT" json:"id"`
+	WebhookID     int64      `sql:"index" json:"webhook_id"`
+	EventID       int64      `sql:"index" json:"event_id"`
+	Event         string     `json:"event"`
+	Payload       string     `sql:"type:text" json:"payload"`
+	Status        string     `sql:"index" json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `sql:"index" json:"next_attempt_at"`
+	StatusCode    int        `json:"status_code"`
+	LastError     string     `json:"last_error"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	CreatedAt     *time.Time `json:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at"`
+}
+
+// NewWebhookDelivery creates pending delivery of the payload, which should be
+// attempted right away
+func NewWebhookDelivery(webhookID, eventID int64, event, payload string) *WebhookDelivery {
+	now := time.Now()
+	return &WebhookDelivery{
+		WebhookID:     webhookID,
+		EventID:       eventID,
+		Event:         event,
+		Payload:       payload,
+		Status:        WebhookDeliveryPending,
+		NextAttemptAt: &now,
+	}
+}
+
+// BeforeSave sets timestamps of the delivery
+func (d *WebhookDelivery) BeforeSave() error {
+	now := time.Now()
+	if d.CreatedAt == nil {
+		d.CreatedAt = &now
+	}
+	d.UpdatedAt = &now
+	return nil
+}
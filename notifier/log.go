@@ -0,0 +1,26 @@
+package notifier
+
+import (
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// LogNotifier writes messages to the log. It is useful for development,
+// when no real delivery channel is configured
+type LogNotifier struct {
+	logger *logrus.Logger
+}
+
+// NewLogNotifier creates notifier which writes messages to the logger
+func NewLogNotifier(logger *logrus.Logger) *LogNotifier {
+	return &LogNotifier{logger: logger}
+}
+
+// Notify writes the message to the log
+func (n *LogNotifier) Notify(ctx context.Context, message Message) error {
+	n.logger.WithFields(logrus.Fields{
+		"user_id": message.UserID,
+		"task_id": message.TaskID,
+	}).Infof("reminder: %s", message.Subject)
+	return nil
+}
@@ -0,0 +1,24 @@
+package notifier
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Message defines a notification about a task which should be delivered to
+// the user
+type Message struct {
+	UserID  int64      `json:"user_id"`
+	To      string     `json:"to"`
+	TaskID  int64      `json:"task_id"`
+	Subject string     `json:"subject"`
+	Body    string     `json:"body"`
+	DueAt   *time.Time `json:"due_at"`
+}
+
+// Notifier defines a channel which delivers messages to users. Delivery is
+// abandoned when the context is done
+type Notifier interface {
+	Notify(ctx context.Context, message Message) error
+}
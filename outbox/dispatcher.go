@@ -0,0 +1,185 @@
+package outbox
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/seesawlabs/ivan-kirichenko-exercise/model"
+)
+
+const defaultInterval = time.Second
+const batchSize = 100
+
+// lockLease is a period the lock of a subscriber is held for. The lock is
+// renewed before every batch, so it expires only if the instance died
+const lockLease = 30 * time.Second
+
+// Handler handles a single event. Event is published again until the handler
+// succeeds, so handlers must tolerate duplicates
+type Handler func(event *model.OutboxEvent) error
+
+type subscriber struct {
+	name      string
+	handle    Handler
+	transient bool
+	position  int64
+}
+
+// Dispatcher publishes events from the outbox to subscribers in order of their
+// ids. Position of every durable subscriber is stored in the database after
+// each handled event, so every event is published at least once, even if the
+// process crashes. Subscriber which fails to handle an event gets it again on
+// the next poll and receives no later events meanwhile. Only one instance of
+// the application publishes events to a durable subscriber at a time
+type Dispatcher struct {
+	db          *gorm.DB
+	logger      *logrus.Logger
+	owner       string
+	interval    time.Duration
+	subscribers []*subscriber
+}
+
+// NewDispatcher creates dispatcher which polls the outbox with the interval.
+// Default interval is 1 second
+func NewDispatcher(db *gorm.DB, logger *logrus.Logger, interval time.Duration) *Dispatcher {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	hostname, _ := os.Hostname()
+	return &Dispatcher{
+		db:       db,
+		logger:   logger,
+		owner:    fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		interval: interval,
+	}
+}
+
+// Subscribe registers durable subscriber. Name identifies position of the
+// subscriber in the database, so it must not change between restarts
+func (d *Dispatcher) Subscribe(name string, handle Handler) {
+	d.subscribers = append(d.subscribers, &subscriber{name: name, handle: handle})
+}
+
+// SubscribeTransient registers subscriber which lives only as long as this
+// instance of the application, e.g. clients connected to it. Its position is
+// kept in memory, so every instance publishes all events to its transient
+// subscribers, starting with events written after the start
+func (d *Dispatcher) SubscribeTransient(name string, handle Handler) {
+	d.subscribers = append(d.subscribers, &subscriber{name: name, handle: handle, transient: true})
+}
+
+// Start stores positions of new subscribers and starts publishing events in
+// background. New subscriber receives only events written after it was
+// started for the first time
+func (d *Dispatcher) Start() error {
+	last := model.OutboxEvent{}
+	err := d.db.Order("id desc").First(&last).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+
+	for _, s := range d.subscribers {
+		if s.transient {
+			s.position = last.Id
+			continue
+		}
+		offset := model.OutboxOffset{}
+		err := d.db.Where(model.OutboxOffset{Subscriber: s.name}).
+			Attrs(model.OutboxOffset{Position: last.Id}).
+			FirstOrCreate(&offset).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range d.subscribers {
+		go d.run(s)
+	}
+	return nil
+}
+
+func (d *Dispatcher) run(s *subscriber) {
+	for range time.Tick(d.interval) {
+		if err := d.publish(s); err != nil {
+			d.logger.WithField("count#outbox.failure", 1).
+				Errorf("could not publish events to %s: %s", s.name, err.Error())
+		}
+	}
+}
+
+// publish passes events after the position of the subscriber to it until the
+// outbox is exhausted or the subscriber fails
+func (d *Dispatcher) publish(s *subscriber) error {
+	for {
+		if !s.transient {
+			acquired, err := d.lock(s.name)
+			if err != nil || !acquired {
+				return err
+			}
+
+			offset := model.OutboxOffset{}
+			if err := d.db.Where("subscriber = ?", s.name).First(&offset).Error; err != nil {
+				return err
+			}
+			s.position = offset.Position
+		}
+
+		events := []model.OutboxEvent{}
+		err := d.db.Where("id > ?", s.position).Order("id").Limit(batchSize).Find(&events).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range events {
+			if err := d.handle(s, &events[i]); err != nil {
+				return fmt.Errorf("event %d: %s", events[i].Id, err.Error())
+			}
+			if err := d.advance(s, events[i].Id); err != nil {
+				return err
+			}
+		}
+		if len(events) < batchSize {
+			return nil
+		}
+	}
+}
+
+// advance moves the subscriber past the handled event
+func (d *Dispatcher) advance(s *subscriber, position int64) error {
+	s.position = position
+	if s.transient {
+		return nil
+	}
+	return d.db.Model(&model.OutboxOffset{}).
+		Where("subscriber = ? and locked_by = ?", s.name, d.owner).
+		UpdateColumns(map[string]interface{}{"position": position, "updated_at": time.Now()}).Error
+}
+
+// handle passes the event to the subscriber. Panic of the subscriber is
+// reported as failure
+func (d *Dispatcher) handle(s *subscriber, event *model.OutboxEvent) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return s.handle(event)
+}
+
+// lock acquires or renews lock of the subscriber in the database
+func (d *Dispatcher) lock(name string) (bool, error) {
+	now := time.Now()
+	result := d.db.Model(&model.OutboxOffset{}).
+		Where("subscriber = ? and (locked_by = ? or locked_until is null or locked_until < ?)", name, d.owner, now).
+		UpdateColumns(map[string]interface{}{
+			"locked_by":    d.owner,
+			"locked_until": now.Add(lockLease),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRoundTrip(t, store, testKey("blob.txt"))
+}
+
+func TestLocalStoreRejectsKeysOutsideDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "..", "../escaped", "a/../../escaped", "a/.."} {
+		content := []byte("content")
+		if err := store.Put(key, bytes.NewReader(content), int64(len(content)), ""); err == nil {
+			t.Errorf("put of key %q must fail", key)
+		}
+		if _, err := store.Open(key, int64(len(content))); err == nil {
+			t.Errorf("open of key %q must fail", key)
+		}
+		if err := store.Delete(key); err == nil {
+			t.Errorf("delete of key %q must fail", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("blob must not be written outside of the store")
+	}
+}
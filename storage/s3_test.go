@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+// TestS3StoreRoundTrip runs against S3-compatible storage, e.g. a local MinIO:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//
+// It is skipped unless TEST_S3_ENDPOINT is set. TEST_S3_BUCKET must name an
+// existing bucket, TEST_S3_ACCESS_KEY and TEST_S3_SECRET_KEY the credentials
+func TestS3StoreRoundTrip(t *testing.T) {
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TEST_S3_ENDPOINT is not set")
+	}
+
+	store, err := NewS3Store(S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("TEST_S3_REGION"),
+		Bucket:    os.Getenv("TEST_S3_BUCKET"),
+		AccessKey: os.Getenv("TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("TEST_S3_SECRET_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRoundTrip(t, store, testKey("blob with spaces+plus.txt"))
+}
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when requested blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// ReadSeekCloser defines blob opened for reading. Seeking allows to serve
+// ranges of the blob
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// BlobStore defines storage of binary objects by key
+type BlobStore interface {
+	// Put stores size bytes read from r under the key
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Open opens the blob of given size for reading
+	Open(key string, size int64) (ReadSeekCloser, error)
+	// Delete removes the blob. Missing blob is not an error
+	Delete(key string) error
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRoundTrip stores a blob, serves a range of it the way attachments are
+// downloaded, and deletes it
+func testRoundTrip(t *testing.T, store BlobStore, key string) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if err := store.Put(key, bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	blob, err := store.Open(key, int64(len(content)))
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	req := httptest.NewRequest("GET", "/blob", nil)
+	req.Header.Set("Range", "bytes=10-15")
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "blob.txt", time.Time{}, blob)
+	blob.Close()
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, rec.Code)
+	}
+	if body := rec.Body.String(); body != "abcdef" {
+		t.Fatalf("expected range abcdef, got %q", body)
+	}
+
+	blob, err = store.Open(key, int64(len(content)))
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	whole, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil || !bytes.Equal(whole, content) {
+		t.Fatalf("expected content %q, got %q (%v)", content, whole, err)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := store.Open(key, int64(len(content))); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("delete of missing blob: %s", err)
+	}
+}
+
+// testKey returns a key which does not collide with blobs of previous runs
+func testKey(name string) string {
+	return strings.Join([]string{"test", time.Now().Format("20060102150405.000000000"), name}, "/")
+}
@@ -15,6 +15,7 @@ func main() {
 
 	configPath := flag.String("config", "config.yaml", "mandatory path to config file")
 	migrate := flag.Bool("migrate", false, "path to directiry with migration scripts. If provided, runs database migrations and exits")
+	flag.Parse()
 
 	if configPath == nil {
 		logger.Fatal("config file must be provided")